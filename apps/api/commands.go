@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+)
+
+// command is a maintenance subcommand run instead of the node, as in
+// `api reindex -data-dir ./data`.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"reindex": {"rebuild the transaction and address indexes", runReindex},
+	"export":  {"write a range of blocks to a chain archive", runExport},
+	"import":  {"validate and add the blocks of a chain archive", runImport},
+	"fsck":    {"check the database and optionally repair it", runFsck},
+
+	"export-snapshot": {"write the account state at a height to a snapshot", runExportSnapshot},
+	"import-snapshot": {"start a new node from a verified snapshot", runImportSnapshot},
+}
+
+// usage lists the subcommands before the node flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(out, "\nWithout a command the node is started with these flags:\n")
+	flag.PrintDefaults()
+}
+
+func defaultDataDir() string {
+	home, _ := os.UserHomeDir()
+	return home + "/.fernet-token"
+}
+
+// openStorage opens the node database in dataDir without starting a node.
+func openStorage(dataDir string) (*blockchain.BoltStorage, error) {
+	path := filepath.Join(dataDir, "blockchain.db")
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no database at %s: %w", path, err)
+	}
+	return blockchain.NewBoltStorage(path)
+}
+
+// loadGenesis loads the genesis file at path, or returns nil for the default
+// genesis if path is empty.
+func loadGenesis(path string) (*blockchain.Genesis, error) {
+	if path == "" {
+		return nil, nil
+	}
+	genesis, err := blockchain.LoadGenesis(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load genesis: %w", err)
+	}
+	return genesis, nil
+}
+
+// openChain opens the node database in dataDir as a blockchain, creating the
+// database if create is set.
+func openChain(dataDir, genesisPath string, create bool) (*blockchain.Blockchain, *blockchain.BoltStorage, error) {
+	genesis, err := loadGenesis(genesisPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var store *blockchain.BoltStorage
+	if create {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, nil, err
+		}
+		store, err = blockchain.NewBoltStorage(filepath.Join(dataDir, "blockchain.db"))
+	} else {
+		store, err = openStorage(dataDir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bc, err := blockchain.NewBlockchain(store, genesis)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return bc, store, nil
+}
+
+func runReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory")
+	fs.Parse(args)
+
+	store, err := openStorage(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Reindex(); err != nil {
+		return fmt.Errorf("failed to rebuild indexes: %w", err)
+	}
+	log.Println("Rebuilt transaction and address indexes")
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory")
+	genesisPath := fs.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	out := fs.String("out", "", "Archive file to write")
+	from := fs.Uint64("from", 0, "First height to export")
+	to := fs.Uint64("to", math.MaxUint64, "Last height to export (default: tip)")
+	fs.Parse(args)
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	bc, store, err := openChain(*dataDir, *genesisPath, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	header, err := bc.Export(f, *from, *to)
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported blocks %d to %d to %s", header.From, header.From+header.Count-1, *out)
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory, created if needed")
+	genesisPath := fs.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	in := fs.String("in", "", "Archive file to read")
+	fs.Parse(args)
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bc, store, err := openChain(*dataDir, *genesisPath, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := bc.Import(f)
+	if result != nil {
+		log.Printf("Imported %d blocks, skipped %d already known; tip is now %d", result.Added, result.Skipped, bc.GetLatestBlock().Index)
+	}
+	return err
+}
+
+func runExportSnapshot(args []string) error {
+	fs := flag.NewFlagSet("export-snapshot", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory")
+	genesisPath := fs.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	out := fs.String("out", "", "Snapshot file to write")
+	height := fs.Uint64("height", 0, "Height to take the snapshot at (default: tip)")
+	fs.Parse(args)
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	bc, store, err := openChain(*dataDir, *genesisPath, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *height == 0 {
+		*height = bc.GetLatestBlock().Index
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	info, err := bc.ExportSnapshot(f, *height)
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported state of %d accounts at block %d (%s) to %s", info.Accounts, info.Height, info.Hash, *out)
+	return nil
+}
+
+func runImportSnapshot(args []string) error {
+	fs := flag.NewFlagSet("import-snapshot", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory, created if needed")
+	genesisPath := fs.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	in := fs.String("in", "", "Snapshot file to read")
+	fs.Parse(args)
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bc, store, err := openChain(*dataDir, *genesisPath, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	info, err := bc.ImportSnapshot(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported state of %d accounts at block %d (%s); start the node to sync from there", info.Accounts, info.Height, info.Hash)
+	return nil
+}
+
+func runFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dataDir := fs.String("data-dir", defaultDataDir(), "Data directory")
+	genesisPath := fs.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	repair := fs.Bool("repair", false, "Truncate to the last good block and rebuild state and indexes")
+	fs.Parse(args)
+
+	genesis, err := loadGenesis(*genesisPath)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStorage(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := blockchain.Fsck(store, genesis)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		log.Printf("Problem: %s", problem)
+	}
+	log.Printf("%d blocks stored, %d intact", report.Stored, report.Intact)
+	if report.OK() {
+		log.Println("No problems found")
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("found %d problems; run with -repair to keep the %d intact blocks and rebuild state and indexes", len(report.Problems), report.Intact)
+	}
+
+	if err := store.Repair(report); err != nil {
+		return fmt.Errorf("repair failed: %w", err)
+	}
+	log.Printf("Repaired database: kept %d blocks and rebuilt state and indexes", report.Intact)
+	return nil
+}
@@ -2,45 +2,96 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 
 	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/faucet"
 	"github.com/nawesan12/fernet-token/packages/node"
 	"github.com/nawesan12/fernet-token/packages/wallet"
 )
 
+// GET /api/blockchain returns a page of blocks rather than the whole chain.
+const (
+	defaultBlockPage = 20
+	maxBlockPage     = 100
+)
+
 type APIHandler struct {
-	node *node.Node
+	node   *node.Node
+	faucet *faucet.Faucet // nil when no faucet key is configured
 }
 
-func NewAPIHandler(n *node.Node) *APIHandler {
-	return &APIHandler{node: n}
+func NewAPIHandler(n *node.Node, f *faucet.Faucet) *APIHandler {
+	return &APIHandler{node: n, faucet: f}
 }
 
 func (h *APIHandler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/blockchain", h.getBlockchain)
 	mux.HandleFunc("GET /api/blockchain/height", h.getHeight)
+	mux.HandleFunc("GET /api/chain", h.getChainInfo)
+	mux.HandleFunc("GET /api/supply", h.getSupply)
 	mux.HandleFunc("GET /api/block/{index}", h.getBlock)
 	mux.HandleFunc("GET /api/balance/{address}", h.getBalance)
 	mux.HandleFunc("GET /api/nonce/{address}", h.getNonce)
 	mux.HandleFunc("GET /api/tx/pending", h.getPending)
 	mux.HandleFunc("GET /api/tx/{id}", h.getTransaction)
+	mux.HandleFunc("GET /api/tx/{id}/proof", h.getTransactionProof)
 	mux.HandleFunc("GET /api/address/{address}/transactions", h.getAddressTransactions)
 	mux.HandleFunc("GET /api/peers", h.getPeers)
 	mux.HandleFunc("POST /api/wallet/create", h.createWallet)
 	mux.HandleFunc("POST /api/transaction", h.submitTransaction)
 	mux.HandleFunc("POST /api/mine", h.mine)
 	mux.HandleFunc("POST /api/peers/connect", h.connectPeer)
-	mux.HandleFunc("POST /api/faucet", h.faucet)
+	mux.HandleFunc("GET /api/faucet", h.getFaucetStatus)
+	mux.HandleFunc("POST /api/faucet", h.requestFaucet)
 }
 
+// getBlockchain returns count blocks starting at from, defaulting to the
+// latest blocks.
 func (h *APIHandler) getBlockchain(w http.ResponseWriter, r *http.Request) {
-	chain := h.node.Blockchain.GetChain()
+	height := h.node.Blockchain.Height()
+	count := uint64(defaultBlockPage)
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		parsed, err := strconv.ParseUint(countStr, 10, 64)
+		if err != nil || parsed == 0 {
+			writeError(w, http.StatusBadRequest, "invalid count")
+			return
+		}
+		count = min(parsed, maxBlockPage)
+	}
+	var from uint64
+	if height > count {
+		from = height - count
+	}
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := strconv.ParseUint(fromStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from")
+			return
+		}
+		from = parsed
+	}
+
+	var blocks []blockchain.Block
+	if from < height {
+		var err error
+		blocks, err = h.node.Blockchain.GetBlocks(from, from+count-1)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load blocks")
+			return
+		}
+	}
+	if blocks == nil {
+		blocks = []blockchain.Block{}
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"chain":  chain,
-		"height": len(chain),
+		"chain":  blocks,
+		"from":   from,
+		"height": height,
 	})
 }
 
@@ -50,6 +101,36 @@ func (h *APIHandler) getHeight(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *APIHandler) getChainInfo(w http.ResponseWriter, r *http.Request) {
+	genesis, _ := h.node.Blockchain.GetBlock(0)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"chainId":     h.node.Blockchain.ChainID(),
+		"genesisHash": genesis.Hash,
+	})
+}
+
+func (h *APIHandler) getSupply(w http.ResponseWriter, r *http.Request) {
+	height := h.node.Blockchain.GetLatestBlock().Index
+	if heightStr := r.URL.Query().Get("height"); heightStr != "" {
+		parsed, err := strconv.ParseUint(heightStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid height")
+			return
+		}
+		height = parsed
+	}
+
+	genesis := h.node.Blockchain.Genesis()
+	supply := genesis.SupplyAtHeight(height)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"height":      height,
+		"supply":      supply,
+		"formatted":   formatFernet(supply),
+		"totalSupply": blockchain.TotalSupply,
+		"blockReward": genesis.BlockReward(height + 1),
+	})
+}
+
 func (h *APIHandler) getBlock(w http.ResponseWriter, r *http.Request) {
 	indexStr := r.PathValue("index")
 	index, err := strconv.ParseUint(indexStr, 10, 64)
@@ -108,6 +189,17 @@ func (h *APIHandler) getTransaction(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, result)
 }
 
+func (h *APIHandler) getTransactionProof(w http.ResponseWriter, r *http.Request) {
+	txID := r.PathValue("id")
+	proof, err := h.node.Blockchain.GetMerkleProof(txID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, proof)
+}
+
 func (h *APIHandler) getAddressTransactions(w http.ResponseWriter, r *http.Request) {
 	address := r.PathValue("address")
 	results := h.node.Blockchain.GetAddressTransactions(address)
@@ -125,6 +217,7 @@ func (h *APIHandler) getPeers(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"peers": h.node.P2P.PeerAddresses(),
 		"count": h.node.P2P.PeerCount(),
+		"known": h.node.P2P.PeerBook().Len(),
 	})
 }
 
@@ -143,6 +236,7 @@ func (h *APIHandler) createWallet(w http.ResponseWriter, r *http.Request) {
 
 type submitTxRequest struct {
 	ID        string `json:"id"`
+	ChainID   string `json:"chainId"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Amount    uint64 `json:"amount"`
@@ -162,6 +256,7 @@ func (h *APIHandler) submitTransaction(w http.ResponseWriter, r *http.Request) {
 
 	tx := &blockchain.Transaction{
 		ID:        req.ID,
+		ChainID:   req.ChainID,
 		Sender:    req.Sender,
 		Receiver:  req.Receiver,
 		Amount:    req.Amount,
@@ -221,6 +316,8 @@ func (h *APIHandler) connectPeer(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	// Redial the peer if the connection drops
+	h.node.P2P.AddPersistentPeer(req.Address)
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"message": "connected to peer",
@@ -232,21 +329,59 @@ type faucetRequest struct {
 	Address string `json:"address"`
 }
 
-func (h *APIHandler) faucet(w http.ResponseWriter, r *http.Request) {
+func (h *APIHandler) getFaucetStatus(w http.ResponseWriter, r *http.Request) {
+	if h.faucet == nil {
+		writeError(w, http.StatusServiceUnavailable, "faucet disabled")
+		return
+	}
+
+	status := h.faucet.Status()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"address":         status.Address,
+		"balance":         status.Balance,
+		"formatted":       formatFernet(status.Balance),
+		"amount":          status.Amount,
+		"fee":             status.Fee,
+		"pending":         status.Pending,
+		"addressCooldown": status.AddressCooldown,
+		"ipCooldown":      status.IPCooldown,
+	})
+}
+
+func (h *APIHandler) requestFaucet(w http.ResponseWriter, r *http.Request) {
+	if h.faucet == nil {
+		writeError(w, http.StatusServiceUnavailable, "faucet disabled")
+		return
+	}
+
 	var req faucetRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Address == "" {
 		writeError(w, http.StatusBadRequest, "address required")
 		return
 	}
 
-	amount := uint64(100) * blockchain.OneFernet
-	h.node.Blockchain.CreditAddress(req.Address, amount)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"message": "faucet: credited 100 FERNET",
-		"address": req.Address,
-		"amount":  amount,
-		"formatted": formatFernet(amount),
+	tx, err := h.faucet.Request(req.Address, ip)
+	if err != nil {
+		var cooldown *faucet.CooldownError
+		if errors.As(err, &cooldown) {
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":   "faucet transaction submitted",
+		"address":   req.Address,
+		"amount":    tx.Amount,
+		"formatted": formatFernet(tx.Amount),
+		"txId":      tx.ID,
 	})
 }
 
@@ -11,26 +11,55 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/faucet"
 	"github.com/nawesan12/fernet-token/packages/node"
+	"github.com/nawesan12/fernet-token/packages/p2p"
+	"github.com/nawesan12/fernet-token/packages/wallet"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+	runNode()
+}
+
+func runNode() {
+	flag.Usage = usage
 	httpPort := flag.String("http-port", "8080", "HTTP API port")
 	p2pPort := flag.String("p2p-port", "6000", "P2P network port")
 	dataDir := flag.String("data-dir", "", "Data directory (default: ~/.fernet-token)")
 	miner := flag.String("miner", "", "Default miner address")
 	peers := flag.String("peers", "", "Comma-separated list of seed peers (host:port)")
+	genesisPath := flag.String("genesis", "", "Genesis file (default: built-in test network genesis)")
+	faucetKey := flag.String("faucet-key", "", "PEM private key of a funded account to run the faucet from")
+	maxInbound := flag.Int("max-inbound", p2p.DefaultMaxInbound, "Maximum number of inbound P2P connections")
+	maxOutbound := flag.Int("max-outbound", p2p.DefaultMaxOutbound, "Number of outbound P2P connections to keep from the peer book")
 	flag.Parse()
 
 	if *dataDir == "" {
-		home, _ := os.UserHomeDir()
-		*dataDir = home + "/.fernet-token"
+		*dataDir = defaultDataDir()
 	}
 	os.MkdirAll(*dataDir, 0755)
 
 	cfg := node.Config{
-		DataDir: *dataDir,
-		P2PPort: *p2pPort,
+		DataDir:     *dataDir,
+		P2PPort:     *p2pPort,
+		MaxInbound:  *maxInbound,
+		MaxOutbound: *maxOutbound,
+	}
+	if *genesisPath != "" {
+		genesis, err := blockchain.LoadGenesis(*genesisPath)
+		if err != nil {
+			log.Fatalf("Failed to load genesis: %v", err)
+		}
+		cfg.Genesis = genesis
 	}
 
 	n, err := node.NewNode(cfg)
@@ -41,22 +70,31 @@ func main() {
 	// Start P2P
 	n.StartP2P()
 
-	// Connect to seed peers
+	// Stay connected to seed peers, redialing those that are down
 	if *peers != "" {
 		for _, addr := range strings.Split(*peers, ",") {
 			addr = strings.TrimSpace(addr)
 			if addr != "" {
-				if err := n.P2P.ConnectToPeer(addr); err != nil {
-					log.Printf("Failed to connect to peer %s: %v", addr, err)
-				}
+				n.P2P.AddPersistentPeer(addr)
 			}
 		}
 	}
 
 	_ = miner // available for future auto-mining
 
+	// Setup faucet
+	var f *faucet.Faucet
+	if *faucetKey != "" {
+		w, err := wallet.LoadFromFile(*faucetKey)
+		if err != nil {
+			log.Fatalf("Failed to load faucet key: %v", err)
+		}
+		f = faucet.New(n, w, faucet.DefaultConfig())
+		log.Printf("Faucet enabled from %s (balance %d)", w.Address, n.Blockchain.GetBalance(w.Address))
+	}
+
 	// Setup HTTP
-	handler := NewAPIHandler(n)
+	handler := NewAPIHandler(n, f)
 	mux := http.NewServeMux()
 	handler.RegisterRoutes(mux)
 
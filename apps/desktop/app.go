@@ -111,7 +111,8 @@ func (a *App) SendTransaction(receiver string, amount, fee uint64) map[string]st
 	}
 
 	nonce := a.node.Blockchain.GetNonce(a.wallet.Address)
-	tx := blockchain.NewTransaction(a.wallet.Address, receiver, amount, fee, nonce, a.wallet.PublicKey)
+	chainID := a.node.Blockchain.ChainID()
+	tx := blockchain.NewTransaction(chainID, a.wallet.Address, receiver, amount, fee, nonce, a.wallet.PublicKey)
 
 	sig, err := a.wallet.Sign(tx.SignableData())
 	if err != nil {
@@ -168,7 +169,9 @@ func (a *App) GetBlock(index uint64) map[string]interface{} {
 		"index":        block.Index,
 		"hash":         block.Hash,
 		"prevHash":     block.PrevHash,
+		"merkleRoot":   block.MerkleRoot,
 		"timestamp":    block.Timestamp,
+		"target":       block.Target,
 		"miner":        block.Miner,
 		"nonce":        block.Nonce,
 		"transactions": block.Transactions,
@@ -180,14 +183,21 @@ func (a *App) GetRecentBlocks(count int) []map[string]interface{} {
 	if a.node == nil {
 		return nil
 	}
-	chain := a.node.Blockchain.GetChain()
-	start := len(chain) - count
-	if start < 0 {
-		start = 0
+	height := a.node.Blockchain.Height()
+	start := uint64(0)
+	if count < 0 {
+		count = 0
+	}
+	if height > uint64(count) {
+		start = height - uint64(count)
+	}
+	chain, err := a.node.Blockchain.GetBlocks(start, height-1)
+	if err != nil {
+		return nil
 	}
 
 	var result []map[string]interface{}
-	for i := len(chain) - 1; i >= start; i-- {
+	for i := len(chain) - 1; i >= 0; i-- {
 		b := chain[i]
 		result = append(result, map[string]interface{}{
 			"index":     b.Index,
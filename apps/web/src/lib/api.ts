@@ -2,6 +2,7 @@ const API_BASE = 'http://localhost:8080/api';
 
 export interface Transaction {
 	id: string;
+	chainId: string;
 	sender: string;
 	receiver: string;
 	amount: number;
@@ -17,7 +18,10 @@ export interface Block {
 	timestamp: number;
 	transactions: Transaction[];
 	prevHash: string;
+	merkleRoot: string;
+	stateRoot: string;
 	hash: string;
+	target: string;
 	nonce: number;
 	miner: string;
 }
@@ -32,8 +36,41 @@ export interface HeightResponse {
 	height: number;
 }
 
+export interface FaucetStatusResponse {
+	address: string;
+	balance: number;
+	formatted: string;
+	amount: number;
+	fee: number;
+	pending: number;
+	addressCooldown: number;
+	ipCooldown: number;
+}
+
+export interface FaucetResponse {
+	message: string;
+	address: string;
+	amount: number;
+	formatted: string;
+	txId: string;
+}
+
+export interface ChainInfoResponse {
+	chainId: string;
+	genesisHash: string;
+}
+
+export interface SupplyResponse {
+	height: number;
+	supply: number;
+	formatted: string;
+	totalSupply: number;
+	blockReward: number;
+}
+
 export interface BlockchainResponse {
 	chain: Block[];
+	from: number;
 	height: number;
 }
 
@@ -63,6 +100,19 @@ export interface TxResult {
 	blockHash: string;
 }
 
+export interface MerkleStep {
+	hash: string;
+	left: boolean;
+}
+
+export interface MerkleProof {
+	txId: string;
+	blockIndex: number;
+	blockHash: string;
+	merkleRoot: string;
+	path: MerkleStep[];
+}
+
 export interface AddressTransactionsResponse {
 	address: string;
 	transactions: TxResult[];
@@ -79,10 +129,22 @@ async function fetchJSON<T>(url: string, options?: RequestInit): Promise<T> {
 }
 
 export const api = {
-	getBlockchain: () => fetchJSON<BlockchainResponse>(`${API_BASE}/blockchain`),
+	// Without arguments the latest blocks are returned; count is capped at 100
+	getBlockchain: (from?: number, count?: number) => {
+		const params = new URLSearchParams();
+		if (from !== undefined) params.set('from', String(from));
+		if (count !== undefined) params.set('count', String(count));
+		const query = params.toString();
+		return fetchJSON<BlockchainResponse>(`${API_BASE}/blockchain${query ? `?${query}` : ''}`);
+	},
 
 	getHeight: () => fetchJSON<HeightResponse>(`${API_BASE}/blockchain/height`),
 
+	getChainInfo: () => fetchJSON<ChainInfoResponse>(`${API_BASE}/chain`),
+
+	getSupply: (height?: number) =>
+		fetchJSON<SupplyResponse>(`${API_BASE}/supply${height === undefined ? '' : `?height=${height}`}`),
+
 	getBlock: (index: number) => fetchJSON<Block>(`${API_BASE}/block/${index}`),
 
 	getBalance: (address: string) => fetchJSON<BalanceResponse>(`${API_BASE}/balance/${address}`),
@@ -117,8 +179,10 @@ export const api = {
 			body: JSON.stringify({ address })
 		}),
 
+	getFaucetStatus: () => fetchJSON<FaucetStatusResponse>(`${API_BASE}/faucet`),
+
 	faucet: (address: string) =>
-		fetchJSON<{ message: string; amount: number; formatted: string }>(`${API_BASE}/faucet`, {
+		fetchJSON<FaucetResponse>(`${API_BASE}/faucet`, {
 			method: 'POST',
 			headers: { 'Content-Type': 'application/json' },
 			body: JSON.stringify({ address })
@@ -127,6 +191,8 @@ export const api = {
 	getTransaction: (id: string) =>
 		fetchJSON<TxResult>(`${API_BASE}/tx/${id}`),
 
+	getTransactionProof: (id: string) => fetchJSON<MerkleProof>(`${API_BASE}/tx/${id}/proof`),
+
 	getAddressTransactions: (address: string) =>
 		fetchJSON<AddressTransactionsResponse>(`${API_BASE}/address/${address}/transactions`)
 };
@@ -1,6 +1,8 @@
 // Client-side wallet crypto using Web Crypto API (ECDSA P-256)
 // Private keys never leave the browser.
 
+import { encodeSignableTx, type SignableTx } from './encoding';
+
 export interface WalletKeys {
 	privateKey: CryptoKey;
 	publicKey: CryptoKey;
@@ -41,14 +43,9 @@ async function deriveAddress(publicKeyHex: string): Promise<string> {
 	return bufToHex(hashBytes.slice(0, 20));
 }
 
-export async function signTransaction(
-	privateKey: CryptoKey,
-	signableData: string
-): Promise<string> {
-	// SHA-256 hash of the signable data string
-	const encoder = new TextEncoder();
-	const dataBytes = encoder.encode(signableData);
-	const hashBuf = await crypto.subtle.digest('SHA-256', dataBytes);
+export async function signTransaction(privateKey: CryptoKey, tx: SignableTx): Promise<string> {
+	// SHA-256 hash of the canonical signable encoding
+	const hashBuf = await crypto.subtle.digest('SHA-256', encodeSignableTx(tx));
 
 	// Sign the hash with ECDSA
 	const sigBuf = await crypto.subtle.sign(
@@ -61,17 +58,6 @@ export async function signTransaction(
 	return bufToHex(new Uint8Array(sigBuf));
 }
 
-export function buildSignableData(
-	sender: string,
-	receiver: string,
-	amount: number,
-	fee: number,
-	nonce: number,
-	timestamp: number
-): string {
-	return `${sender}:${receiver}:${amount}:${fee}:${nonce}:${timestamp}`;
-}
-
 export async function exportPrivateKeyJWK(key: CryptoKey): Promise<JsonWebKey> {
 	return crypto.subtle.exportKey('jwk', key);
 }
@@ -116,16 +102,8 @@ function hexToBuf(hex: string): Uint8Array {
 	return bytes;
 }
 
-export async function computeTxHash(
-	sender: string,
-	receiver: string,
-	amount: number,
-	fee: number,
-	nonce: number,
-	timestamp: number
-): Promise<string> {
-	const data = `${sender}:${receiver}:${amount}:${fee}:${nonce}:${timestamp}`;
-	const encoder = new TextEncoder();
-	const hashBuf = await crypto.subtle.digest('SHA-256', encoder.encode(data));
+// Transaction ID: SHA-256 of the canonical signable encoding (matches Transaction.CalculateHash in Go).
+export async function computeTxHash(tx: SignableTx): Promise<string> {
+	const hashBuf = await crypto.subtle.digest('SHA-256', encodeSignableTx(tx));
 	return bufToHex(new Uint8Array(hashBuf));
 }
@@ -0,0 +1,74 @@
+// Canonical binary encoding of transactions (matches packages/blockchain/encoding.go).
+// Integers are big-endian, strings are a uint32 length followed by UTF-8 bytes.
+// Test vectors: packages/blockchain/testdata/encoding_vectors.json
+
+// Transaction encoding version (TxEncodingVersion in the Go package).
+export const ENCODING_VERSION = 1;
+
+export interface SignableTx {
+	chainId: string;
+	sender: string;
+	receiver: string;
+	amount: number | bigint;
+	fee: number | bigint;
+	nonce: number | bigint;
+	timestamp: number | bigint;
+}
+
+class Encoder {
+	private parts: Uint8Array[] = [];
+
+	byte(v: number) {
+		this.parts.push(new Uint8Array([v]));
+	}
+
+	uint32(v: number) {
+		const b = new Uint8Array(4);
+		new DataView(b.buffer).setUint32(0, v);
+		this.parts.push(b);
+	}
+
+	uint64(v: number | bigint) {
+		const b = new Uint8Array(8);
+		new DataView(b.buffer).setBigUint64(0, BigInt(v));
+		this.parts.push(b);
+	}
+
+	int64(v: number | bigint) {
+		const b = new Uint8Array(8);
+		new DataView(b.buffer).setBigInt64(0, BigInt(v));
+		this.parts.push(b);
+	}
+
+	string(s: string) {
+		const bytes = new TextEncoder().encode(s);
+		this.uint32(bytes.length);
+		this.parts.push(bytes);
+	}
+
+	finish(): Uint8Array {
+		const out = new Uint8Array(this.parts.reduce((n, p) => n + p.length, 0));
+		let offset = 0;
+		for (const p of this.parts) {
+			out.set(p, offset);
+			offset += p.length;
+		}
+		return out;
+	}
+}
+
+// encodeSignableTx returns the bytes covered by the transaction ID and signature.
+// Numbers must be exact integers; timestamps above 2^53 should be passed as bigint
+// or be exactly representable (e.g. whole seconds in nanoseconds).
+export function encodeSignableTx(tx: SignableTx): Uint8Array {
+	const e = new Encoder();
+	e.byte(ENCODING_VERSION);
+	e.string(tx.chainId);
+	e.string(tx.sender);
+	e.string(tx.receiver);
+	e.uint64(tx.amount);
+	e.uint64(tx.fee);
+	e.uint64(tx.nonce);
+	e.int64(tx.timestamp);
+	return e.finish();
+}
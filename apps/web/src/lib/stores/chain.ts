@@ -22,13 +22,12 @@ export const chainStore = writable<ChainState>(initial);
 export async function refreshChain() {
 	try {
 		const [chainRes, pendingRes, peersRes] = await Promise.all([
-			api.getBlockchain(),
+			api.getBlockchain(undefined, 10),
 			api.getPending(),
 			api.getPeers()
 		]);
 
-		const blocks = chainRes.chain || [];
-		const recent = blocks.slice(-10).reverse();
+		const recent = (chainRes.chain || []).slice().reverse();
 
 		chainStore.set({
 			height: chainRes.height,
@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ArchiveVersion is the version of the chain archive format written by
+// Export.
+//
+// Layout (integers big-endian, strings as a uint32 length followed by bytes):
+//
+//	archive: magic "FRNCHAIN" | version | genesis hash | from u64 | count u64 | block*
+//	block:   length u32 | block encoding (see HeaderEncodingVersion)
+//
+// Blocks are written in height order, so an archive can be produced and
+// consumed one block at a time.
+const ArchiveVersion byte = 1
+
+const maxArchiveBlock = 64 << 20
+
+var archiveMagic = [8]byte{'F', 'R', 'N', 'C', 'H', 'A', 'I', 'N'}
+
+var ErrNotArchive = errors.New("not a chain archive")
+
+// ArchiveHeader describes the blocks held in an archive.
+type ArchiveHeader struct {
+	Version     byte
+	GenesisHash string
+	From        uint64
+	Count       uint64
+}
+
+// Export writes the main chain blocks from height from to to, inclusive, to
+// w. to is clamped to the tip. The chain is locked against updates while the
+// blocks are streamed from storage.
+func (bc *Blockchain) Export(w io.Writer, from, to uint64) (*ArchiveHeader, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if tip := uint64(len(bc.headers)) - 1; to > tip {
+		to = tip
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid range %d to %d", from, to)
+	}
+	if bc.base > 0 && from <= bc.base {
+		return nil, fmt.Errorf("blocks up to %d were imported from a snapshot and have no transactions", bc.base)
+	}
+	header := &ArchiveHeader{
+		Version:     ArchiveVersion,
+		GenesisHash: bc.headers[0].Hash,
+		From:        from,
+		Count:       to - from + 1,
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeArchiveHeader(bw, header); err != nil {
+		return nil, err
+	}
+	written := uint64(0)
+	err := bc.store.IterateBlocks(from, to, func(block *Block) error {
+		if block.Hash != bc.headers[block.Index].Hash {
+			return fmt.Errorf("stored block %d does not match the main chain", block.Index)
+		}
+		data, err := block.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+		if _, err := bw.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export blocks: %w", err)
+	}
+	if written != header.Count {
+		return nil, fmt.Errorf("storage holds %d of %d blocks", written, header.Count)
+	}
+	return header, bw.Flush()
+}
+
+func writeArchiveHeader(w io.Writer, h *ArchiveHeader) error {
+	var e encoder
+	e.buf.Write(archiveMagic[:])
+	e.byte(h.Version)
+	e.string(h.GenesisHash)
+	e.uint64(h.From)
+	e.uint64(h.Count)
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+// ArchiveReader reads the blocks of an archive one at a time.
+type ArchiveReader struct {
+	Header ArchiveHeader
+	r      *bufio.Reader
+	read   uint64
+}
+
+// NewArchiveReader reads and checks the archive header from r.
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	br := bufio.NewReader(r)
+	var fixed [9]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, ErrNotArchive
+	}
+	if [8]byte(fixed[:8]) != archiveMagic {
+		return nil, ErrNotArchive
+	}
+	if fixed[8] != ArchiveVersion {
+		return nil, fmt.Errorf("%w: archive version %d", ErrUnknownEncodingVersion, fixed[8])
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(br, length[:]); err != nil {
+		return nil, fmt.Errorf("truncated archive header: %w", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxEncodedString {
+		return nil, fmt.Errorf("genesis hash of %d bytes exceeds limit", n)
+	}
+	rest := make([]byte, int(n)+16)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("truncated archive header: %w", err)
+	}
+
+	return &ArchiveReader{
+		Header: ArchiveHeader{
+			Version:     fixed[8],
+			GenesisHash: string(rest[:n]),
+			From:        binary.BigEndian.Uint64(rest[n:]),
+			Count:       binary.BigEndian.Uint64(rest[n+8:]),
+		},
+		r: br,
+	}, nil
+}
+
+// Next returns the next block, or io.EOF once every block in the header's
+// count has been read.
+func (a *ArchiveReader) Next() (*Block, error) {
+	if a.read == a.Header.Count {
+		return nil, io.EOF
+	}
+	height := a.Header.From + a.read
+
+	var length [4]byte
+	if _, err := io.ReadFull(a.r, length[:]); err != nil {
+		return nil, fmt.Errorf("block %d: archive truncated: %w", height, err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxArchiveBlock {
+		return nil, fmt.Errorf("block %d: %d bytes exceeds limit", height, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(a.r, data); err != nil {
+		return nil, fmt.Errorf("block %d: archive truncated: %w", height, err)
+	}
+
+	var block Block
+	if err := block.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("block %d: %w", height, err)
+	}
+	if block.Index != height {
+		return nil, fmt.Errorf("expected block %d, found %d", height, block.Index)
+	}
+	a.read++
+	return &block, nil
+}
+
+// ImportResult counts the blocks read from an archive.
+type ImportResult struct {
+	Added   int // blocks accepted into the block tree
+	Skipped int // blocks already known
+}
+
+// Import reads an archive from r and adds each block through the normal
+// consensus checks, as if it had been received from a peer. Blocks already
+// known are skipped. The archive must start at or below the current tip
+// plus one and belong to this chain's genesis.
+func (bc *Blockchain) Import(r io.Reader) (*ImportResult, error) {
+	archive, err := NewArchiveReader(r)
+	if err != nil {
+		return nil, err
+	}
+	bc.mu.RLock()
+	genesis := bc.headers[0].Hash
+	bc.mu.RUnlock()
+	if archive.Header.GenesisHash != genesis {
+		return nil, fmt.Errorf("archive belongs to genesis %s, expected %s", archive.Header.GenesisHash, genesis)
+	}
+
+	result := &ImportResult{}
+	for {
+		block, err := archive.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		_, err = bc.AddBlock(block)
+		if errors.Is(err, ErrKnownBlock) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("block %d: %w", block.Index, err)
+		}
+		result.Added++
+	}
+}
@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 4; i++ {
+		src.MineBlock("miner1", nil)
+	}
+
+	var buf bytes.Buffer
+	header, err := src.Export(&buf, 0, 100)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if header.From != 0 || header.Count != 5 {
+		t.Fatalf("expected blocks 0 to 4, got %d from %d", header.Count, header.From)
+	}
+
+	dst, _ := NewBlockchain(NewMemoryStorage(), nil)
+	result, err := dst.Import(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Added != 4 || result.Skipped != 1 {
+		t.Errorf("expected 4 added and 1 skipped, got %d and %d", result.Added, result.Skipped)
+	}
+	if dst.GetLatestBlock().Hash != src.GetLatestBlock().Hash {
+		t.Error("imported chain should have the exported tip")
+	}
+	if dst.GetBalance("miner1") != src.GetBalance("miner1") {
+		t.Error("imported chain should have the same state")
+	}
+
+	// Importing again adds nothing
+	result, err = dst.Import(bytes.NewReader(buf.Bytes()))
+	if err != nil || result.Added != 0 || result.Skipped != 5 {
+		t.Errorf("re-import should skip every block: %+v, %v", result, err)
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	src, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 4; i++ {
+		src.MineBlock("miner1", nil)
+	}
+
+	var first, second bytes.Buffer
+	src.Export(&first, 0, 2)
+	src.Export(&second, 3, 4)
+
+	dst, _ := NewBlockchain(NewMemoryStorage(), nil)
+	if _, err := dst.Import(bytes.NewReader(second.Bytes())); !errors.Is(err, ErrOrphanBlock) {
+		t.Errorf("blocks past our tip should be orphans, got %v", err)
+	}
+	for _, archive := range []*bytes.Buffer{&first, &second} {
+		if _, err := dst.Import(archive); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+	}
+	if dst.Height() != 5 {
+		t.Errorf("expected 5 blocks, got %d", dst.Height())
+	}
+}
+
+func TestImportRejectsBadArchives(t *testing.T) {
+	src, _ := NewBlockchain(NewMemoryStorage(), nil)
+	src.MineBlock("miner1", nil)
+	src.MineBlock("miner1", nil)
+	var buf bytes.Buffer
+	src.Export(&buf, 0, 2)
+	archive := buf.Bytes()
+
+	dst, _ := NewBlockchain(NewMemoryStorage(), nil)
+	if _, err := dst.Import(bytes.NewReader([]byte("not an archive"))); !errors.Is(err, ErrNotArchive) {
+		t.Errorf("expected ErrNotArchive, got %v", err)
+	}
+	if _, err := dst.Import(bytes.NewReader(archive[:len(archive)-10])); err == nil {
+		t.Error("truncated archive should be rejected")
+	}
+
+	// A block with a changed miner fails the coinbase check
+	tampered := bytes.Replace(archive, []byte("miner1"), []byte("miner2"), 1)
+	dst, _ = NewBlockchain(NewMemoryStorage(), nil)
+	if _, err := dst.Import(bytes.NewReader(tampered)); err == nil {
+		t.Error("tampered block should fail validation")
+	}
+	if dst.Height() != 1 {
+		t.Errorf("no block should be added from a tampered archive, got %d", dst.Height())
+	}
+
+	other := DefaultGenesis()
+	other.ChainID = "fernet-other"
+	dst, _ = NewBlockchain(NewMemoryStorage(), other)
+	if _, err := dst.Import(bytes.NewReader(archive)); err == nil {
+		t.Error("archive of another chain should be rejected")
+	}
+}
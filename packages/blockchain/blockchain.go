@@ -2,95 +2,270 @@ package blockchain
 
 import (
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Blockchain holds the main chain's headers and state in memory. Block bodies
+// stay in storage and are loaded through a bounded cache when needed.
 type Blockchain struct {
-	Chain    []Block
+	headers  []Block // main chain blocks without their transactions
+	base     uint64  // height of the snapshot the chain started from, if any
+	cache    *blockCache
 	Balances map[string]uint64
 	Nonces   map[string]uint64
+	tree     *stateTree // state root tree over Balances and Nonces
+	index    map[string]*blockNode
+	side     map[string]*blockNode // index entries not on the main chain
+	genesis  *Genesis
+	chainID  string
+	now      func() time.Time
 	store    Storage
 	mu       sync.RWMutex
 }
 
-// NewBlockchain creates or loads a blockchain from storage.
-func NewBlockchain(store Storage) (*Blockchain, error) {
+// NewBlockchain creates or loads a blockchain from storage. A nil genesis
+// selects DefaultGenesis. Loading fails if the stored chain was created from
+// a different genesis.
+func NewBlockchain(store Storage, genesis *Genesis) (*Blockchain, error) {
+	if genesis == nil {
+		genesis = DefaultGenesis()
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis: %w", err)
+	}
+
 	bc := &Blockchain{
 		Balances: make(map[string]uint64),
 		Nonces:   make(map[string]uint64),
+		cache:    newBlockCache(BlockCacheSize),
+		genesis:  genesis,
+		now:      time.Now,
 		store:    store,
 	}
 
-	chain, err := store.LoadChain()
+	headers, err := loadHeaders(store)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load chain: %w", err)
 	}
 
-	if len(chain) > 0 {
-		bc.Chain = chain
-		bc.rebuildState()
-		log.Printf("Loaded blockchain with %d blocks from storage", len(bc.Chain))
+	genesisBlock := genesis.Block()
+	if len(headers) > 0 {
+		if headers[0].Hash != genesisBlock.Hash {
+			return nil, fmt.Errorf("stored chain has genesis %s, expected %s", headers[0].Hash, genesisBlock.Hash)
+		}
+		bc.headers = headers
+		snapshot, ok, err := store.LoadSnapshot()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load snapshot: %w", err)
+		}
+		if ok {
+			if snapshot.Height >= uint64(len(headers)) || headers[snapshot.Height].Hash != snapshot.Hash {
+				return nil, fmt.Errorf("stored snapshot at height %d is not on the stored chain", snapshot.Height)
+			}
+			bc.base = snapshot.Height
+		}
+		if err := bc.loadState(); err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded blockchain with %d blocks from storage", len(bc.headers))
 	} else {
-		bc.createGenesisBlock()
+		bc.headers = []Block{genesisBlock.header()}
+		if err := bc.rebuildState([]Block{genesisBlock}); err != nil {
+			return nil, err
+		}
+		err := store.Commit(&ChainBatch{
+			Blocks:   []Block{genesisBlock},
+			Balances: bc.Balances,
+			Nonces:   bc.Nonces,
+			Tip:      ChainTip{Height: 0, Hash: genesisBlock.Hash},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to save genesis block: %w", err)
+		}
 		log.Println("Created new blockchain with genesis block")
 	}
+	bc.buildIndex()
+	bc.chainID = genesis.chainID(&bc.headers[0])
 
 	return bc, nil
 }
 
-func (bc *Blockchain) createGenesisBlock() {
-	genesis := Block{
-		Index:        0,
-		Timestamp:    GenesisTimestamp,
-		Transactions: []Transaction{},
-		PrevHash:     "0",
-		Nonce:        0,
-		Miner:        "",
-	}
-	genesis.Hash = CalculateBlockHash(&genesis)
-	bc.Chain = append(bc.Chain, genesis)
-	bc.store.SaveBlock(genesis)
-}
-
-// rebuildState replays the chain to reconstruct balances and nonces.
-func (bc *Blockchain) rebuildState() {
-	bc.Balances = make(map[string]uint64)
-	bc.Nonces = make(map[string]uint64)
-
-	for _, block := range bc.Chain {
-		for _, tx := range block.Transactions {
-			if tx.Sender == CoinbaseSender {
-				bc.Balances[tx.Receiver] += tx.Amount
-			} else {
-				bc.Balances[tx.Sender] -= (tx.Amount + tx.Fee)
-				bc.Balances[tx.Receiver] += tx.Amount
-				bc.Balances[block.Miner] += tx.Fee
-				if tx.Nonce >= bc.Nonces[tx.Sender] {
-					bc.Nonces[tx.Sender] = tx.Nonce + 1
-				}
+// loadHeaders reads the headers of every stored block, checking heights are
+// contiguous from genesis.
+func loadHeaders(store Storage) ([]Block, error) {
+	var headers []Block
+	err := store.IterateBlocks(0, math.MaxUint64, func(block *Block) error {
+		if block.Index != uint64(len(headers)) {
+			return fmt.Errorf("expected block %d, found %d", len(headers), block.Index)
+		}
+		headers = append(headers, block.header())
+		return nil
+	})
+	return headers, err
+}
+
+// header returns a copy of the block without its transactions.
+func (b *Block) header() Block {
+	h := *b
+	h.Transactions = nil
+	return h
+}
+
+// ChainIDFromGenesis derives the chain identifier that transactions must be
+// signed for from the genesis block.
+func ChainIDFromGenesis(genesis *Block) string {
+	return "fernet-" + genesis.Hash[:16]
+}
+
+// ChainID returns the identifier of this chain, included in every signed
+// transaction for replay protection.
+func (bc *Blockchain) ChainID() string {
+	return bc.chainID
+}
+
+// Genesis returns the genesis parameters the chain was created with.
+func (bc *Blockchain) Genesis() *Genesis {
+	return bc.genesis
+}
+
+// loadState reads balances and nonces from storage if they were committed
+// together with the stored tip and match its state root. Otherwise it replays
+// the chain and writes the result back.
+func (bc *Blockchain) loadState() error {
+	tip, ok, err := bc.store.LoadTip()
+	if err != nil {
+		return fmt.Errorf("failed to load tip: %w", err)
+	}
+	balances, err := bc.store.LoadBalances()
+	if err != nil {
+		return fmt.Errorf("failed to load balances: %w", err)
+	}
+	nonces, err := bc.store.LoadNonces()
+	if err != nil {
+		return fmt.Errorf("failed to load nonces: %w", err)
+	}
+
+	last := bc.headers[len(bc.headers)-1]
+	if ok && tip.Height == last.Index && tip.Hash == last.Hash && StateRoot(balances, nonces) == last.StateRoot {
+		bc.setState(balances, nonces)
+		return nil
+	}
+
+	log.Printf("Stored state does not match tip %d, replaying chain", last.Index)
+	if err := bc.rebuildState(nil); err != nil {
+		return err
+	}
+	err = bc.store.Commit(&ChainBatch{
+		Balances: stateDiff(balances, bc.Balances),
+		Nonces:   stateDiff(nonces, bc.Nonces),
+		Tip:      ChainTip{Height: last.Index, Hash: last.Hash},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save rebuilt state: %w", err)
+	}
+	return nil
+}
+
+// stateDiff returns the entries that turn stored into current, with zero
+// marking accounts to remove.
+func stateDiff(stored, current map[string]uint64) map[string]uint64 {
+	diff := make(map[string]uint64)
+	for addr, v := range current {
+		if stored[addr] != v {
+			diff[addr] = v
+		}
+	}
+	for addr := range stored {
+		if _, ok := current[addr]; !ok {
+			diff[addr] = 0
+		}
+	}
+	return diff
+}
+
+// rebuildState replays the main chain to reconstruct balances and nonces.
+// Blocks are read from storage unless given. It fails, leaving nothing to
+// save, if a block does not apply: the database then needs fsck -repair.
+func (bc *Blockchain) rebuildState(blocks []Block) error {
+	balances, nonces, from, err := bc.baseState()
+	if err != nil {
+		return err
+	}
+	bc.setState(balances, nonces)
+
+	view := bc.view()
+	apply := func(block *Block) error {
+		if err := view.applyBlock(block); err != nil {
+			return fmt.Errorf("stored block %d does not apply: %w", block.Index, err)
+		}
+		return nil
+	}
+	if blocks != nil {
+		for i := range blocks {
+			if err = apply(&blocks[i]); err != nil {
+				break
 			}
 		}
+	} else {
+		err = bc.store.IterateBlocks(from, uint64(len(bc.headers)-1), apply)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replay chain: %w; run fsck -repair to truncate the database to its last good block", err)
+	}
+	view.commit()
+	return nil
+}
+
+// setState replaces the committed state and builds its state tree.
+func (bc *Blockchain) setState(balances, nonces map[string]uint64) {
+	bc.Balances = balances
+	bc.Nonces = nonces
+	bc.tree = newStateTree(balances, nonces)
+}
+
+// view returns a view of the committed state whose state roots and commit
+// go through the state tree.
+func (bc *Blockchain) view() *stateView {
+	view := newStateView(bc.Balances, bc.Nonces)
+	view.tree = bc.tree
+	return view
+}
+
+// baseState returns the state a replay of the main chain starts from and the
+// height of the first block to apply: empty state and genesis, or for a chain
+// started from a snapshot, the snapshot state and the block after it.
+func (bc *Blockchain) baseState() (balances, nonces map[string]uint64, from uint64, err error) {
+	balances = make(map[string]uint64)
+	nonces = make(map[string]uint64)
+	if bc.base == 0 {
+		return balances, nonces, 0, nil
+	}
+
+	snapshot, ok, err := bc.store.LoadSnapshot()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if !ok {
+		return nil, nil, 0, errors.New("snapshot missing from storage")
+	}
+	for addr, v := range snapshot.Balances {
+		balances[addr] = v
+	}
+	for addr, v := range snapshot.Nonces {
+		nonces[addr] = v
 	}
+	return balances, nonces, bc.base + 1, nil
 }
 
-// CalculateBlockHash computes the hash of a block using BlockHashData (excludes Hash field).
+// CalculateBlockHash computes the hash of a block's canonical header encoding.
 func CalculateBlockHash(block *Block) string {
-	data := BlockHashData{
-		Index:        block.Index,
-		Timestamp:    block.Timestamp,
-		Transactions: block.Transactions,
-		PrevHash:     block.PrevHash,
-		Nonce:        block.Nonce,
-		Miner:        block.Miner,
-	}
-	jsonBytes, _ := json.Marshal(data)
-	hash := sha256.Sum256(jsonBytes)
+	hash := sha256.Sum256(block.HeaderBytes())
 	return fmt.Sprintf("%x", hash)
 }
 
@@ -99,10 +274,23 @@ func (bc *Blockchain) MineBlock(miner string, pendingTxns []Transaction) (*Block
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
 
-	// Validate all transactions
+	// Validate all transactions against a staged copy of the state, in nonce
+	// order so several transactions from one sender can share a block
+	pending := make([]Transaction, len(pendingTxns))
+	copy(pending, pendingTxns)
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Nonce < pending[j].Nonce })
+
+	view := bc.view()
 	var validTxns []Transaction
-	for _, tx := range pendingTxns {
-		if err := bc.validateTransactionLocked(&tx); err != nil {
+	for _, tx := range pending {
+		if tx.Sender == CoinbaseSender {
+			continue
+		}
+		if err := tx.IsValid(bc.chainID); err != nil {
+			log.Printf("Skipping invalid tx %s: %v", tx.ID, err)
+			continue
+		}
+		if err := view.applyTx(&tx); err != nil {
 			log.Printf("Skipping invalid tx %s: %v", tx.ID, err)
 			continue
 		}
@@ -112,51 +300,63 @@ func (bc *Blockchain) MineBlock(miner string, pendingTxns []Transaction) (*Block
 		}
 	}
 
-	// Add coinbase transaction
-	coinbase := NewCoinbaseTx(miner, MiningReward)
+	// Add coinbase transaction paying the block reward plus all fees
+	prevBlock := bc.headers[len(bc.headers)-1]
+	coinbase := NewCoinbaseTx(miner, bc.genesis.BlockReward(prevBlock.Index+1)+TotalFees(validTxns))
 	allTxns := append([]Transaction{*coinbase}, validTxns...)
 
-	prevBlock := bc.Chain[len(bc.Chain)-1]
+	target := bc.genesis.NextTarget(bc.headers)
 	newBlock := Block{
 		Index:        prevBlock.Index + 1,
-		Timestamp:    time.Now().Unix(),
+		Timestamp:    bc.blockTimeLocked(),
 		Transactions: allTxns,
 		PrevHash:     prevBlock.Hash,
+		Target:       TargetToHex(target),
 		Nonce:        0,
 		Miner:        miner,
 	}
+	newBlock.MerkleRoot = BlockMerkleRoot(&newBlock)
+	if err := view.credit(miner, coinbase.Amount); err != nil {
+		return nil, err
+	}
+	newBlock.StateRoot = view.stateRoot()
 
 	// Proof of Work
 	for {
 		newBlock.Hash = CalculateBlockHash(&newBlock)
-		if strings.HasPrefix(newBlock.Hash, TargetPrefix) {
+		if HashMeetsTarget(newBlock.Hash, target) {
 			break
 		}
 		newBlock.Nonce++
 	}
 
-	// Apply state changes
-	bc.Balances[miner] += MiningReward
-	for _, tx := range validTxns {
-		bc.Balances[tx.Sender] -= (tx.Amount + tx.Fee)
-		bc.Balances[tx.Receiver] += tx.Amount
-		bc.Balances[miner] += tx.Fee
-		if tx.Nonce >= bc.Nonces[tx.Sender] {
-			bc.Nonces[tx.Sender] = tx.Nonce + 1
-		}
+	// Apply state changes and persist
+	if _, err := bc.addBlockLocked(&newBlock); err != nil {
+		return nil, fmt.Errorf("failed to add mined block: %w", err)
 	}
 
-	bc.Chain = append(bc.Chain, newBlock)
-
-	// Persist
-	bc.store.SaveBlock(newBlock)
-	bc.store.SaveBalances(bc.Balances)
-	bc.store.SaveNonces(bc.Nonces)
-
 	log.Printf("Block %d mined by %s with hash %s (%d txns)", newBlock.Index, miner, newBlock.Hash, len(validTxns))
 	return &newBlock, nil
 }
 
+// SetClock replaces the clock used to timestamp mined blocks and to reject
+// blocks from the future. Tests use it to make timestamp rules deterministic.
+func (bc *Blockchain) SetClock(now func() time.Time) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.now = now
+}
+
+// blockTimeLocked returns the timestamp for a new block on the tip: the
+// current time, moved forward if needed to stay after the median time past.
+func (bc *Blockchain) blockTimeLocked() int64 {
+	timestamp := bc.now().Unix()
+	if mtp := MedianTimePast(bc.headers); timestamp <= mtp {
+		timestamp = mtp + 1
+	}
+	return timestamp
+}
+
 // ValidateTransaction checks if a transaction is valid against current state.
 func (bc *Blockchain) ValidateTransaction(tx *Transaction) error {
 	bc.mu.RLock()
@@ -165,7 +365,7 @@ func (bc *Blockchain) ValidateTransaction(tx *Transaction) error {
 }
 
 func (bc *Blockchain) validateTransactionLocked(tx *Transaction) error {
-	if err := tx.IsValid(); err != nil {
+	if err := tx.IsValid(bc.chainID); err != nil {
 		return err
 	}
 
@@ -173,73 +373,128 @@ func (bc *Blockchain) validateTransactionLocked(tx *Transaction) error {
 		return nil
 	}
 
-	// Check balance
-	balance := bc.Balances[tx.Sender]
-	if balance < tx.Amount+tx.Fee {
-		return fmt.Errorf("insufficient balance: has %d, needs %d", balance, tx.Amount+tx.Fee)
+	return newStateView(bc.Balances, bc.Nonces).checkTx(tx)
+}
+
+// ValidatePendingTransaction checks a transaction against current state with
+// the sender's pending transactions applied first, so a sender can queue
+// several transactions for the next block. Pending transactions that do not
+// follow on from the sender's nonce are ignored.
+func (bc *Blockchain) ValidatePendingTransaction(tx *Transaction, pending []Transaction) error {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if err := tx.IsValid(bc.chainID); err != nil {
+		return err
+	}
+	if tx.Sender == CoinbaseSender {
+		return nil
 	}
 
-	// Check nonce
-	expectedNonce := bc.Nonces[tx.Sender]
-	if tx.Nonce != expectedNonce {
-		return fmt.Errorf("invalid nonce: expected %d, got %d", expectedNonce, tx.Nonce)
+	var queued []Transaction
+	for _, p := range pending {
+		if p.Sender == tx.Sender && p.ID != tx.ID {
+			queued = append(queued, p)
+		}
 	}
+	sort.SliceStable(queued, func(i, j int) bool { return queued[i].Nonce < queued[j].Nonce })
 
-	return nil
+	view := newStateView(bc.Balances, bc.Nonces)
+	for _, p := range queued {
+		if p.Nonce != view.nonce(tx.Sender) {
+			continue
+		}
+		if err := view.applyTx(&p); err != nil {
+			break
+		}
+	}
+	return view.checkTx(tx)
 }
 
-// ValidateChain verifies the entire chain integrity.
+// ValidateChain verifies the stored main chain, replaying every block on a
+// fresh state. Blocks are streamed from storage one at a time. For a chain
+// started from a snapshot, only the headers up to the snapshot are checked
+// and replay starts from the snapshot state.
 func (bc *Blockchain) ValidateChain() error {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
-	if len(bc.Chain) == 0 {
-		return errors.New("chain is empty")
+	_, _, valid, err := bc.replayStored()
+	if err != nil {
+		return err
 	}
-
-	// Check genesis
-	if bc.Chain[0].PrevHash != "0" {
-		return errors.New("invalid genesis block")
+	if valid != uint64(len(bc.headers)) {
+		return fmt.Errorf("storage holds %d of %d blocks", valid, len(bc.headers))
 	}
+	return nil
+}
 
-	for i := 1; i < len(bc.Chain); i++ {
-		block := bc.Chain[i]
-		prevBlock := bc.Chain[i-1]
-
-		// Check index sequence
-		if block.Index != prevBlock.Index+1 {
-			return fmt.Errorf("block %d: invalid index", i)
+// replayStored validates the stored main chain block by block, stopping at
+// the first invalid one. It returns the state after the last valid block and
+// the number of valid blocks.
+func (bc *Blockchain) replayStored() (balances, nonces map[string]uint64, valid uint64, err error) {
+	now := bc.now().Unix()
+	balances, nonces, height, err := bc.baseState()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for i := uint64(1); i <= bc.base; i++ {
+		if err := bc.validateHeader(bc.headers[:i], &bc.headers[i], now); err != nil {
+			return nil, nil, 0, fmt.Errorf("block %d: %w", i, err)
 		}
+	}
+	if bc.base > 0 && StateRoot(balances, nonces) != bc.headers[bc.base].StateRoot {
+		return nil, nil, 0, fmt.Errorf("snapshot state does not match the state root of block %d", bc.base)
+	}
 
-		// Check prev hash link
-		if block.PrevHash != prevBlock.Hash {
-			return fmt.Errorf("block %d: prev hash mismatch", i)
+	err = bc.store.IterateBlocks(height, uint64(len(bc.headers)-1), func(block *Block) error {
+		if block.Index != height || block.Hash != bc.headers[height].Hash {
+			return fmt.Errorf("block %d: stored block does not match the main chain", height)
 		}
-
-		// Check hash correctness
-		expectedHash := CalculateBlockHash(&block)
-		if block.Hash != expectedHash {
-			return fmt.Errorf("block %d: hash mismatch", i)
+		if height == 0 {
+			if err := bc.checkGenesis(block); err != nil {
+				return err
+			}
+		} else if err := bc.validateBlock(bc.headers[:height], block, now); err != nil {
+			return fmt.Errorf("block %d: %w", height, err)
 		}
-
-		// Check PoW
-		if !strings.HasPrefix(block.Hash, TargetPrefix) {
-			return fmt.Errorf("block %d: insufficient proof of work", i)
+		view := newStateView(balances, nonces)
+		if err := view.applyBlock(block); err != nil {
+			return fmt.Errorf("block %d: %w", height, err)
 		}
+		view.commit()
+		height++
+		return nil
+	})
+	return balances, nonces, height, err
+}
 
-		// Check coinbase
-		if len(block.Transactions) == 0 || block.Transactions[0].Sender != CoinbaseSender {
-			return fmt.Errorf("block %d: missing coinbase transaction", i)
-		}
-		if block.Transactions[0].Amount != MiningReward {
-			return fmt.Errorf("block %d: invalid coinbase amount", i)
-		}
+// checkGenesis verifies a block is this chain's genesis block.
+func (bc *Blockchain) checkGenesis(genesis *Block) error {
+	if genesis.Hash != bc.headers[0].Hash || CalculateBlockHash(genesis) != genesis.Hash || BlockMerkleRoot(genesis) != genesis.MerkleRoot {
+		return errors.New("invalid genesis block")
+	}
+	return nil
+}
 
-		// Verify all non-coinbase transaction signatures
-		for j := 1; j < len(block.Transactions); j++ {
-			if err := block.Transactions[j].VerifySignature(); err != nil {
-				return fmt.Errorf("block %d, tx %d: %w", i, j, err)
-			}
+// validateChainState checks the genesis block and every block after it,
+// replaying their transactions on a fresh state.
+func (bc *Blockchain) validateChainState(chain []Block, now int64) error {
+	genesis := &chain[0]
+	if err := bc.checkGenesis(genesis); err != nil {
+		return err
+	}
+
+	view := newStateView(make(map[string]uint64), make(map[string]uint64))
+	if err := view.applyBlock(genesis); err != nil {
+		return fmt.Errorf("block 0: %w", err)
+	}
+	for i := 1; i < len(chain); i++ {
+		if err := bc.validateBlock(chain[:i], &chain[i], now); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+		if err := view.applyBlock(&chain[i]); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
 		}
 	}
 
@@ -260,49 +515,136 @@ func (bc *Blockchain) GetNonce(address string) uint64 {
 	return bc.Nonces[address]
 }
 
+// blockLocked returns the full main chain block at height, from the cache
+// or from storage.
+func (bc *Blockchain) blockLocked(height uint64) (*Block, error) {
+	if height >= uint64(len(bc.headers)) {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	hash := bc.headers[height].Hash
+	if cached, ok := bc.cache.get(hash); ok {
+		block := *cached
+		return &block, nil
+	}
+
+	block, ok, err := bc.store.GetBlock(height)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load block %d: %w", height, err)
+	}
+	if !ok || block.Hash != hash {
+		return nil, fmt.Errorf("block %d missing from storage", height)
+	}
+	bc.cache.add(&block)
+	result := block
+	return &result, nil
+}
+
 // GetBlock returns a block by index.
 func (bc *Blockchain) GetBlock(index uint64) (*Block, error) {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
+	return bc.blockLocked(index)
+}
 
-	if index >= uint64(len(bc.Chain)) {
-		return nil, fmt.Errorf("block %d not found", index)
+// GetBlockByHash returns a known block by hash, on the main chain or on a
+// side branch.
+func (bc *Blockchain) GetBlockByHash(hash string) (*Block, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	node, ok := bc.index[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %s not found", hash)
 	}
-	block := bc.Chain[index]
+	if bc.onMainChain(node) {
+		return bc.blockLocked(node.block.Index)
+	}
+	block := node.block
 	return &block, nil
 }
 
-// GetLatestBlock returns the most recent block.
+// HasBlock reports whether a block is in the block tree, on the main chain or
+// on a side branch.
+func (bc *Blockchain) HasBlock(hash string) bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	_, ok := bc.index[hash]
+	return ok
+}
+
+// SnapshotHeight returns the height of the snapshot the chain was started
+// from, or 0. Blocks up to it are stored without transactions.
+func (bc *Blockchain) SnapshotHeight() uint64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.base
+}
+
+// GetBlocks returns the main chain blocks from height from to to, inclusive.
+func (bc *Blockchain) GetBlocks(from, to uint64) ([]Block, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if to >= uint64(len(bc.headers)) {
+		to = uint64(len(bc.headers)) - 1
+	}
+	if from > to {
+		return nil, nil
+	}
+	blocks := make([]Block, 0, to-from+1)
+	err := bc.store.IterateBlocks(from, to, func(block *Block) error {
+		blocks = append(blocks, *block)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load blocks: %w", err)
+	}
+	if uint64(len(blocks)) != to-from+1 {
+		return nil, fmt.Errorf("storage holds %d of blocks %d to %d", len(blocks), from, to)
+	}
+	return blocks, nil
+}
+
+// GetLatestBlock returns the most recent block. If its body cannot be loaded
+// the header is returned without transactions.
 func (bc *Blockchain) GetLatestBlock() *Block {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
-	block := bc.Chain[len(bc.Chain)-1]
-	return &block
+	height := uint64(len(bc.headers)) - 1
+	block, err := bc.blockLocked(height)
+	if err != nil {
+		log.Printf("Failed to load tip: %v", err)
+		header := bc.headers[height]
+		return &header
+	}
+	return block
 }
 
 // Height returns the number of blocks in the chain.
 func (bc *Blockchain) Height() uint64 {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
-	return uint64(len(bc.Chain))
+	return uint64(len(bc.headers))
 }
 
-// GetChain returns a copy of the full chain.
-func (bc *Blockchain) GetChain() []Block {
+// GetHeaders returns a copy of the main chain headers, without transactions.
+func (bc *Blockchain) GetHeaders() []Block {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
-	result := make([]Block, len(bc.Chain))
-	copy(result, bc.Chain)
+	result := make([]Block, len(bc.headers))
+	copy(result, bc.headers)
 	return result
 }
 
-// CreditAddress adds balance to an address (used for faucet).
-func (bc *Blockchain) CreditAddress(address string, amount uint64) {
-	bc.mu.Lock()
-	defer bc.mu.Unlock()
-	bc.Balances[address] += amount
-	bc.store.SaveBalances(bc.Balances)
+// GetChain loads the full main chain from storage. It is proportional to the
+// chain size; use GetBlocks for ranges.
+func (bc *Blockchain) GetChain() []Block {
+	chain, err := bc.GetBlocks(0, math.MaxUint64)
+	if err != nil {
+		log.Printf("Failed to load chain: %v", err)
+	}
+	return chain
 }
 
 // TxResult wraps a transaction with the block it was found in.
@@ -312,41 +654,57 @@ type TxResult struct {
 	BlockHash   string      `json:"blockHash"`
 }
 
-// FindTransaction searches the chain for a transaction by ID.
+// FindTransaction looks up a main chain transaction by ID.
 func (bc *Blockchain) FindTransaction(txID string) (*TxResult, error) {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
-	for _, block := range bc.Chain {
-		for _, tx := range block.Transactions {
-			if tx.ID == txID {
-				return &TxResult{
-					Transaction: tx,
-					BlockIndex:  block.Index,
-					BlockHash:   block.Hash,
-				}, nil
-			}
-		}
+	loc, ok, err := bc.store.FindTransaction(txID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up transaction: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("transaction %s not found", txID)
 	}
-	return nil, fmt.Errorf("transaction %s not found", txID)
+	return bc.txResultLocked(loc)
 }
 
-// GetAddressTransactions returns all transactions involving an address.
+// GetAddressTransactions returns all main chain transactions involving an
+// address, in chain order.
 func (bc *Blockchain) GetAddressTransactions(address string) []TxResult {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
+	locs, err := bc.store.AddressTransactions(address)
+	if err != nil {
+		log.Printf("Failed to look up transactions of %s: %v", address, err)
+		return nil
+	}
+
 	var results []TxResult
-	for _, block := range bc.Chain {
-		for _, tx := range block.Transactions {
-			if tx.Sender == address || tx.Receiver == address {
-				results = append(results, TxResult{
-					Transaction: tx,
-					BlockIndex:  block.Index,
-					BlockHash:   block.Hash,
-				})
-			}
+	for _, loc := range locs {
+		result, err := bc.txResultLocked(loc)
+		if err != nil {
+			log.Printf("Stale address index entry for %s: %v", address, err)
+			continue
 		}
+		results = append(results, *result)
 	}
 	return results
 }
+
+// txResultLocked resolves an index entry against the main chain.
+func (bc *Blockchain) txResultLocked(loc TxLocation) (*TxResult, error) {
+	block, err := bc.blockLocked(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	if int(loc.Position) >= len(block.Transactions) {
+		return nil, fmt.Errorf("block %d has no transaction %d", loc.Height, loc.Position)
+	}
+	return &TxResult{
+		Transaction: block.Transactions[loc.Position],
+		BlockIndex:  block.Index,
+		BlockHash:   block.Hash,
+	}, nil
+}
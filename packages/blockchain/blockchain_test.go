@@ -1,27 +1,31 @@
 package blockchain
 
 import (
-	"strings"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestGenesisBlock(t *testing.T) {
 	store := NewMemoryStorage()
-	bc, err := NewBlockchain(store)
+	bc, err := NewBlockchain(store, nil)
 	if err != nil {
 		t.Fatalf("NewBlockchain failed: %v", err)
 	}
 
-	if len(bc.Chain) != 1 {
-		t.Fatalf("expected 1 block, got %d", len(bc.Chain))
+	if bc.Height() != 1 {
+		t.Fatalf("expected 1 block, got %d", bc.Height())
 	}
 
-	genesis := bc.Chain[0]
+	genesis, _ := bc.GetBlock(0)
 	if genesis.Index != 0 {
 		t.Errorf("genesis index should be 0, got %d", genesis.Index)
 	}
-	if genesis.PrevHash != "0" {
-		t.Errorf("genesis prevHash should be '0', got '%s'", genesis.PrevHash)
+	if genesis.PrevHash != DefaultGenesis().ParamsHash() {
+		t.Errorf("genesis prevHash should commit to the parameters, got '%s'", genesis.PrevHash)
 	}
 	if genesis.Timestamp != GenesisTimestamp {
 		t.Errorf("genesis timestamp should be %d, got %d", GenesisTimestamp, genesis.Timestamp)
@@ -30,13 +34,15 @@ func TestGenesisBlock(t *testing.T) {
 
 func TestDeterministicGenesis(t *testing.T) {
 	store1 := NewMemoryStorage()
-	bc1, _ := NewBlockchain(store1)
+	bc1, _ := NewBlockchain(store1, nil)
 
 	store2 := NewMemoryStorage()
-	bc2, _ := NewBlockchain(store2)
+	bc2, _ := NewBlockchain(store2, nil)
 
-	if bc1.Chain[0].Hash != bc2.Chain[0].Hash {
-		t.Errorf("genesis hashes should be identical: %s != %s", bc1.Chain[0].Hash, bc2.Chain[0].Hash)
+	g1, _ := bc1.GetBlock(0)
+	g2, _ := bc2.GetBlock(0)
+	if g1.Hash != g2.Hash {
+		t.Errorf("genesis hashes should be identical: %s != %s", g1.Hash, g2.Hash)
 	}
 }
 
@@ -62,7 +68,7 @@ func TestCalculateBlockHash(t *testing.T) {
 
 func TestMineBlock(t *testing.T) {
 	store := NewMemoryStorage()
-	bc, _ := NewBlockchain(store)
+	bc, _ := NewBlockchain(store, nil)
 
 	block, err := bc.MineBlock("miner1", nil)
 	if err != nil {
@@ -72,8 +78,11 @@ func TestMineBlock(t *testing.T) {
 	if block.Index != 1 {
 		t.Errorf("expected block index 1, got %d", block.Index)
 	}
-	if !strings.HasPrefix(block.Hash, TargetPrefix) {
-		t.Errorf("block hash should start with %s, got %s", TargetPrefix, block.Hash)
+	if block.Target != TargetToHex(InitialTarget) {
+		t.Errorf("block target should be %s, got %s", TargetToHex(InitialTarget), block.Target)
+	}
+	if !HashMeetsTarget(block.Hash, InitialTarget) {
+		t.Errorf("block hash %s does not meet target", block.Hash)
 	}
 	if block.Miner != "miner1" {
 		t.Errorf("miner should be 'miner1', got '%s'", block.Miner)
@@ -98,13 +107,13 @@ func TestMineBlock(t *testing.T) {
 
 func TestPersistence(t *testing.T) {
 	store := NewMemoryStorage()
-	bc1, _ := NewBlockchain(store)
+	bc1, _ := NewBlockchain(store, nil)
 	bc1.MineBlock("miner1", nil)
 
 	// Load from same store
-	bc2, _ := NewBlockchain(store)
-	if len(bc2.Chain) != 2 {
-		t.Errorf("expected 2 blocks after reload, got %d", len(bc2.Chain))
+	bc2, _ := NewBlockchain(store, nil)
+	if bc2.Height() != 2 {
+		t.Errorf("expected 2 blocks after reload, got %d", bc2.Height())
 	}
 	if bc2.GetBalance("miner1") != MiningReward {
 		t.Errorf("balance should persist: expected %d, got %d", MiningReward, bc2.GetBalance("miner1"))
@@ -113,7 +122,7 @@ func TestPersistence(t *testing.T) {
 
 func TestValidateChain(t *testing.T) {
 	store := NewMemoryStorage()
-	bc, _ := NewBlockchain(store)
+	bc, _ := NewBlockchain(store, nil)
 	bc.MineBlock("miner1", nil)
 	bc.MineBlock("miner1", nil)
 
@@ -124,7 +133,7 @@ func TestValidateChain(t *testing.T) {
 
 func TestChainHeight(t *testing.T) {
 	store := NewMemoryStorage()
-	bc, _ := NewBlockchain(store)
+	bc, _ := NewBlockchain(store, nil)
 
 	if bc.Height() != 1 {
 		t.Errorf("initial height should be 1 (genesis), got %d", bc.Height())
@@ -135,3 +144,496 @@ func TestChainHeight(t *testing.T) {
 		t.Errorf("height after mining should be 2, got %d", bc.Height())
 	}
 }
+
+// headerChain builds a chain of unmined blocks spaced interval seconds apart,
+// enough to exercise NextTarget without doing any proof of work.
+func headerChain(length int, interval int64) []Block {
+	chain := make([]Block, length)
+	for i := range chain {
+		chain[i] = Block{
+			Index:     uint64(i),
+			Timestamp: GenesisTimestamp + int64(i)*interval,
+			Target:    TargetToHex(InitialTarget),
+		}
+	}
+	return chain
+}
+
+func TestNextTargetBetweenRetargets(t *testing.T) {
+	chain := headerChain(5, 1)
+	if DefaultGenesis().NextTarget(chain).Cmp(InitialTarget) != 0 {
+		t.Error("target should not change between retarget heights")
+	}
+}
+
+func TestNextTargetRetarget(t *testing.T) {
+	// Blocks twice as slow as intended should double the target.
+	slow := DefaultGenesis().NextTarget(headerChain(int(RetargetInterval), 2*TargetBlockTime))
+	want := new(big.Int).Mul(InitialTarget, big.NewInt(2))
+	if slow.Cmp(want) != 0 {
+		t.Errorf("slow blocks: expected target %x, got %x", want, slow)
+	}
+
+	// Instant blocks are clamped to MaxRetargetFactor.
+	fast := DefaultGenesis().NextTarget(headerChain(int(RetargetInterval), 0))
+	want = new(big.Int).Div(InitialTarget, big.NewInt(MaxRetargetFactor))
+	if fast.Cmp(want) != 0 {
+		t.Errorf("fast blocks: expected target %x, got %x", want, fast)
+	}
+}
+
+func TestNextTargetPowLimit(t *testing.T) {
+	chain := headerChain(int(RetargetInterval), 1000*TargetBlockTime)
+	for i := range chain {
+		chain[i].Target = TargetToHex(PowLimit)
+	}
+	if DefaultGenesis().NextTarget(chain).Cmp(PowLimit) != 0 {
+		t.Error("target should never exceed PowLimit")
+	}
+}
+
+func TestReorgToMostWork(t *testing.T) {
+	bc1, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc1.MineBlock("miner1", nil)
+	bc1.MineBlock("miner1", nil)
+
+	bc2, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc2.MineBlock("miner2", nil)
+	bc2.MineBlock("miner2", nil)
+	bc2.MineBlock("miner2", nil)
+
+	var update *ChainUpdate
+	chain2 := bc2.GetChain()
+	for i := 1; i < len(chain2); i++ {
+		u, err := bc1.AddBlock(&chain2[i])
+		if err != nil {
+			t.Fatalf("AddBlock %d failed: %v", i, err)
+		}
+		if i < 3 && bc1.GetLatestBlock().Miner != "miner1" {
+			t.Fatalf("branch with equal work should not replace the main chain")
+		}
+		update = u
+	}
+
+	if bc1.GetLatestBlock().Hash != bc2.GetLatestBlock().Hash {
+		t.Fatal("chain with more work should become the main chain")
+	}
+	if len(update.Disconnected) != 2 || len(update.Connected) != 3 {
+		t.Errorf("expected 2 disconnected and 3 connected, got %d and %d", len(update.Disconnected), len(update.Connected))
+	}
+	if bc1.GetBalance("miner1") != 0 {
+		t.Errorf("rewards of disconnected blocks should be rolled back, got %d", bc1.GetBalance("miner1"))
+	}
+	if bc1.GetBalance("miner2") != 3*MiningReward {
+		t.Errorf("expected miner2 balance %d, got %d", 3*MiningReward, bc1.GetBalance("miner2"))
+	}
+	if err := bc1.ValidateChain(); err != nil {
+		t.Errorf("reorganized chain should be valid: %v", err)
+	}
+}
+
+// steppedClock makes bc's clock advance by TargetBlockTime on every reading,
+// so blocks mined back to back keep the difficulty steady.
+func steppedClock(bc *Blockchain) {
+	now := time.Unix(GenesisTimestamp, 0)
+	bc.SetClock(func() time.Time {
+		now = now.Add(time.Duration(TargetBlockTime) * time.Second)
+		return now
+	})
+}
+
+func TestSideBranchesArePruned(t *testing.T) {
+	genesis := DefaultGenesis()
+	genesis.InitialTarget = TargetToHex(PowLimit)
+	bc1, _ := NewBlockchain(NewMemoryStorage(), genesis)
+	bc2, _ := NewBlockchain(NewMemoryStorage(), genesis)
+	steppedClock(bc1)
+	steppedClock(bc2)
+
+	fork, _ := bc2.MineBlock("miner2", nil)
+	bc1.MineBlock("miner1", nil)
+	bc1.MineBlock("miner1", nil)
+	if _, err := bc1.AddBlock(fork); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+	if !bc1.HasBlock(fork.Hash) {
+		t.Fatal("a recent side branch block should be kept")
+	}
+
+	for i := 0; i < sideBranchDepth; i++ {
+		if _, err := bc1.MineBlock("miner1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc1.HasBlock(fork.Hash) {
+		t.Error("a side branch far below the tip should be pruned")
+	}
+	if err := bc1.ValidateChain(); err != nil {
+		t.Errorf("main chain should stay valid: %v", err)
+	}
+}
+
+func TestShouldReplaceChainRequiresMoreWork(t *testing.T) {
+	bc1, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc1.MineBlock("miner1", nil)
+
+	bc2, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc2.MineBlock("miner2", nil)
+
+	if bc1.ShouldReplaceChain(bc2.GetChain()) {
+		t.Error("chain with equal work should not replace the current chain")
+	}
+
+	bc2.MineBlock("miner2", nil)
+	if !bc1.ShouldReplaceChain(bc2.GetChain()) {
+		t.Error("chain with more work should replace the current chain")
+	}
+}
+
+// buildBlock assembles and mines a block on top of bc's tip without checking
+// its transactions, so tests can produce blocks a peer might send. The state
+// root covers the transactions that apply cleanly.
+func buildBlock(bc *Blockchain, miner string, txns []Transaction) *Block {
+	prev := bc.GetLatestBlock()
+	target := bc.Genesis().NextTarget(bc.GetChain())
+	block := &Block{
+		Index:        prev.Index + 1,
+		Timestamp:    prev.Timestamp + 1,
+		Transactions: append([]Transaction{*NewCoinbaseTx(miner, bc.Genesis().BlockReward(prev.Index+1)+TotalFees(txns))}, txns...),
+		PrevHash:     prev.Hash,
+		Target:       TargetToHex(target),
+		Miner:        miner,
+	}
+	view := newStateView(bc.Balances, bc.Nonces)
+	for i := range block.Transactions {
+		view.applyTx(&block.Transactions[i])
+	}
+	block.StateRoot = view.stateRoot()
+	solveBlock(block)
+	return block
+}
+
+// solveBlock recomputes the merkle root and searches for a nonce meeting the
+// block's target.
+func solveBlock(block *Block) {
+	block.MerkleRoot = BlockMerkleRoot(block)
+	target, _ := ParseTarget(block.Target)
+	for {
+		block.Hash = CalculateBlockHash(block)
+		if HashMeetsTarget(block.Hash, target) {
+			return
+		}
+		block.Nonce++
+	}
+}
+
+func signedTx(bc *Blockchain, privKey *ecdsa.PrivateKey, pubKey, sender, receiver string, amount, nonce uint64) Transaction {
+	tx := NewTransaction(bc.ChainID(), sender, receiver, amount, 0, nonce, pubKey)
+	signTx(privKey, tx)
+	return *tx
+}
+
+func TestAddBlockRejectsOverspend(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	tx := signedTx(bc, privKey, pubKey, sender, "receiver", MiningReward+1, 0)
+	block := buildBlock(bc, "miner2", []Transaction{tx})
+
+	if _, err := bc.AddBlock(block); err == nil {
+		t.Fatal("block spending more than the sender's balance should be rejected")
+	}
+	if bc.Height() != 2 {
+		t.Errorf("rejected block should not be appended, height is %d", bc.Height())
+	}
+	if bc.GetBalance(sender) != MiningReward || bc.GetBalance("receiver") != 0 {
+		t.Error("rejected block should not change any balance")
+	}
+}
+
+func TestAddBlockIsAtomic(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	good := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0)
+	badNonce := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 5)
+	block := buildBlock(bc, "miner2", []Transaction{good, badNonce})
+
+	if _, err := bc.AddBlock(block); err == nil {
+		t.Fatal("block with an invalid nonce should be rejected")
+	}
+	if bc.GetBalance("receiver") != 0 || bc.GetNonce(sender) != 0 {
+		t.Error("valid transactions of a rejected block should not be applied")
+	}
+}
+
+func TestMineBlockSequentialNonces(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	txns := []Transaction{
+		signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 1),
+		signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0),
+		signedTx(bc, privKey, pubKey, sender, "receiver", MiningReward, 2),
+	}
+	block, err := bc.MineBlock("miner1", txns)
+	if err != nil {
+		t.Fatalf("MineBlock failed: %v", err)
+	}
+
+	if len(block.Transactions) != 3 {
+		t.Errorf("expected coinbase and 2 transfers, got %d transactions", len(block.Transactions))
+	}
+	if bc.GetBalance("receiver") != 2*OneFernet {
+		t.Errorf("expected receiver balance %d, got %d", 2*OneFernet, bc.GetBalance("receiver"))
+	}
+	if err := bc.ValidateChain(); err != nil {
+		t.Errorf("chain should remain valid: %v", err)
+	}
+}
+
+func TestBlockRewardHalving(t *testing.T) {
+	cases := []struct {
+		height uint64
+		reward uint64
+	}{
+		{0, 0},
+		{1, MiningReward},
+		{HalvingInterval, MiningReward},
+		{HalvingInterval + 1, MiningReward / 2},
+		{2*HalvingInterval + 1, MiningReward / 4},
+		{64*HalvingInterval + 1, 0},
+	}
+	for _, c := range cases {
+		if got := DefaultGenesis().BlockReward(c.height); got != c.reward {
+			t.Errorf("DefaultGenesis().BlockReward(%d) = %d, want %d", c.height, got, c.reward)
+		}
+	}
+}
+
+func TestSupplyNeverExceedsTotal(t *testing.T) {
+	if DefaultGenesis().SupplyAtHeight(HalvingInterval) != MiningReward*HalvingInterval {
+		t.Errorf("unexpected supply after first era: %d", DefaultGenesis().SupplyAtHeight(HalvingInterval))
+	}
+
+	final := DefaultGenesis().SupplyAtHeight(100 * HalvingInterval)
+	if final > TotalSupply {
+		t.Errorf("supply %d exceeds total supply %d", final, TotalSupply)
+	}
+	if DefaultGenesis().SupplyAtHeight(200*HalvingInterval) != final {
+		t.Error("supply should stop growing once rewards reach zero")
+	}
+}
+
+func TestAddBlockRejectsWrongReward(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	block := buildBlock(bc, "miner1", nil)
+	block.Transactions[0] = *NewCoinbaseTx("miner1", MiningReward*2)
+	solveBlock(block)
+
+	if _, err := bc.AddBlock(block); err == nil {
+		t.Error("block with an inflated coinbase should be rejected")
+	}
+}
+
+func TestCoinbaseCollectsFees(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	tx := NewTransaction(bc.ChainID(), sender, "receiver", OneFernet, 1000, 0, pubKey)
+	signTx(privKey, tx)
+	block, err := bc.MineBlock("miner1", []Transaction{*tx})
+	if err != nil {
+		t.Fatalf("MineBlock failed: %v", err)
+	}
+
+	if block.Transactions[0].Amount != DefaultGenesis().BlockReward(block.Index)+1000 {
+		t.Errorf("coinbase should pay reward plus fees, got %d", block.Transactions[0].Amount)
+	}
+	if bc.GetBalance("miner1") != DefaultGenesis().BlockReward(block.Index)+1000 {
+		t.Errorf("miner should receive reward plus fees, got %d", bc.GetBalance("miner1"))
+	}
+	if bc.GetBalance(sender) != MiningReward-OneFernet-1000 {
+		t.Errorf("sender should pay amount plus fee, got %d", bc.GetBalance(sender))
+	}
+}
+
+func TestCoinbaseMustMatchRewardAndMiner(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	tx := NewTransaction(bc.ChainID(), sender, "receiver", OneFernet, 1000, 0, pubKey)
+	signTx(privKey, tx)
+
+	underpaid := buildBlock(bc, "miner1", []Transaction{*tx})
+	underpaid.Transactions[0] = *NewCoinbaseTx("miner1", DefaultGenesis().BlockReward(underpaid.Index))
+	solveBlock(underpaid)
+	if _, err := bc.AddBlock(underpaid); err == nil {
+		t.Error("coinbase that does not collect the fees should be rejected")
+	}
+
+	otherMiner := buildBlock(bc, "miner1", []Transaction{*tx})
+	otherMiner.Miner = "miner2"
+	solveBlock(otherMiner)
+	if _, err := bc.AddBlock(otherMiner); err == nil {
+		t.Error("block whose miner differs from the coinbase receiver should be rejected")
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	chain := headerChain(3, 10)
+	chain[2].Timestamp = chain[0].Timestamp - 100 // out of order timestamps
+	if mtp := MedianTimePast(chain); mtp != chain[0].Timestamp {
+		t.Errorf("expected median %d, got %d", chain[0].Timestamp, mtp)
+	}
+}
+
+func TestBlockTimestampRules(t *testing.T) {
+	now := time.Unix(GenesisTimestamp+1000, 0)
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.SetClock(func() time.Time { return now })
+
+	parent := bc.GetLatestBlock()
+	if _, err := bc.MineBlock("miner1", nil); err != nil {
+		t.Fatalf("MineBlock failed: %v", err)
+	}
+	if bc.GetLatestBlock().Timestamp != now.Unix() {
+		t.Errorf("mined block should use the injected clock")
+	}
+
+	stale := buildBlock(bc, "miner1", nil)
+	stale.Timestamp = parent.Timestamp
+	solveBlock(stale)
+	if _, err := bc.AddBlock(stale); err == nil {
+		t.Error("block not after the median time past should be rejected")
+	}
+
+	future := buildBlock(bc, "miner1", nil)
+	future.Timestamp = now.Unix() + MaxFutureDrift + 1
+	solveBlock(future)
+	if _, err := bc.AddBlock(future); err == nil {
+		t.Error("block too far in the future should be rejected")
+	}
+
+	// Once the clock catches up the same block becomes acceptable.
+	bc.SetClock(func() time.Time { return now.Add(time.Hour) })
+	if _, err := bc.AddBlock(future); err != nil {
+		t.Errorf("block within the drift limit should be accepted: %v", err)
+	}
+}
+
+func TestMineBlockAfterMedianTimePast(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.SetClock(func() time.Time { return time.Unix(GenesisTimestamp-60, 0) })
+
+	block, err := bc.MineBlock("miner1", nil)
+	if err != nil {
+		t.Fatalf("MineBlock failed: %v", err)
+	}
+	if block.Timestamp <= GenesisTimestamp {
+		t.Errorf("block timestamp %d should be after the median time past", block.Timestamp)
+	}
+}
+
+func TestValidateTransactionRejectsOtherChain(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	tx := NewTransaction("fernet-other", sender, "receiver", OneFernet, 0, 0, pubKey)
+	signTx(privKey, tx)
+	if err := bc.ValidateTransaction(tx); err == nil {
+		t.Error("transaction signed for another chain should be rejected")
+	}
+
+	tx = NewTransaction(bc.ChainID(), sender, "receiver", OneFernet, 0, 0, pubKey)
+	signTx(privKey, tx)
+	if err := bc.ValidateTransaction(tx); err != nil {
+		t.Errorf("transaction signed for this chain should be accepted: %v", err)
+	}
+}
+
+func TestStateRoot(t *testing.T) {
+	balances := map[string]uint64{"alice": 5, "bob": 7}
+	nonces := map[string]uint64{"alice": 2}
+	root := StateRoot(balances, nonces)
+
+	withZeros := map[string]uint64{"alice": 5, "bob": 7, "carol": 0}
+	if StateRoot(withZeros, map[string]uint64{"alice": 2, "bob": 0}) != root {
+		t.Error("zero entries should not change the state root")
+	}
+	if StateRoot(map[string]uint64{"alice": 5, "bob": 8}, nonces) == root {
+		t.Error("a different balance should change the state root")
+	}
+	if StateRoot(balances, map[string]uint64{"alice": 3}) == root {
+		t.Error("a different nonce should change the state root")
+	}
+	if StateRoot(nil, nil) != EmptyMerkleRoot {
+		t.Error("empty state should have the empty root")
+	}
+}
+
+func TestStateTreeUpdates(t *testing.T) {
+	balances := make(map[string]uint64)
+	nonces := make(map[string]uint64)
+	tree := newStateTree(balances, nonces)
+
+	// Updates, additions and removals of accounts across the tree, checked
+	// against the root computed from scratch
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		view := newStateView(balances, nonces)
+		view.tree = tree
+		for i := rng.Intn(8); i >= 0; i-- {
+			addr := fmt.Sprintf("account%03d", rng.Intn(60))
+			switch rng.Intn(4) {
+			case 0:
+				view.balances[addr] = 0
+				view.nonces[addr] = 0
+			case 1:
+				view.nonces[addr] = view.nonce(addr) + 1
+			default:
+				view.balances[addr] = uint64(rng.Intn(1000))
+			}
+		}
+		root := view.stateRoot()
+		if expected := StateRoot(view.accounts()); root != expected {
+			t.Fatalf("round %d: root %s, expected %s", round, root, expected)
+		}
+		view.commit()
+		if tree.root() != root {
+			t.Fatalf("round %d: committed tree has root %s, expected %s", round, tree.root(), root)
+		}
+	}
+}
+
+func TestMinedBlockCommitsToState(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+	tx := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0)
+	block, _ := bc.MineBlock("miner1", []Transaction{tx})
+
+	if block.StateRoot != StateRoot(bc.Balances, bc.Nonces) {
+		t.Error("mined block should commit to the state after it")
+	}
+}
+
+func TestAddBlockRejectsWrongStateRoot(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	block := buildBlock(bc, "miner1", nil)
+	block.StateRoot = StateRoot(map[string]uint64{"miner1": MiningReward + 1}, nil)
+	solveBlock(block)
+
+	if _, err := bc.AddBlock(block); err == nil {
+		t.Fatal("block committing to the wrong state should be rejected")
+	}
+	if bc.Height() != 1 || bc.GetBalance("miner1") != 0 {
+		t.Error("rejected block should not change the chain")
+	}
+}
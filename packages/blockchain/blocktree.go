@@ -0,0 +1,371 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+)
+
+var (
+	ErrKnownBlock  = errors.New("block already known")
+	ErrOrphanBlock = errors.New("parent block unknown")
+)
+
+const (
+	// Side branch blocks more than sideBranchDepth below the tip are dropped
+	// from the block tree, and at most maxSideBlocks are kept, those with the
+	// most work first. Sync fetches dropped blocks again if their branch
+	// ever overtakes the main chain.
+	sideBranchDepth = 100
+	maxSideBlocks   = 1000
+)
+
+// blockNode is a block known to this node, either on the main chain or on a
+// side branch, along with the cumulative work of the branch ending at it.
+// Main chain nodes hold only the header; their bodies are in storage. Side
+// branch nodes keep the full block, since it is stored nowhere else.
+type blockNode struct {
+	block  Block
+	parent *blockNode
+	work   *big.Int
+}
+
+// ChainUpdate describes how the main chain changed after accepting blocks.
+type ChainUpdate struct {
+	Disconnected []Block // blocks removed from the main chain, tip first
+	Connected    []Block // blocks added to the main chain, in height order
+}
+
+func (u *ChainUpdate) merge(other *ChainUpdate) {
+	u.Disconnected = append(u.Disconnected, other.Disconnected...)
+	u.Connected = append(u.Connected, other.Connected...)
+}
+
+// BlockWork returns the expected number of hashes needed to meet target.
+func BlockWork(target *big.Int) *big.Int {
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// ChainWork returns the cumulative proof of work of a chain.
+func ChainWork(chain []Block) *big.Int {
+	total := new(big.Int)
+	for i := 1; i < len(chain); i++ {
+		target, err := ParseTarget(chain[i].Target)
+		if err != nil {
+			continue
+		}
+		total.Add(total, BlockWork(target))
+	}
+	return total
+}
+
+// buildIndex populates the block tree from the main chain headers.
+func (bc *Blockchain) buildIndex() {
+	bc.index = make(map[string]*blockNode)
+	bc.side = make(map[string]*blockNode)
+	var parent *blockNode
+	for _, block := range bc.headers {
+		node := &blockNode{block: block, parent: parent, work: new(big.Int)}
+		if parent != nil {
+			target, _ := ParseTarget(block.Target)
+			node.work.Add(parent.work, BlockWork(target))
+		}
+		bc.index[block.Hash] = node
+		parent = node
+	}
+}
+
+func (bc *Blockchain) tipNode() *blockNode {
+	return bc.index[bc.headers[len(bc.headers)-1].Hash]
+}
+
+func (bc *Blockchain) onMainChain(node *blockNode) bool {
+	index := node.block.Index
+	return index < uint64(len(bc.headers)) && bc.headers[index].Hash == node.block.Hash
+}
+
+// headerWindow returns how many blocks ending at a parent are needed to
+// validate the header of its child: enough for the median time past and for
+// the retarget interval.
+func (bc *Blockchain) headerWindow() int {
+	if int(bc.genesis.RetargetInterval) > MedianTimeSpan {
+		return int(bc.genesis.RetargetInterval)
+	}
+	return MedianTimeSpan
+}
+
+// ancestors returns the last headerWindow blocks of the branch ending at
+// node, in height order, by following parent links. Side branch blocks keep
+// their transactions.
+func (bc *Blockchain) ancestors(node *blockNode) []Block {
+	result := make([]Block, bc.headerWindow())
+	i := len(result)
+	for ; node != nil && i > 0; node = node.parent {
+		i--
+		result[i] = node.block
+	}
+	return result[i:]
+}
+
+// addBlockLocked validates a block against its parent's branch, inserts it
+// into the block tree and reorganizes if its branch now has the most work.
+func (bc *Blockchain) addBlockLocked(block *Block) (*ChainUpdate, error) {
+	if _, ok := bc.index[block.Hash]; ok {
+		return nil, ErrKnownBlock
+	}
+	parent, ok := bc.index[block.PrevHash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrOrphanBlock, block.PrevHash)
+	}
+
+	if err := bc.validateBlock(bc.ancestors(parent), block, bc.now().Unix()); err != nil {
+		return nil, err
+	}
+
+	target, _ := ParseTarget(block.Target)
+	node := &blockNode{
+		block:  *block,
+		parent: parent,
+		work:   new(big.Int).Add(parent.work, BlockWork(target)),
+	}
+	bc.index[block.Hash] = node
+	bc.side[block.Hash] = node
+
+	if node.work.Cmp(bc.tipNode().work) <= 0 {
+		log.Printf("Stored block %d (%s) on a side branch", block.Index, block.Hash)
+		bc.pruneSideBranches()
+		return &ChainUpdate{}, nil
+	}
+
+	update, err := bc.reorganizeLocked(node)
+	if err != nil {
+		bc.discardBranch(block.Hash)
+		return nil, err
+	}
+	bc.pruneSideBranches()
+	return update, nil
+}
+
+// reorganizeLocked makes newTip the tip of the main chain, rolling state back
+// to the common ancestor and applying only the blocks of the new branch.
+// The new branch is applied to a staged copy of the state; if any of its
+// blocks fails validation the main chain is left untouched and the invalid
+// block is dropped from the tree together with its descendants. Storage is
+// updated in one batch before the in-memory chain, so a failed write leaves
+// the main chain untouched as well.
+func (bc *Blockchain) reorganizeLocked(newTip *blockNode) (*ChainUpdate, error) {
+	// Walk back to the main chain; only blocks after the fork point change
+	var newBranch []Block
+	node := newTip
+	for !bc.onMainChain(node) {
+		newBranch = append(newBranch, node.block)
+		node = node.parent
+	}
+	for i, j := 0, len(newBranch)-1; i < j; i, j = i+1, j-1 {
+		newBranch[i], newBranch[j] = newBranch[j], newBranch[i]
+	}
+
+	fork := int(node.block.Index)
+	if uint64(fork) < bc.base {
+		return nil, fmt.Errorf("cannot reorganize below snapshot height %d", bc.base)
+	}
+
+	view := bc.view()
+	update := &ChainUpdate{}
+	for i := len(bc.headers) - 1; i > fork; i-- {
+		block, err := bc.blockLocked(uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if err := bc.disconnectBlock(view, block); err != nil {
+			return nil, err
+		}
+		update.Disconnected = append(update.Disconnected, *block)
+	}
+	var undo []BlockUndo
+	for i := range newBranch {
+		record := view.undoRecord(&newBranch[i])
+		if err := view.applyBlock(&newBranch[i]); err != nil {
+			bc.discardBranch(newBranch[i].Hash)
+			return nil, fmt.Errorf("block %d: %w", newBranch[i].Index, err)
+		}
+		update.Connected = append(update.Connected, newBranch[i])
+		undo = append(undo, record)
+	}
+
+	// Persist before touching memory so a failed write leaves both as they were
+	batch := &ChainBatch{
+		Blocks:       update.Connected,
+		Disconnected: update.Disconnected,
+		Undo:         undo,
+		Balances:     view.balances,
+		Nonces:       view.nonces,
+		Tip:          ChainTip{Height: newTip.block.Index, Hash: newTip.block.Hash},
+	}
+	if err := bc.store.Commit(batch); err != nil {
+		return nil, fmt.Errorf("failed to persist chain update: %w", err)
+	}
+	view.commit()
+
+	// Disconnected blocks now live only on their side branch, while the
+	// connected ones can be reloaded from storage.
+	for i := range update.Disconnected {
+		node := bc.index[update.Disconnected[i].Hash]
+		node.block = update.Disconnected[i]
+		bc.side[node.block.Hash] = node
+	}
+	bc.headers = bc.headers[:fork+1]
+	for i := range update.Connected {
+		block := update.Connected[i]
+		bc.cache.add(&block)
+		bc.index[block.Hash].block = block.header()
+		delete(bc.side, block.Hash)
+		bc.headers = append(bc.headers, block.header())
+	}
+
+	if len(update.Disconnected) > 0 {
+		log.Printf("Reorganized chain: disconnected %d blocks, connected %d, new tip %d (%s)",
+			len(update.Disconnected), len(update.Connected), newTip.block.Index, newTip.block.Hash)
+	}
+	return update, nil
+}
+
+// disconnectBlock reverts a main chain block on view using its stored undo
+// record, falling back to replaying it backwards if it has none.
+func (bc *Blockchain) disconnectBlock(view *stateView, block *Block) error {
+	undo, ok, err := bc.store.LoadUndo(block.Index)
+	if err != nil {
+		return fmt.Errorf("failed to load undo record for block %d: %w", block.Index, err)
+	}
+	if ok {
+		view.revert(&undo)
+	} else {
+		view.undoBlock(block)
+	}
+	return nil
+}
+
+// DisconnectTip removes the last block from the main chain, restoring the
+// state it changed from its undo record. The block is dropped from the block
+// tree, so it is accepted again if a peer sends it.
+func (bc *Blockchain) DisconnectTip() (*ChainUpdate, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.disconnectTipLocked()
+}
+
+func (bc *Blockchain) disconnectTipLocked() (*ChainUpdate, error) {
+	if len(bc.headers) == 1 {
+		return nil, errors.New("cannot disconnect the genesis block")
+	}
+	if uint64(len(bc.headers))-1 <= bc.base {
+		return nil, fmt.Errorf("cannot disconnect blocks below snapshot height %d", bc.base)
+	}
+	loaded, err := bc.blockLocked(uint64(len(bc.headers)) - 1)
+	if err != nil {
+		return nil, err
+	}
+	tip := *loaded
+	parent := bc.headers[len(bc.headers)-2]
+
+	view := bc.view()
+	if err := bc.disconnectBlock(view, &tip); err != nil {
+		return nil, err
+	}
+	batch := &ChainBatch{
+		Disconnected: []Block{tip},
+		Balances:     view.balances,
+		Nonces:       view.nonces,
+		Tip:          ChainTip{Height: parent.Index, Hash: parent.Hash},
+	}
+	if err := bc.store.Commit(batch); err != nil {
+		return nil, fmt.Errorf("failed to persist chain update: %w", err)
+	}
+	view.commit()
+	bc.headers = bc.headers[:len(bc.headers)-1]
+	bc.discardBranch(tip.Hash)
+
+	log.Printf("Disconnected block %d (%s)", tip.Index, tip.Hash)
+	return &ChainUpdate{Disconnected: []Block{tip}}, nil
+}
+
+// RewindTo disconnects blocks until the block at height is the tip.
+func (bc *Blockchain) RewindTo(height uint64) (*ChainUpdate, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	update := &ChainUpdate{}
+	for uint64(len(bc.headers))-1 > height {
+		tipUpdate, err := bc.disconnectTipLocked()
+		if err != nil {
+			return update, err
+		}
+		update.merge(tipUpdate)
+	}
+	return update, nil
+}
+
+// discardBranch removes a block that is not on the main chain, and every
+// side branch block built on it, from the block tree.
+func (bc *Blockchain) discardBranch(hash string) {
+	bad, ok := bc.index[hash]
+	if !ok {
+		return
+	}
+	delete(bc.index, hash)
+	delete(bc.side, hash)
+	for h, node := range bc.side {
+		for n := node.parent; n != nil && n.block.Index >= bad.block.Index; n = n.parent {
+			if n == bad {
+				delete(bc.index, h)
+				delete(bc.side, h)
+				break
+			}
+		}
+	}
+}
+
+// pruneSideBranches drops side branch blocks too far below the tip or beyond
+// maxSideBlocks, along with the blocks built on them, so peers cannot grow
+// the block tree without bound by forking off cheap old blocks.
+func (bc *Blockchain) pruneSideBranches() {
+	if len(bc.side) == 0 {
+		return
+	}
+	tip := uint64(len(bc.headers)) - 1
+	nodes := make([]*blockNode, 0, len(bc.side))
+	for _, node := range bc.side {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].work.Cmp(nodes[j].work) > 0
+	})
+
+	drop := make(map[*blockNode]bool)
+	for i, node := range nodes {
+		if i >= maxSideBlocks || node.block.Index+sideBranchDepth < tip {
+			drop[node] = true
+		}
+	}
+	if len(drop) == 0 {
+		return
+	}
+
+	// Parents come first in height order, so descendants of dropped blocks
+	// are dropped too
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].block.Index < nodes[j].block.Index
+	})
+	for _, node := range nodes {
+		if drop[node.parent] {
+			drop[node] = true
+		}
+	}
+	for node := range drop {
+		delete(bc.index, node.block.Hash)
+		delete(bc.side, node.block.Hash)
+	}
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCacheSize is the number of full blocks kept in memory. Older blocks
+// are loaded from storage when needed.
+const BlockCacheSize = 256
+
+// blockCache is a least-recently-used cache of full blocks keyed by hash.
+// Keying by hash means a reorg never leaves a stale entry behind. It has its
+// own lock since readers holding the chain's read lock still update it.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *blockCache) get(hash string) (*Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*Block), true
+}
+
+func (c *blockCache) add(block *Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[block.Hash]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[block.Hash] = c.order.PushFront(block)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Block).Hash)
+	}
+}
@@ -2,15 +2,70 @@ package blockchain
 
 import (
 	"fmt"
-	"strings"
+	"math"
+	"sort"
 )
 
-// ValidateBlock validates a block received from a peer.
-func (bc *Blockchain) ValidateBlock(block *Block) error {
-	bc.mu.RLock()
-	defer bc.mu.RUnlock()
+// MedianTimePast returns the median timestamp of the last MedianTimeSpan
+// blocks of chain.
+func MedianTimePast(chain []Block) int64 {
+	start := len(chain) - MedianTimeSpan
+	if start < 0 {
+		start = 0
+	}
+	times := make([]int64, 0, MedianTimeSpan)
+	for _, block := range chain[start:] {
+		times = append(times, block.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
 
-	latestBlock := bc.Chain[len(bc.Chain)-1]
+// validateBlock checks a block against the chain it extends, whose last
+// element must be the block's parent. The chain needs no more than the
+// blocks returned by ancestors. now is the validating node's clock in
+// Unix seconds.
+func (bc *Blockchain) validateBlock(chain []Block, block *Block, now int64) error {
+	if err := bc.validateHeader(chain, block, now); err != nil {
+		return err
+	}
+
+	// Check the header commits to the transactions
+	if root := BlockMerkleRoot(block); block.MerkleRoot != root {
+		return fmt.Errorf("merkle root mismatch: expected %s, got %s", root, block.MerkleRoot)
+	}
+
+	// Check coinbase
+	if len(block.Transactions) == 0 || block.Transactions[0].Sender != CoinbaseSender {
+		return fmt.Errorf("missing coinbase transaction")
+	}
+	coinbase := block.Transactions[0]
+	if coinbase.Receiver != block.Miner {
+		return fmt.Errorf("coinbase pays %s but block miner is %s", coinbase.Receiver, block.Miner)
+	}
+	fees := TotalFees(block.Transactions[1:])
+	reward := bc.genesis.BlockReward(block.Index)
+	if fees > math.MaxUint64-reward {
+		return fmt.Errorf("block fees overflow")
+	}
+	if coinbase.Amount != reward+fees {
+		return fmt.Errorf("invalid coinbase amount: expected reward %d plus fees %d, got %d", reward, fees, coinbase.Amount)
+	}
+
+	// Verify transaction hashes and signatures
+	for i := range block.Transactions {
+		if err := block.Transactions[i].IsValid(bc.chainID); err != nil {
+			return fmt.Errorf("tx %d invalid: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateHeader checks the parts of a block covered by its hash that do not
+// depend on its transactions: linkage, timestamp and proof of work.
+func (bc *Blockchain) validateHeader(chain []Block, block *Block, now int64) error {
+	latestBlock := chain[len(chain)-1]
 
 	// Check index sequence
 	if block.Index != latestBlock.Index+1 {
@@ -22,134 +77,110 @@ func (bc *Blockchain) ValidateBlock(block *Block) error {
 		return fmt.Errorf("prev hash mismatch: expected %s, got %s", latestBlock.Hash, block.PrevHash)
 	}
 
+	// Check timestamp
+	if mtp := MedianTimePast(chain); block.Timestamp <= mtp {
+		return fmt.Errorf("timestamp %d is not after median time past %d", block.Timestamp, mtp)
+	}
+	if block.Timestamp > now+MaxFutureDrift {
+		return fmt.Errorf("timestamp %d is too far in the future", block.Timestamp)
+	}
+
 	// Check hash correctness
 	expectedHash := CalculateBlockHash(block)
 	if block.Hash != expectedHash {
 		return fmt.Errorf("hash mismatch: expected %s, got %s", expectedHash, block.Hash)
 	}
 
-	// Check PoW
-	if !strings.HasPrefix(block.Hash, TargetPrefix) {
+	// Check difficulty and PoW
+	target := bc.genesis.NextTarget(chain)
+	if block.Target != TargetToHex(target) {
+		return fmt.Errorf("unexpected target: expected %s, got %s", TargetToHex(target), block.Target)
+	}
+	if !HashMeetsTarget(block.Hash, target) {
 		return fmt.Errorf("insufficient proof of work")
 	}
 
-	// Check coinbase
-	if len(block.Transactions) == 0 || block.Transactions[0].Sender != CoinbaseSender {
-		return fmt.Errorf("missing coinbase transaction")
-	}
-	if block.Transactions[0].Amount != MiningReward {
-		return fmt.Errorf("invalid coinbase reward: expected %d, got %d", MiningReward, block.Transactions[0].Amount)
-	}
+	return nil
+}
 
-	// Verify all non-coinbase transaction signatures
-	for i := 1; i < len(block.Transactions); i++ {
-		if err := block.Transactions[i].VerifySignature(); err != nil {
-			return fmt.Errorf("tx %d signature invalid: %w", i, err)
+// TotalFees sums the fees of the given transactions, saturating on overflow
+// so an absurd total is rejected rather than wrapped.
+func TotalFees(txns []Transaction) uint64 {
+	var total uint64
+	for _, tx := range txns {
+		if tx.Fee > math.MaxUint64-total {
+			return math.MaxUint64
 		}
+		total += tx.Fee
 	}
-
-	return nil
+	return total
 }
 
-// AddBlock validates then appends a block received from a peer.
-func (bc *Blockchain) AddBlock(block *Block) error {
-	if err := bc.ValidateBlock(block); err != nil {
-		return fmt.Errorf("block validation failed: %w", err)
+// ValidateBlock validates a block received from a peer against the branch
+// of the block tree it extends.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	parent, ok := bc.index[block.PrevHash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrOrphanBlock, block.PrevHash)
 	}
+	return bc.validateBlock(bc.ancestors(parent), block, bc.now().Unix())
+}
 
+// AddBlock validates a block received from a peer and adds it to the block
+// tree. If its branch has the most cumulative work the main chain is
+// reorganized onto it; the returned update lists the blocks that moved.
+func (bc *Blockchain) AddBlock(block *Block) (*ChainUpdate, error) {
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
 
-	// Apply state changes
-	for _, tx := range block.Transactions {
-		if tx.Sender == CoinbaseSender {
-			bc.Balances[tx.Receiver] += tx.Amount
-		} else {
-			bc.Balances[tx.Sender] -= (tx.Amount + tx.Fee)
-			bc.Balances[tx.Receiver] += tx.Amount
-			bc.Balances[block.Miner] += tx.Fee
-			if tx.Nonce >= bc.Nonces[tx.Sender] {
-				bc.Nonces[tx.Sender] = tx.Nonce + 1
-			}
-		}
+	update, err := bc.addBlockLocked(block)
+	if err != nil {
+		return nil, fmt.Errorf("block validation failed: %w", err)
 	}
-
-	bc.Chain = append(bc.Chain, *block)
-	bc.store.SaveBlock(*block)
-	bc.store.SaveBalances(bc.Balances)
-	bc.store.SaveNonces(bc.Nonces)
-
-	return nil
+	return update, nil
 }
 
-// ShouldReplaceChain returns true if the given chain is longer and valid.
+// ShouldReplaceChain returns true if the given chain shares our genesis block,
+// is valid and has more cumulative work than the current main chain.
 func (bc *Blockchain) ShouldReplaceChain(newChain []Block) bool {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
-	if len(newChain) <= len(bc.Chain) {
+	if len(newChain) == 0 || newChain[0].Hash != bc.headers[0].Hash {
 		return false
 	}
 
-	// Validate the new chain
-	if len(newChain) == 0 || newChain[0].PrevHash != "0" {
+	if err := bc.validateChainState(newChain, bc.now().Unix()); err != nil {
 		return false
 	}
 
-	for i := 1; i < len(newChain); i++ {
-		block := newChain[i]
-		prevBlock := newChain[i-1]
-
-		if block.Index != prevBlock.Index+1 {
-			return false
-		}
-		if block.PrevHash != prevBlock.Hash {
-			return false
-		}
-		expectedHash := CalculateBlockHash(&block)
-		if block.Hash != expectedHash {
-			return false
-		}
-		if !strings.HasPrefix(block.Hash, TargetPrefix) && i > 0 {
-			return false
-		}
-	}
-
-	return true
+	return ChainWork(newChain).Cmp(bc.tipNode().work) > 0
 }
 
-// ReplaceChain replaces the current chain with a longer valid chain.
-func (bc *Blockchain) ReplaceChain(newChain []Block) error {
+// ReplaceChain adds the blocks of a chain with more work to the block tree,
+// reorganizing the main chain onto it from the common ancestor.
+func (bc *Blockchain) ReplaceChain(newChain []Block) (*ChainUpdate, error) {
 	if !bc.ShouldReplaceChain(newChain) {
-		return fmt.Errorf("new chain is not valid or not longer")
+		return nil, fmt.Errorf("new chain is not valid or does not have more work")
 	}
 
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
 
-	bc.Chain = newChain
-
-	// Rebuild state from scratch
-	bc.Balances = make(map[string]uint64)
-	bc.Nonces = make(map[string]uint64)
-	for _, block := range bc.Chain {
-		for _, tx := range block.Transactions {
-			if tx.Sender == CoinbaseSender {
-				bc.Balances[tx.Receiver] += tx.Amount
-			} else {
-				bc.Balances[tx.Sender] -= (tx.Amount + tx.Fee)
-				bc.Balances[tx.Receiver] += tx.Amount
-				bc.Balances[block.Miner] += tx.Fee
-				if tx.Nonce >= bc.Nonces[tx.Sender] {
-					bc.Nonces[tx.Sender] = tx.Nonce + 1
-				}
-			}
+	update := &ChainUpdate{}
+	for i := 1; i < len(newChain); i++ {
+		if _, ok := bc.index[newChain[i].Hash]; ok {
+			continue
 		}
-		bc.store.SaveBlock(block)
+		blockUpdate, err := bc.addBlockLocked(&newChain[i])
+		if err != nil {
+			return update, fmt.Errorf("block %d: %w", i, err)
+		}
+		update.merge(blockUpdate)
 	}
 
-	bc.store.SaveBalances(bc.Balances)
-	bc.store.SaveNonces(bc.Nonces)
-
-	return nil
+	return update, nil
 }
@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+var (
+	// InitialTarget is the proof-of-work target of the first blocks,
+	// equivalent to a hash with four leading zero hex digits.
+	InitialTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 240), big.NewInt(1))
+
+	// PowLimit is the easiest target a retarget may ever produce.
+	PowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 244), big.NewInt(1))
+)
+
+// TargetToHex encodes a target as a fixed-width 64 character hex string.
+func TargetToHex(target *big.Int) string {
+	return fmt.Sprintf("%064x", target)
+}
+
+// ParseTarget decodes a hex target as stored in Block.Target.
+func ParseTarget(s string) (*big.Int, error) {
+	if len(s) != 64 {
+		return nil, fmt.Errorf("invalid target length: %d", len(s))
+	}
+	target, ok := new(big.Int).SetString(s, 16)
+	if !ok || target.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid target: %s", s)
+	}
+	return target, nil
+}
+
+// HashMeetsTarget reports whether a hex block hash is numerically at or below target.
+func HashMeetsTarget(hash string, target *big.Int) bool {
+	h, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return false
+	}
+	return h.Cmp(target) <= 0
+}
+
+// NextTarget returns the target required for the block following chain. The
+// chain must end with the parent and hold at least its last RetargetInterval
+// blocks, or every block from genesis if there are fewer.
+//
+// Every RetargetInterval blocks the target is scaled by how long the last
+// interval actually took compared to TargetBlockTime, clamped to a factor of
+// MaxRetargetFactor in either direction. The genesis block is excluded from
+// the measured window since its timestamp is fixed.
+func (g *Genesis) NextTarget(chain []Block) *big.Int {
+	parent := chain[len(chain)-1]
+	height := parent.Index + 1
+
+	current, err := ParseTarget(parent.Target)
+	if err != nil {
+		current, err = ParseTarget(g.InitialTarget)
+		if err != nil {
+			current = new(big.Int).Set(InitialTarget)
+		}
+	}
+
+	if height%g.RetargetInterval != 0 {
+		return current
+	}
+
+	start := len(chain) - int(g.RetargetInterval)
+	first := chain[start]
+	if first.Index == 0 {
+		first = chain[start+1]
+	}
+	if parent.Index <= first.Index {
+		return current
+	}
+
+	expected := g.TargetBlockTime * int64(parent.Index-first.Index)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/MaxRetargetFactor {
+		actual = expected / MaxRetargetFactor
+	}
+	if actual > expected*MaxRetargetFactor {
+		actual = expected * MaxRetargetFactor
+	}
+
+	next := new(big.Int).Mul(current, big.NewInt(actual))
+	next.Div(next, big.NewInt(expected))
+	if next.Cmp(PowLimit) > 0 {
+		next.Set(PowLimit)
+	}
+	if next.Sign() <= 0 {
+		next.SetInt64(1)
+	}
+	return next
+}
@@ -0,0 +1,303 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TxEncodingVersion and HeaderEncodingVersion are the first byte of the
+// canonical transaction and block header encodings. Decoders reject versions
+// they do not know. Transactions and headers are versioned separately so a
+// header change does not alter transaction IDs and signatures.
+//
+// Layout (all integers big-endian, strings as a uint32 length followed by
+// UTF-8 bytes):
+//
+//	signable tx:  tx version | chainID | sender | receiver | amount u64 | fee u64 | nonce u64 | timestamp i64
+//	transaction:  signable tx | pubKey | signature
+//	block header: header version | index u64 | timestamp i64 | prevHash | merkleRoot | stateRoot | target | nonce u64 | miner
+//	block:        block header | tx count u32 | (tx length u32 | transaction)*
+//
+// Transaction IDs and block hashes are not encoded; they are the SHA-256 of
+// the signable transaction and the block header and are recomputed on decode.
+//
+// Header version 2 added the state root.
+const (
+	TxEncodingVersion     byte = 1
+	HeaderEncodingVersion byte = 2
+)
+
+const (
+	maxEncodedString = 1 << 16
+	maxEncodedTxs    = 1 << 16
+)
+
+var ErrUnknownEncodingVersion = errors.New("unknown encoding version")
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) byte(v byte) { e.buf.WriteByte(v) }
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) { e.uint64(uint64(v)) }
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+// decoder reads a canonical encoding, remembering the first error so
+// callers can check once at the end.
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{r: bytes.NewReader(data)}
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > d.r.Len() {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	d.r.Read(b)
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.read(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) int64() int64 { return int64(d.uint64()) }
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	if n > maxEncodedString {
+		d.fail(fmt.Errorf("string of %d bytes exceeds limit", n))
+		return ""
+	}
+	return string(d.read(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if n > uint32(d.r.Len()) {
+		d.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	return d.read(int(n))
+}
+
+func (d *decoder) version(want byte) {
+	if v := d.byte(); d.err == nil && v != want {
+		d.fail(fmt.Errorf("%w: %d", ErrUnknownEncodingVersion, v))
+	}
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// finish reports the first decoding error, or an error if bytes are left over.
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.r.Len() != 0 {
+		return fmt.Errorf("%d trailing bytes", d.r.Len())
+	}
+	return nil
+}
+
+func (t *Transaction) encodeSignable(e *encoder) {
+	e.byte(TxEncodingVersion)
+	e.string(t.ChainID)
+	e.string(t.Sender)
+	e.string(t.Receiver)
+	e.uint64(t.Amount)
+	e.uint64(t.Fee)
+	e.uint64(t.Nonce)
+	e.int64(t.Timestamp)
+}
+
+// SignableBytes returns the canonical encoding of the fields covered by the
+// transaction ID and signature.
+func (t *Transaction) SignableBytes() []byte {
+	var e encoder
+	t.encodeSignable(&e)
+	return e.buf.Bytes()
+}
+
+// MarshalBinary returns the canonical encoding of the transaction.
+func (t *Transaction) MarshalBinary() ([]byte, error) {
+	var e encoder
+	t.encodeSignable(&e)
+	e.string(t.PubKey)
+	e.string(t.Signature)
+	return e.buf.Bytes(), nil
+}
+
+func (t *Transaction) decode(d *decoder) {
+	d.version(TxEncodingVersion)
+	t.ChainID = d.string()
+	t.Sender = d.string()
+	t.Receiver = d.string()
+	t.Amount = d.uint64()
+	t.Fee = d.uint64()
+	t.Nonce = d.uint64()
+	t.Timestamp = d.int64()
+	t.PubKey = d.string()
+	t.Signature = d.string()
+	t.ID = t.CalculateHash()
+}
+
+// UnmarshalBinary decodes a canonical transaction encoding and recomputes its ID.
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	t.decode(d)
+	if err := d.finish(); err != nil {
+		return fmt.Errorf("failed to decode transaction: %w", err)
+	}
+	return nil
+}
+
+// HeaderBytes returns the canonical encoding of the block header, the data
+// covered by the block hash.
+func (b *Block) HeaderBytes() []byte {
+	var e encoder
+	b.encodeHeader(&e)
+	return e.buf.Bytes()
+}
+
+func (b *Block) encodeHeader(e *encoder) {
+	e.byte(HeaderEncodingVersion)
+	e.uint64(b.Index)
+	e.int64(b.Timestamp)
+	e.string(b.PrevHash)
+	e.string(b.MerkleRoot)
+	e.string(b.StateRoot)
+	e.string(b.Target)
+	e.uint64(b.Nonce)
+	e.string(b.Miner)
+}
+
+func (b *Block) decodeHeader(d *decoder) {
+	d.version(HeaderEncodingVersion)
+	b.Index = d.uint64()
+	b.Timestamp = d.int64()
+	b.PrevHash = d.string()
+	b.MerkleRoot = d.string()
+	b.StateRoot = d.string()
+	b.Target = d.string()
+	b.Nonce = d.uint64()
+	b.Miner = d.string()
+}
+
+// MarshalBinary returns the canonical encoding of the block and its transactions.
+func (b *Block) MarshalBinary() ([]byte, error) {
+	var e encoder
+	b.encodeHeader(&e)
+	e.uint32(uint32(len(b.Transactions)))
+	for i := range b.Transactions {
+		data, err := b.Transactions[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.bytes(data)
+	}
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a canonical block encoding and recomputes the block
+// hash and transaction IDs.
+func (b *Block) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data)
+	b.decodeHeader(d)
+
+	count := d.uint32()
+	if count > maxEncodedTxs {
+		d.fail(fmt.Errorf("%d transactions exceeds limit", count))
+	}
+	if d.err == nil {
+		b.Transactions = make([]Transaction, count)
+	}
+	for i := 0; d.err == nil && i < int(count); i++ {
+		txData := d.bytes()
+		if d.err != nil {
+			break
+		}
+		txDecoder := newDecoder(txData)
+		b.Transactions[i].decode(txDecoder)
+		if err := txDecoder.finish(); err != nil {
+			d.fail(fmt.Errorf("tx %d: %w", i, err))
+		}
+	}
+
+	if err := d.finish(); err != nil {
+		return fmt.Errorf("failed to decode block: %w", err)
+	}
+	b.Hash = CalculateBlockHash(b)
+	return nil
+}
+
+// UnmarshalHeader decodes a canonical block header encoding, as returned by
+// HeaderBytes, and recomputes the block hash. The block has no transactions.
+func (b *Block) UnmarshalHeader(data []byte) error {
+	d := newDecoder(data)
+	b.decodeHeader(d)
+	if err := d.finish(); err != nil {
+		return fmt.Errorf("failed to decode block header: %w", err)
+	}
+	b.Transactions = nil
+	b.Hash = CalculateBlockHash(b)
+	return nil
+}
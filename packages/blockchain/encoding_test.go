@@ -0,0 +1,230 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var updateVectors = flag.Bool("update", false, "rewrite testdata/encoding_vectors.json")
+
+const vectorsPath = "testdata/encoding_vectors.json"
+
+// encodingVectors are shared with the TypeScript client, which must produce
+// the same bytes and hashes for the same inputs.
+type encodingVectors struct {
+	TxVersion     byte                `json:"txVersion"`
+	HeaderVersion byte                `json:"headerVersion"`
+	Transactions  []transactionVector `json:"transactions"`
+	Blocks        []blockVector       `json:"blocks"`
+}
+
+type transactionVector struct {
+	Name        string      `json:"name"`
+	Transaction Transaction `json:"transaction"`
+	Signable    string      `json:"signable"`
+	ID          string      `json:"id"`
+	Encoded     string      `json:"encoded"`
+}
+
+type blockVector struct {
+	Name    string `json:"name"`
+	Block   Block  `json:"block"`
+	Header  string `json:"header"`
+	Hash    string `json:"hash"`
+	Encoded string `json:"encoded"`
+}
+
+func vectorTransactions() []Transaction {
+	transfer := Transaction{
+		ChainID:   "fernet-0123456789abcdef",
+		Sender:    "1f0e3dad99908345f7439f8ffabdffc4b2b4b6a1",
+		Receiver:  "a3c65c2974270fd093ee8a9bf8ae7d0b0a2f1e5c",
+		Amount:    150 * OneFernet,
+		Fee:       1_000_000,
+		Nonce:     7,
+		Timestamp: 1_700_000_123_000_000_000,
+		PubKey:    "04aa",
+		Signature: "0bad",
+	}
+	transfer.ID = transfer.CalculateHash()
+
+	coinbase := Transaction{
+		Sender:    CoinbaseSender,
+		Receiver:  "miner",
+		Amount:    MiningReward,
+		Timestamp: -1,
+	}
+	coinbase.ID = coinbase.CalculateHash()
+
+	return []Transaction{transfer, coinbase}
+}
+
+func vectorBlocks() []Block {
+	txns := vectorTransactions()
+	block := Block{
+		Index:        42,
+		Timestamp:    1_700_000_500,
+		Transactions: []Transaction{txns[1], txns[0]},
+		PrevHash:     "00000a1b2c3d4e5f00000a1b2c3d4e5f00000a1b2c3d4e5f00000a1b2c3d4e5f",
+		StateRoot:    StateRoot(map[string]uint64{"miner": MiningReward}, nil),
+		Target:       TargetToHex(InitialTarget),
+		Nonce:        99,
+		Miner:        "miner",
+	}
+	block.MerkleRoot = BlockMerkleRoot(&block)
+	block.Hash = CalculateBlockHash(&block)
+
+	empty := Block{
+		Transactions: []Transaction{},
+		PrevHash:     "0",
+		MerkleRoot:   EmptyMerkleRoot,
+		StateRoot:    EmptyMerkleRoot,
+		Target:       TargetToHex(InitialTarget),
+	}
+	empty.Hash = CalculateBlockHash(&empty)
+
+	return []Block{block, empty}
+}
+
+func buildVectors(t *testing.T) encodingVectors {
+	vectors := encodingVectors{TxVersion: TxEncodingVersion, HeaderVersion: HeaderEncodingVersion}
+	for i, tx := range vectorTransactions() {
+		encoded, err := tx.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors.Transactions = append(vectors.Transactions, transactionVector{
+			Name:        []string{"transfer", "coinbase"}[i],
+			Transaction: tx,
+			Signable:    hex.EncodeToString(tx.SignableBytes()),
+			ID:          tx.ID,
+			Encoded:     hex.EncodeToString(encoded),
+		})
+	}
+	for i, block := range vectorBlocks() {
+		encoded, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors.Blocks = append(vectors.Blocks, blockVector{
+			Name:    []string{"block", "empty"}[i],
+			Block:   block,
+			Header:  hex.EncodeToString(block.HeaderBytes()),
+			Hash:    block.Hash,
+			Encoded: hex.EncodeToString(encoded),
+		})
+	}
+	return vectors
+}
+
+func TestEncodingVectors(t *testing.T) {
+	if *updateVectors {
+		data, _ := json.MarshalIndent(buildVectors(t), "", "  ")
+		if err := os.WriteFile(vectorsPath, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatalf("failed to read vectors: %v", err)
+	}
+	var vectors encodingVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("failed to parse vectors: %v", err)
+	}
+
+	for _, v := range vectors.Transactions {
+		tx := v.Transaction
+		if got := hex.EncodeToString(tx.SignableBytes()); got != v.Signable {
+			t.Errorf("%s: signable bytes %s, want %s", v.Name, got, v.Signable)
+		}
+		if got := tx.CalculateHash(); got != v.ID {
+			t.Errorf("%s: id %s, want %s", v.Name, got, v.ID)
+		}
+		encoded, _ := tx.MarshalBinary()
+		if got := hex.EncodeToString(encoded); got != v.Encoded {
+			t.Errorf("%s: encoding %s, want %s", v.Name, got, v.Encoded)
+		}
+	}
+
+	for _, v := range vectors.Blocks {
+		block := v.Block
+		if got := hex.EncodeToString(block.HeaderBytes()); got != v.Header {
+			t.Errorf("%s: header bytes %s, want %s", v.Name, got, v.Header)
+		}
+		if got := CalculateBlockHash(&block); got != v.Hash {
+			t.Errorf("%s: hash %s, want %s", v.Name, got, v.Hash)
+		}
+		encoded, _ := block.MarshalBinary()
+		if got := hex.EncodeToString(encoded); got != v.Encoded {
+			t.Errorf("%s: encoding %s, want %s", v.Name, got, v.Encoded)
+		}
+	}
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	for _, tx := range vectorTransactions() {
+		data, err := tx.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var decoded Transaction
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if !reflect.DeepEqual(decoded, tx) {
+			t.Errorf("round trip mismatch:\n got %+v\nwant %+v", decoded, tx)
+		}
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	mined, _ := bc.MineBlock("miner1", nil)
+
+	for _, block := range append(vectorBlocks(), *mined) {
+		data, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var decoded Block
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if !reflect.DeepEqual(decoded, block) {
+			t.Errorf("round trip mismatch:\n got %+v\nwant %+v", decoded, block)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	tx := vectorTransactions()[0]
+	data, _ := tx.MarshalBinary()
+
+	var decoded Transaction
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("truncated encoding should be rejected")
+	}
+	if err := decoded.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Error("trailing bytes should be rejected")
+	}
+
+	wrongVersion := append([]byte{TxEncodingVersion + 1}, data[1:]...)
+	if err := decoded.UnmarshalBinary(wrongVersion); !errors.Is(err, ErrUnknownEncodingVersion) {
+		t.Errorf("unknown version should be rejected, got %v", err)
+	}
+
+	// A header version is not a transaction version
+	block := vectorBlocks()[0]
+	blockData, _ := block.MarshalBinary()
+	var decodedBlock Block
+	if err := decodedBlock.UnmarshalBinary(append([]byte{TxEncodingVersion}, blockData[1:]...)); !errors.Is(err, ErrUnknownEncodingVersion) {
+		t.Errorf("a block with the transaction version should be rejected, got %v", err)
+	}
+}
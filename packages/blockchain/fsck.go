@@ -0,0 +1,297 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FsckReport describes a database checked by Fsck.
+type FsckReport struct {
+	Stored   uint64 // blocks in the database
+	Intact   uint64 // blocks from genesis that are stored in order, linked and valid
+	Problems []string
+
+	// State replayed over the intact blocks and their tip, used by Repair
+	balances map[string]uint64
+	nonces   map[string]uint64
+	tip      ChainTip
+}
+
+// OK reports whether no problems were found.
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Fsck checks a database without modifying it. Blocks must be stored under
+// contiguous keys from genesis and link by hash; the intact part of the chain
+// is then validated and replayed as by ValidateChain. The stored tip and
+// state are compared with the replay, and the block hash, transaction and
+// address indexes with the intact blocks. A nil genesis selects
+// DefaultGenesis.
+func Fsck(s *BoltStorage, genesis *Genesis) (*FsckReport, error) {
+	if genesis == nil {
+		genesis = DefaultGenesis()
+	}
+	report := &FsckReport{}
+
+	var headers []Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		headers, err = scanBlocks(tx, genesis.Block().Hash, report)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) == 0 {
+		report.problem("genesis block is missing or damaged")
+		return report, nil
+	}
+
+	bc := &Blockchain{
+		headers: headers,
+		cache:   newBlockCache(BlockCacheSize),
+		genesis: genesis,
+		chainID: genesis.chainID(&headers[0]),
+		now:     time.Now,
+		store:   s,
+	}
+	snapshot, ok, err := s.LoadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if ok {
+		if snapshot.Height < uint64(len(headers)) && headers[snapshot.Height].Hash == snapshot.Hash {
+			bc.base = snapshot.Height
+		} else {
+			report.problem("snapshot at block %d is not on the intact chain", snapshot.Height)
+		}
+	}
+
+	balances, nonces, valid, err := bc.replayStored()
+	if err != nil {
+		report.problem("%v", err)
+	}
+	report.Intact = valid
+	if valid == 0 {
+		return report, nil
+	}
+	last := headers[valid-1]
+	report.balances = balances
+	report.nonces = nonces
+	report.tip = ChainTip{Height: last.Index, Hash: last.Hash}
+
+	if err := s.checkState(report); err != nil {
+		return nil, err
+	}
+	if err := s.db.View(func(tx *bolt.Tx) error { return checkIndexes(tx, report) }); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// scanBlocks reads the blocks bucket in key order and returns the headers of
+// the blocks before the first gap, undecodable block or broken hash link.
+func scanBlocks(tx *bolt.Tx, genesisHash string, report *FsckReport) ([]Block, error) {
+	var headers []Block
+	broken := false
+	c := tx.Bucket(blocksBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		report.Stored++
+		if broken {
+			continue
+		}
+		height := uint64(len(headers))
+
+		var block Block
+		switch err := block.UnmarshalBinary(v); {
+		case !bytes.Equal(k, blockKey(height)):
+			report.problem("block %d is missing, next key is %q", height, k)
+		case err != nil:
+			report.problem("block %d: %v", height, err)
+		case block.Index != height:
+			report.problem("block %d is stored with index %d", height, block.Index)
+		case height == 0 && block.Hash != genesisHash:
+			report.problem("block 0 is not the genesis block")
+		case height > 0 && block.PrevHash != headers[height-1].Hash:
+			report.problem("block %d does not link to block %d", height, height-1)
+		default:
+			headers = append(headers, block.header())
+			continue
+		}
+		broken = true
+	}
+	if above := report.Stored - uint64(len(headers)); above > 0 {
+		report.problem("%d stored blocks are not connected to the chain", above)
+	}
+
+	// Every hash index entry must name a connected block and vice versa
+	hashes := tx.Bucket(hashesBucket)
+	indexed := 0
+	err := hashes.ForEach(func(k, v []byte) error {
+		height, err := decodeUint64(v)
+		if err != nil || height >= uint64(len(headers)) || headers[height].Hash != string(k) {
+			report.problem("block hash index entry %s does not match a stored block", k)
+			return nil
+		}
+		indexed++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if indexed != len(headers) {
+		report.problem("%d blocks are missing from the block hash index", len(headers)-indexed)
+	}
+	return headers, nil
+}
+
+// checkState compares the stored tip and state with the replayed chain.
+func (s *BoltStorage) checkState(report *FsckReport) error {
+	tip, ok, err := s.LoadTip()
+	if err != nil {
+		return fmt.Errorf("failed to load tip: %w", err)
+	}
+	if !ok {
+		report.problem("no tip is recorded")
+	} else if tip != report.tip {
+		report.problem("tip records block %d (%s), intact chain ends at block %d (%s)", tip.Height, tip.Hash, report.tip.Height, report.tip.Hash)
+	}
+
+	balances, err := s.LoadBalances()
+	if err != nil {
+		return fmt.Errorf("failed to load balances: %w", err)
+	}
+	if diff := stateDiff(balances, report.balances); len(diff) > 0 {
+		report.problem("%d stored balances differ from the replayed chain", len(diff))
+	}
+	nonces, err := s.LoadNonces()
+	if err != nil {
+		return fmt.Errorf("failed to load nonces: %w", err)
+	}
+	if diff := stateDiff(nonces, report.nonces); len(diff) > 0 {
+		report.problem("%d stored nonces differ from the replayed chain", len(diff))
+	}
+	return nil
+}
+
+// checkIndexes compares the transaction and address indexes with the
+// transactions of the intact blocks.
+func checkIndexes(tx *bolt.Tx, report *FsckReport) error {
+	txs := make(map[string][]byte)
+	addrs := make(map[string]string)
+	c := tx.Bucket(blocksBucket).Cursor()
+	last := blockKey(report.tip.Height)
+	for k, v := c.First(); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+		var block Block
+		if err := block.UnmarshalBinary(v); err != nil {
+			return fmt.Errorf("block %s: %w", k, err)
+		}
+		for i := range block.Transactions {
+			t := &block.Transactions[i]
+			loc := TxLocation{Height: block.Index, Position: uint32(i)}
+			txs[t.ID] = encodeTxLocation(loc)
+			for _, addr := range indexedAddresses(t) {
+				addrs[string(addrIndexKey(addr, loc))] = t.ID
+			}
+		}
+	}
+
+	missing, stale := 0, 0
+	txIndex := tx.Bucket(txIndexBucket)
+	for id, loc := range txs {
+		if !bytes.Equal(txIndex.Get([]byte(id)), loc) {
+			missing++
+		}
+	}
+	txIndex.ForEach(func(k, v []byte) error {
+		if !bytes.Equal(txs[string(k)], v) {
+			stale++
+		}
+		return nil
+	})
+	if missing > 0 || stale > 0 {
+		report.problem("transaction index has %d missing and %d stale entries", missing, stale)
+	}
+
+	missing, stale = 0, 0
+	addrIndex := tx.Bucket(addrIndexBucket)
+	for key, id := range addrs {
+		if string(addrIndex.Get([]byte(key))) != id {
+			missing++
+		}
+	}
+	addrIndex.ForEach(func(k, v []byte) error {
+		if id, ok := addrs[string(k)]; !ok || id != string(v) {
+			stale++
+		}
+		return nil
+	})
+	if missing > 0 || stale > 0 {
+		report.problem("address index has %d missing and %d stale entries", missing, stale)
+	}
+	return nil
+}
+
+// Repair truncates the database to the intact blocks found by Fsck, replaces
+// the stored state with the replayed one and rebuilds every index, in one
+// transaction. Blocks above the intact chain are lost; they can be fetched
+// from peers again.
+func (s *BoltStorage) Repair(report *FsckReport) error {
+	if report.Intact == 0 {
+		return errors.New("the genesis block or snapshot is damaged; the database cannot be repaired")
+	}
+	snapshot, ok, err := s.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if ok && report.tip.Height < snapshot.Height {
+		return fmt.Errorf("the chain is damaged below snapshot height %d; import the snapshot again", snapshot.Height)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		from := blockKey(report.tip.Height + 1)
+		if err := deleteFrom(tx.Bucket(blocksBucket), from); err != nil {
+			return err
+		}
+		if err := deleteFrom(tx.Bucket(undoBucket), from); err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{balancesBucket, noncesBucket, hashesBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := putAccounts(tx.Bucket(balancesBucket), report.balances); err != nil {
+			return err
+		}
+		if err := putAccounts(tx.Bucket(noncesBucket), report.nonces); err != nil {
+			return err
+		}
+		if err := indexBlockHashes(tx); err != nil {
+			return err
+		}
+		if err := rebuildIndexes(tx); err != nil {
+			return err
+		}
+
+		tip, err := json.Marshal(report.tip)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(tipKey, tip)
+	})
+}
@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func fsckSource(t *testing.T, blocks int) (*BoltStorage, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, _ := NewBlockchain(store, nil)
+	for i := 0; i < blocks; i++ {
+		if _, err := bc.MineBlock("miner1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store, path
+}
+
+func checkFsck(t *testing.T, store *BoltStorage) *FsckReport {
+	t.Helper()
+	report, err := Fsck(store, nil)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	return report
+}
+
+func TestFsckHealthyDatabase(t *testing.T) {
+	store, _ := fsckSource(t, 3)
+	defer store.Close()
+
+	report := checkFsck(t, store)
+	if !report.OK() || report.Stored != 4 || report.Intact != 4 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestFsckRepairsState(t *testing.T) {
+	store, _ := fsckSource(t, 2)
+	defer store.Close()
+
+	store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(balancesBucket).Put([]byte("miner1"), encodeUint64(1))
+	})
+	report := checkFsck(t, store)
+	if report.OK() {
+		t.Fatal("tampered balance should be reported")
+	}
+
+	if err := store.Repair(report); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report := checkFsck(t, store); !report.OK() {
+		t.Errorf("problems after repair: %v", report.Problems)
+	}
+	balances, _ := store.LoadBalances()
+	if balances["miner1"] != 2*DefaultGenesis().BlockReward(1) {
+		t.Errorf("expected balance %d after repair, got %d", 2*DefaultGenesis().BlockReward(1), balances["miner1"])
+	}
+}
+
+func TestFsckRepairsIndexes(t *testing.T) {
+	store, _ := fsckSource(t, 2)
+	defer store.Close()
+
+	store.db.Update(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(txIndexBucket).Cursor().First()
+		return tx.Bucket(txIndexBucket).Delete(k)
+	})
+	report := checkFsck(t, store)
+	if report.OK() || report.Intact != 3 {
+		t.Fatalf("missing index entry should be reported: %+v", report)
+	}
+
+	if err := store.Repair(report); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report := checkFsck(t, store); !report.OK() {
+		t.Errorf("problems after repair: %v", report.Problems)
+	}
+}
+
+func TestFsckTruncatesDamagedBlocks(t *testing.T) {
+	store, path := fsckSource(t, 5)
+
+	store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).Put(blockKey(3), []byte{HeaderEncodingVersion, 0xff})
+	})
+	report := checkFsck(t, store)
+	if report.OK() || report.Stored != 6 || report.Intact != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if err := store.Repair(report); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report := checkFsck(t, store); !report.OK() || report.Stored != 3 {
+		t.Errorf("unexpected report after repair: %+v", report)
+	}
+	store.Close()
+
+	store, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	bc, err := NewBlockchain(store, nil)
+	if err != nil {
+		t.Fatalf("NewBlockchain after repair: %v", err)
+	}
+	if bc.Height() != 3 || bc.GetBalance("miner1") != 2*DefaultGenesis().BlockReward(1) {
+		t.Errorf("expected height 3 and balance %d, got %d and %d", 2*DefaultGenesis().BlockReward(1), bc.Height(), bc.GetBalance("miner1"))
+	}
+	if _, err := bc.MineBlock("miner1", nil); err != nil {
+		t.Errorf("mining after repair failed: %v", err)
+	}
+}
+
+func TestFsckReportsGap(t *testing.T) {
+	store, _ := fsckSource(t, 4)
+	defer store.Close()
+
+	store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).Delete(blockKey(2))
+	})
+	report := checkFsck(t, store)
+	if report.OK() || report.Stored != 4 || report.Intact != 2 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
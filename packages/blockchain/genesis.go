@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Genesis describes the first block of a chain and the consensus parameters
+// every node on it must agree on. It is usually loaded from a JSON genesis
+// file; fields left out keep their DefaultGenesis values.
+type Genesis struct {
+	ChainID          string            `json:"chainId"`
+	Timestamp        int64             `json:"timestamp"`
+	Alloc            map[string]uint64 `json:"alloc"`
+	InitialTarget    string            `json:"initialTarget"`
+	InitialReward    uint64            `json:"initialReward"`
+	HalvingInterval  uint64            `json:"halvingInterval"`
+	RetargetInterval uint64            `json:"retargetInterval"`
+	TargetBlockTime  int64             `json:"targetBlockTime"`
+}
+
+// DefaultGenesis returns the parameters of the public test network.
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		Timestamp:        GenesisTimestamp,
+		Alloc:            map[string]uint64{},
+		InitialTarget:    TargetToHex(InitialTarget),
+		InitialReward:    MiningReward,
+		HalvingInterval:  HalvingInterval,
+		RetargetInterval: RetargetInterval,
+		TargetBlockTime:  TargetBlockTime,
+	}
+}
+
+// LoadGenesis reads a JSON genesis file on top of DefaultGenesis.
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genesis file: %w", err)
+	}
+
+	g := DefaultGenesis()
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("failed to parse genesis file: %w", err)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis file: %w", err)
+	}
+	return g, nil
+}
+
+// Validate checks the parameters are usable.
+func (g *Genesis) Validate() error {
+	target, err := ParseTarget(g.InitialTarget)
+	if err != nil {
+		return err
+	}
+	if target.Cmp(PowLimit) > 0 {
+		return errors.New("initial target is easier than the proof-of-work limit")
+	}
+	if g.HalvingInterval == 0 || g.RetargetInterval == 0 || g.TargetBlockTime <= 0 {
+		return errors.New("halving interval, retarget interval and target block time must be positive")
+	}
+
+	var premine uint64
+	for addr, amount := range g.Alloc {
+		if addr == "" || addr == CoinbaseSender {
+			return fmt.Errorf("invalid allocation address %q", addr)
+		}
+		if amount == 0 {
+			return fmt.Errorf("allocation to %s is zero", addr)
+		}
+		if amount > math.MaxUint64-premine {
+			return errors.New("allocations overflow")
+		}
+		premine += amount
+	}
+	if premine > TotalSupply {
+		return fmt.Errorf("allocations of %d exceed total supply %d", premine, TotalSupply)
+	}
+	return nil
+}
+
+// Premine returns the sum of all genesis allocations.
+func (g *Genesis) Premine() uint64 {
+	var total uint64
+	for _, amount := range g.Alloc {
+		total += amount
+	}
+	return total
+}
+
+// ParamsHash commits to the consensus parameters. It is stored as the
+// genesis block's PrevHash, so nodes configured differently end up with
+// different genesis hashes and never accept each other's blocks.
+func (g *Genesis) ParamsHash() string {
+	var e encoder
+	e.byte(HeaderEncodingVersion)
+	e.string(g.ChainID)
+	e.string(g.InitialTarget)
+	e.uint64(g.InitialReward)
+	e.uint64(g.HalvingInterval)
+	e.uint64(g.RetargetInterval)
+	e.int64(g.TargetBlockTime)
+	hash := sha256.Sum256(e.buf.Bytes())
+	return fmt.Sprintf("%x", hash)
+}
+
+// Block builds the genesis block. Each allocation is a coinbase transaction,
+// ordered by address so every node builds the same block.
+func (g *Genesis) Block() Block {
+	addrs := make([]string, 0, len(g.Alloc))
+	for addr := range g.Alloc {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	txns := make([]Transaction, 0, len(addrs))
+	for _, addr := range addrs {
+		tx := Transaction{
+			Sender:    CoinbaseSender,
+			Receiver:  addr,
+			Amount:    g.Alloc[addr],
+			Timestamp: g.Timestamp,
+		}
+		tx.ID = tx.CalculateHash()
+		txns = append(txns, tx)
+	}
+
+	genesis := Block{
+		Index:        0,
+		Timestamp:    g.Timestamp,
+		Transactions: txns,
+		PrevHash:     g.ParamsHash(),
+		Target:       g.InitialTarget,
+		Nonce:        0,
+		Miner:        "",
+	}
+	genesis.MerkleRoot = BlockMerkleRoot(&genesis)
+	genesis.StateRoot = StateRoot(g.Alloc, nil)
+	genesis.Hash = CalculateBlockHash(&genesis)
+	return genesis
+}
+
+// chainID returns the configured chain ID, or one derived from the genesis
+// block when the genesis file does not set it.
+func (g *Genesis) chainID(genesis *Block) string {
+	if g.ChainID != "" {
+		return g.ChainID
+	}
+	return ChainIDFromGenesis(genesis)
+}
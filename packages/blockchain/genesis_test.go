@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenesisAllocations(t *testing.T) {
+	genesis := DefaultGenesis()
+	genesis.ChainID = "fernet-devnet"
+	genesis.Alloc = map[string]uint64{
+		"alice": 1000 * OneFernet,
+		"bob":   500 * OneFernet,
+	}
+
+	bc, err := NewBlockchain(NewMemoryStorage(), genesis)
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	if bc.GetBalance("alice") != 1000*OneFernet || bc.GetBalance("bob") != 500*OneFernet {
+		t.Errorf("unexpected balances: alice=%d bob=%d", bc.GetBalance("alice"), bc.GetBalance("bob"))
+	}
+	if bc.ChainID() != "fernet-devnet" {
+		t.Errorf("expected configured chain ID, got %s", bc.ChainID())
+	}
+	if bc.CirculatingSupply() != 1500*OneFernet {
+		t.Errorf("premine should count towards supply, got %d", bc.CirculatingSupply())
+	}
+	if err := bc.ValidateChain(); err != nil {
+		t.Errorf("chain with premine should validate: %v", err)
+	}
+}
+
+func TestGenesisParamsChangeHash(t *testing.T) {
+	a := DefaultGenesis()
+	b := DefaultGenesis()
+	b.TargetBlockTime = 10
+
+	if a.Block().Hash == b.Block().Hash {
+		t.Error("different consensus parameters should produce different genesis blocks")
+	}
+
+	c := DefaultGenesis()
+	c.Alloc = map[string]uint64{"alice": 1}
+	if a.Block().Hash == c.Block().Hash {
+		t.Error("different allocations should produce different genesis blocks")
+	}
+}
+
+func TestStoredGenesisMismatch(t *testing.T) {
+	store := NewMemoryStorage()
+	if _, err := NewBlockchain(store, nil); err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+
+	other := DefaultGenesis()
+	other.ChainID = "fernet-other"
+	if _, err := NewBlockchain(store, other); err == nil {
+		t.Error("loading a chain with a different genesis should fail")
+	}
+}
+
+func TestRejectChainFromOtherGenesis(t *testing.T) {
+	other := DefaultGenesis()
+	other.Alloc = map[string]uint64{"alice": OneFernet}
+
+	bc1, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc2, _ := NewBlockchain(NewMemoryStorage(), other)
+	bc2.MineBlock("miner1", nil)
+	bc2.MineBlock("miner1", nil)
+
+	if bc1.ShouldReplaceChain(bc2.GetChain()) {
+		t.Error("chain from a different genesis should not replace ours")
+	}
+	block := bc2.GetLatestBlock()
+	if _, err := bc1.AddBlock(block); err == nil {
+		t.Error("block from a different genesis should be rejected")
+	}
+}
+
+func TestLoadGenesis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	data := `{"chainId": "fernet-devnet", "timestamp": 1700000000, "alloc": {"alice": 100000000}, "targetBlockTime": 10}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := LoadGenesis(path)
+	if err != nil {
+		t.Fatalf("LoadGenesis failed: %v", err)
+	}
+	if genesis.Timestamp != 1700000000 || genesis.TargetBlockTime != 10 || genesis.Alloc["alice"] != OneFernet {
+		t.Errorf("unexpected genesis: %+v", genesis)
+	}
+	if genesis.InitialReward != MiningReward || genesis.RetargetInterval != RetargetInterval {
+		t.Error("missing fields should keep their defaults")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"alloc": {"alice": 2100000000000001}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadGenesis(path); err == nil {
+		t.Error("allocations above total supply should be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// locatorDenseLength is the number of most recent blocks listed one by one
+// in a block locator before the step between entries starts doubling.
+const locatorDenseLength = 10
+
+// Locator describes the main chain to a peer by listing hashes from the tip
+// back to genesis: the last few blocks one by one, then exponentially
+// further apart. The peer answers from the first hash it also has on its
+// main chain, which is the latest common block within a factor of two.
+func (bc *Blockchain) Locator() []string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	var locator []string
+	step := uint64(1)
+	for height := uint64(len(bc.headers)) - 1; ; height -= step {
+		locator = append(locator, bc.headers[height].Hash)
+		if height == 0 {
+			break
+		}
+		if len(locator) >= locatorDenseLength {
+			step *= 2
+		}
+		if height < step {
+			step = height
+		}
+	}
+	return locator
+}
+
+// HeadersAfter returns up to max main chain headers following the first
+// locator hash found on the main chain, or following genesis if none is.
+func (bc *Blockchain) HeadersAfter(locator []string, max int) []Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	start := uint64(0)
+	for _, hash := range locator {
+		if node, ok := bc.index[hash]; ok && bc.onMainChain(node) {
+			start = node.block.Index
+			break
+		}
+	}
+
+	from := start + 1
+	to := from + uint64(max)
+	if to > uint64(len(bc.headers)) {
+		to = uint64(len(bc.headers))
+	}
+	if from >= to {
+		return nil
+	}
+	result := make([]Block, to-from)
+	copy(result, bc.headers[from:to])
+	return result
+}
+
+// HeaderChain validates headers received from a peer ahead of their blocks,
+// so a branch's links, timestamps and proof of work are checked before any
+// of its transactions are downloaded. The first headers added must extend a
+// block in the block tree; later ones extend the last header added.
+type HeaderChain struct {
+	bc    *Blockchain
+	chain []Block // the last headers added, enough to validate the next one
+	work  *big.Int
+}
+
+// NewHeaderChain returns an empty header chain for headers extending bc.
+func (bc *Blockchain) NewHeaderChain() *HeaderChain {
+	return &HeaderChain{bc: bc}
+}
+
+// Add validates headers in order and appends them. If one is invalid none
+// of them are added.
+func (hc *HeaderChain) Add(headers []Block) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	bc := hc.bc
+	bc.mu.RLock()
+	if hc.chain == nil {
+		parent, ok := bc.index[headers[0].PrevHash]
+		if !ok {
+			bc.mu.RUnlock()
+			return fmt.Errorf("%w: %s", ErrOrphanBlock, headers[0].PrevHash)
+		}
+		hc.chain = bc.ancestors(parent)
+		for i := range hc.chain {
+			hc.chain[i].Transactions = nil
+		}
+		hc.work = new(big.Int).Set(parent.work)
+	}
+	now := bc.now().Unix()
+	bc.mu.RUnlock()
+
+	length := len(hc.chain)
+	work := new(big.Int).Set(hc.work)
+	for i := range headers {
+		header := headers[i].header()
+		if err := bc.validateHeader(hc.chain, &header, now); err != nil {
+			hc.chain = hc.chain[:length]
+			return fmt.Errorf("header %d: %w", header.Index, err)
+		}
+		target, _ := ParseTarget(header.Target)
+		work.Add(work, BlockWork(target))
+		hc.chain = append(hc.chain, header)
+	}
+	hc.work = work
+
+	// Only the last headers are needed to validate the next ones
+	if window := bc.headerWindow(); len(hc.chain) > 2*window {
+		hc.chain = append([]Block(nil), hc.chain[len(hc.chain)-window:]...)
+	}
+	return nil
+}
+
+// Tip returns the last header added. It must not be called before Add
+// succeeds.
+func (hc *HeaderChain) Tip() Block {
+	return hc.chain[len(hc.chain)-1]
+}
+
+// MoreWork reports whether the headers added so far form a branch with more
+// cumulative work than the main chain.
+func (hc *HeaderChain) MoreWork() bool {
+	if hc.work == nil {
+		return false
+	}
+	hc.bc.mu.RLock()
+	defer hc.bc.mu.RUnlock()
+	return hc.work.Cmp(hc.bc.tipNode().work) > 0
+}
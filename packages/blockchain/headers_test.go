@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLocator(t *testing.T) {
+	genesis := DefaultGenesis()
+	genesis.InitialTarget = TargetToHex(PowLimit)
+	bc, _ := NewBlockchain(NewMemoryStorage(), genesis)
+	steppedClock(bc)
+	for i := 0; i < 20; i++ {
+		bc.MineBlock("miner1", nil)
+	}
+
+	locator := bc.Locator()
+	headers := bc.GetHeaders()
+	// Heights 20 down to 11 one by one, then 9, 5 and genesis
+	want := []int{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 9, 5, 0}
+	if len(locator) != len(want) {
+		t.Fatalf("expected %d locator entries, got %d", len(want), len(locator))
+	}
+	for i, height := range want {
+		if locator[i] != headers[height].Hash {
+			t.Errorf("entry %d: expected block %d", i, height)
+		}
+	}
+}
+
+func TestHeadersAfter(t *testing.T) {
+	bc1, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc2, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 3; i++ {
+		block, _ := bc1.MineBlock("miner1", nil)
+		bc2.AddBlock(block)
+	}
+	bc1.MineBlock("miner1", nil)
+	bc1.MineBlock("miner1", nil)
+	bc2.MineBlock("miner2", nil)
+
+	// bc2's tip is unknown to bc1, so headers follow the common block 3
+	headers := bc1.HeadersAfter(bc2.Locator(), 10)
+	if len(headers) != 2 || headers[0].Index != 4 || headers[1].Index != 5 {
+		t.Fatalf("unexpected headers: %+v", headers)
+	}
+	if headers[0].Transactions != nil {
+		t.Error("headers should not carry transactions")
+	}
+	if got := bc1.HeadersAfter(bc2.Locator(), 1); len(got) != 1 || got[0].Index != 4 {
+		t.Errorf("expected only block 4, got %d headers", len(got))
+	}
+	if got := bc1.HeadersAfter([]string{"unknown"}, 10); len(got) != 5 || got[0].Index != 1 {
+		t.Errorf("unknown locator should start after genesis, got %d headers", len(got))
+	}
+	if got := bc1.HeadersAfter(bc1.Locator(), 10); len(got) != 0 {
+		t.Errorf("expected no headers after the tip, got %d", len(got))
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	bc1, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc1.MineBlock("miner1", nil)
+
+	bc2, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 4; i++ {
+		bc2.MineBlock("miner2", nil)
+	}
+	headers := bc2.HeadersAfter(bc1.Locator(), 10)
+
+	hc := bc1.NewHeaderChain()
+	if err := hc.Add(headers[:1]); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if hc.MoreWork() {
+		t.Error("branch with equal work should not have more work")
+	}
+	if err := hc.Add(headers[2:]); err == nil {
+		t.Error("headers that skip a block should be rejected")
+	}
+	if err := hc.Add(headers[1:]); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if !hc.MoreWork() || hc.Tip().Hash != headers[3].Hash {
+		t.Error("branch of 4 blocks should have more work than 1")
+	}
+	if bc1.HasBlock(headers[0].Hash) {
+		t.Error("validated headers should not be added to the block tree")
+	}
+}
+
+func TestHeaderChainRejectsInvalidHeaders(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+
+	other, _ := NewBlockchain(NewMemoryStorage(), nil)
+	block, _ := other.MineBlock("miner2", nil)
+
+	tampered := block.header()
+	tampered.Miner = "miner3"
+	if err := bc.NewHeaderChain().Add([]Block{tampered}); err == nil {
+		t.Error("header with a wrong hash should be rejected")
+	}
+
+	orphan := block.header()
+	orphan.PrevHash = "unknown"
+	if err := bc.NewHeaderChain().Add([]Block{orphan}); !errors.Is(err, ErrOrphanBlock) {
+		t.Errorf("expected ErrOrphanBlock, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The transaction index maps a transaction ID to its height and position.
+// The address index has one key per address and transaction, made of the
+// address, a separator, the height and the position, so a prefix scan lists
+// an address's transactions in chain order.
+var (
+	txIndexBucket   = []byte("txindex")
+	addrIndexBucket = []byte("addrindex")
+)
+
+func encodeTxLocation(loc TxLocation) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, loc.Height)
+	binary.BigEndian.PutUint32(b[8:], loc.Position)
+	return b
+}
+
+func decodeTxLocation(b []byte) (TxLocation, error) {
+	if len(b) != 12 {
+		return TxLocation{}, fmt.Errorf("invalid transaction location of %d bytes", len(b))
+	}
+	return TxLocation{
+		Height:   binary.BigEndian.Uint64(b),
+		Position: binary.BigEndian.Uint32(b[8:]),
+	}, nil
+}
+
+func addrIndexPrefix(address string) []byte {
+	return append([]byte(address), 0)
+}
+
+func addrIndexKey(address string, loc TxLocation) []byte {
+	return append(addrIndexPrefix(address), encodeTxLocation(loc)...)
+}
+
+// indexedAddresses returns the addresses a transaction is listed under.
+func indexedAddresses(tx *Transaction) []string {
+	if tx.Sender == CoinbaseSender || tx.Sender == tx.Receiver {
+		return []string{tx.Receiver}
+	}
+	return []string{tx.Sender, tx.Receiver}
+}
+
+// indexBlock adds a main chain block's transactions to both indexes.
+func indexBlock(tx *bolt.Tx, block *Block) error {
+	txIndex := tx.Bucket(txIndexBucket)
+	addrIndex := tx.Bucket(addrIndexBucket)
+	for i := range block.Transactions {
+		t := &block.Transactions[i]
+		loc := TxLocation{Height: block.Index, Position: uint32(i)}
+		if err := txIndex.Put([]byte(t.ID), encodeTxLocation(loc)); err != nil {
+			return err
+		}
+		for _, addr := range indexedAddresses(t) {
+			if err := addrIndex.Put(addrIndexKey(addr, loc), []byte(t.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexBlock removes a block's transactions from both indexes.
+func unindexBlock(tx *bolt.Tx, block *Block) error {
+	txIndex := tx.Bucket(txIndexBucket)
+	addrIndex := tx.Bucket(addrIndexBucket)
+	for i := range block.Transactions {
+		t := &block.Transactions[i]
+		loc := TxLocation{Height: block.Index, Position: uint32(i)}
+
+		// A transaction may have been moved to another height by a reorg
+		// committed in the same batch; only remove the entry if it is ours.
+		if data := txIndex.Get([]byte(t.ID)); data != nil && bytes.Equal(data, encodeTxLocation(loc)) {
+			if err := txIndex.Delete([]byte(t.ID)); err != nil {
+				return err
+			}
+		}
+		for _, addr := range indexedAddresses(t) {
+			if err := addrIndex.Delete(addrIndexKey(addr, loc)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildIndexes recreates both indexes from the stored blocks.
+func rebuildIndexes(tx *bolt.Tx) error {
+	for _, name := range [][]byte{txIndexBucket, addrIndexBucket} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(blocksBucket).ForEach(func(k, v []byte) error {
+		var block Block
+		if err := block.UnmarshalBinary(v); err != nil {
+			return fmt.Errorf("block %s: %w", k, err)
+		}
+		return indexBlock(tx, &block)
+	})
+}
+
+// indexBlockHashes fills the block hash bucket from the stored blocks.
+func indexBlockHashes(tx *bolt.Tx) error {
+	hashes := tx.Bucket(hashesBucket)
+	return tx.Bucket(blocksBucket).ForEach(func(k, v []byte) error {
+		var block Block
+		if err := block.UnmarshalBinary(v); err != nil {
+			return fmt.Errorf("block %s: %w", k, err)
+		}
+		return hashes.Put([]byte(block.Hash), encodeUint64(block.Index))
+	})
+}
+
+// Reindex rebuilds the transaction and address indexes from the stored blocks.
+func (s *BoltStorage) Reindex() error {
+	return s.db.Update(rebuildIndexes)
+}
+
+func (s *BoltStorage) FindTransaction(txID string) (loc TxLocation, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(txIndexBucket).Get([]byte(txID))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		loc, err = decodeTxLocation(data)
+		return err
+	})
+	return loc, ok, err
+}
+
+func (s *BoltStorage) AddressTransactions(address string) ([]TxLocation, error) {
+	var locs []TxLocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := addrIndexPrefix(address)
+		c := tx.Bucket(addrIndexBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			loc, err := decodeTxLocation(k[len(prefix):])
+			if err != nil {
+				return err
+			}
+			locs = append(locs, loc)
+		}
+		return nil
+	})
+	return locs, err
+}
+
+// memoryIndex mirrors the bbolt indexes for MemoryStorage.
+type memoryIndex struct {
+	txs   map[string]TxLocation
+	addrs map[string][]TxLocation
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{
+		txs:   make(map[string]TxLocation),
+		addrs: make(map[string][]TxLocation),
+	}
+}
+
+func (idx *memoryIndex) add(block *Block) {
+	for i := range block.Transactions {
+		t := &block.Transactions[i]
+		loc := TxLocation{Height: block.Index, Position: uint32(i)}
+		idx.txs[t.ID] = loc
+		for _, addr := range indexedAddresses(t) {
+			idx.addrs[addr] = append(idx.addrs[addr], loc)
+		}
+	}
+}
+
+func (idx *memoryIndex) remove(block *Block) {
+	for i := range block.Transactions {
+		t := &block.Transactions[i]
+		loc := TxLocation{Height: block.Index, Position: uint32(i)}
+		if idx.txs[t.ID] == loc {
+			delete(idx.txs, t.ID)
+		}
+		for _, addr := range indexedAddresses(t) {
+			locs := idx.addrs[addr]
+			for j := range locs {
+				if locs[j] == loc {
+					idx.addrs[addr] = append(locs[:j], locs[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (s *MemoryStorage) FindTransaction(txID string) (TxLocation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index.txs[txID]
+	return loc, ok, nil
+}
+
+func (s *MemoryStorage) AddressTransactions(address string) ([]TxLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TxLocation(nil), s.index.addrs[address]...), nil
+}
@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTransactionIndex(t *testing.T) {
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(store, nil)
+	bc.MineBlock(sender, nil)
+	tx := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0)
+	block, _ := bc.MineBlock("miner1", []Transaction{tx})
+
+	result, err := bc.FindTransaction(tx.ID)
+	if err != nil || result.BlockIndex != block.Index || result.Transaction.ID != tx.ID {
+		t.Fatalf("FindTransaction = %+v, %v", result, err)
+	}
+	if got := bc.GetAddressTransactions(sender); len(got) != 2 || got[0].BlockIndex != 1 || got[1].Transaction.ID != tx.ID {
+		t.Errorf("unexpected sender history: %+v", got)
+	}
+	if got := bc.GetAddressTransactions("receiver"); len(got) != 1 {
+		t.Errorf("expected 1 receiver transaction, got %d", len(got))
+	}
+
+	// Disconnecting the block removes its entries
+	bc.DisconnectTip()
+	if _, err := bc.FindTransaction(tx.ID); err == nil {
+		t.Error("disconnected transaction should not be found")
+	}
+	if got := bc.GetAddressTransactions("receiver"); len(got) != 0 {
+		t.Errorf("expected no receiver transactions, got %d", len(got))
+	}
+}
+
+func TestReindex(t *testing.T) {
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	bc, _ := NewBlockchain(store, nil)
+	block, _ := bc.MineBlock("miner1", nil)
+	coinbase := block.Transactions[0].ID
+
+	store.db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket(txIndexBucket)
+		tx.CreateBucket(txIndexBucket)
+		return nil
+	})
+	if _, ok, _ := store.FindTransaction(coinbase); ok {
+		t.Fatal("index should be empty")
+	}
+
+	if err := store.Reindex(); err != nil {
+		t.Fatalf("Reindex failed: %v", err)
+	}
+	loc, ok, err := store.FindTransaction(coinbase)
+	if err != nil || !ok || loc.Height != 1 || loc.Position != 0 {
+		t.Errorf("FindTransaction after reindex = %+v, %v, %v", loc, ok, err)
+	}
+}
@@ -0,0 +1,177 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// EmptyMerkleRoot is the Merkle root of a block without transactions.
+const EmptyMerkleRoot = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Leaves and inner nodes are hashed with distinct prefixes so an inner node
+// can never be passed off as a transaction ID.
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// MerkleStep is one sibling hash on the path from a leaf to the root.
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // sibling is on the left of the running hash
+}
+
+// MerkleProof proves a transaction is included in a block.
+type MerkleProof struct {
+	TxID       string       `json:"txId"`
+	BlockIndex uint64       `json:"blockIndex"`
+	BlockHash  string       `json:"blockHash"`
+	MerkleRoot string       `json:"merkleRoot"`
+	Path       []MerkleStep `json:"path"`
+}
+
+func merkleLeaf(txID string) []byte {
+	id, _ := hex.DecodeString(txID)
+	h := sha256.Sum256(append([]byte{merkleLeafPrefix}, id...))
+	return h[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// merkleLevels returns every level of the tree, leaves first. A node without
+// a sibling is carried up to the next level unchanged.
+func merkleLevels(txIDs []string) [][][]byte {
+	leaves := make([][]byte, len(txIDs))
+	for i, id := range txIDs {
+		leaves[i] = merkleLeaf(id)
+	}
+	return merkleTree(leaves)
+}
+
+// merkleTree returns every level of the tree over already hashed leaves,
+// leaves first.
+func merkleTree(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, (len(level)+1)/2)
+		for k := range next {
+			next[k] = merkleParent(level, k)
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleParent returns node k of the level above level.
+func merkleParent(level [][]byte, k int) []byte {
+	if 2*k+1 == len(level) {
+		return level[2*k]
+	}
+	return merkleNode(level[2*k], level[2*k+1])
+}
+
+// MerkleRoot computes the root of the Merkle tree over transaction IDs.
+func MerkleRoot(txIDs []string) string {
+	if len(txIDs) == 0 {
+		return EmptyMerkleRoot
+	}
+	levels := merkleLevels(txIDs)
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// BlockMerkleRoot computes the Merkle root of a block's transactions.
+func BlockMerkleRoot(block *Block) string {
+	ids := make([]string, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		ids[i] = tx.ID
+	}
+	return MerkleRoot(ids)
+}
+
+// BuildMerklePath returns the sibling hashes proving the transaction at
+// position is part of the tree over txIDs.
+func BuildMerklePath(txIDs []string, position int) ([]MerkleStep, error) {
+	if position < 0 || position >= len(txIDs) {
+		return nil, fmt.Errorf("position %d out of range", position)
+	}
+
+	var path []MerkleStep
+	levels := merkleLevels(txIDs)
+	for _, level := range levels[:len(levels)-1] {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			path = append(path, MerkleStep{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < position,
+			})
+		}
+		position /= 2
+	}
+	return path, nil
+}
+
+// VerifyMerklePath reports whether path links txID to root.
+func VerifyMerklePath(txID string, path []MerkleStep, root string) bool {
+	current := merkleLeaf(txID)
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+		if step.Left {
+			current = merkleNode(sibling, current)
+		} else {
+			current = merkleNode(current, sibling)
+		}
+	}
+	return hex.EncodeToString(current) == root
+}
+
+// Verify checks the proof against its own Merkle root. Callers must still
+// check that MerkleRoot belongs to a block header they trust.
+func (p *MerkleProof) Verify() bool {
+	return VerifyMerklePath(p.TxID, p.Path, p.MerkleRoot)
+}
+
+// GetMerkleProof builds an inclusion proof for a transaction on the main chain.
+func (bc *Blockchain) GetMerkleProof(txID string) (*MerkleProof, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	loc, ok, err := bc.store.FindTransaction(txID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up transaction: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("transaction %s not found", txID)
+	}
+
+	block, err := bc.blockLocked(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		ids[i] = tx.ID
+	}
+	path, err := BuildMerklePath(ids, int(loc.Position))
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{
+		TxID:       txID,
+		BlockIndex: block.Index,
+		BlockHash:  block.Hash,
+		MerkleRoot: block.MerkleRoot,
+		Path:       path,
+	}, nil
+}
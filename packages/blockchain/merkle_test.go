@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func testTxIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		h := sha256.Sum256([]byte(fmt.Sprintf("tx-%d", i)))
+		ids[i] = hex.EncodeToString(h[:])
+	}
+	return ids
+}
+
+func TestMerkleRootEmpty(t *testing.T) {
+	if MerkleRoot(nil) != EmptyMerkleRoot {
+		t.Errorf("empty tree should have root %s", EmptyMerkleRoot)
+	}
+}
+
+func TestMerklePathAllSizes(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		ids := testTxIDs(n)
+		root := MerkleRoot(ids)
+		for pos := range ids {
+			path, err := BuildMerklePath(ids, pos)
+			if err != nil {
+				t.Fatalf("n=%d pos=%d: %v", n, pos, err)
+			}
+			if !VerifyMerklePath(ids[pos], path, root) {
+				t.Errorf("n=%d pos=%d: valid proof rejected", n, pos)
+			}
+			if VerifyMerklePath(testTxIDs(n + 1)[n], path, root) {
+				t.Errorf("n=%d pos=%d: proof accepted for another transaction", n, pos)
+			}
+		}
+	}
+}
+
+func TestMerkleRootOrderMatters(t *testing.T) {
+	ids := testTxIDs(2)
+	swapped := []string{ids[1], ids[0]}
+	if MerkleRoot(ids) == MerkleRoot(swapped) {
+		t.Error("reordering transactions should change the merkle root")
+	}
+}
+
+func TestGetMerkleProof(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	tx := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0)
+	block, err := bc.MineBlock("miner1", []Transaction{tx})
+	if err != nil {
+		t.Fatalf("MineBlock failed: %v", err)
+	}
+
+	proof, err := bc.GetMerkleProof(tx.ID)
+	if err != nil {
+		t.Fatalf("GetMerkleProof failed: %v", err)
+	}
+	if proof.BlockIndex != block.Index || proof.MerkleRoot != block.MerkleRoot {
+		t.Error("proof should reference the including block")
+	}
+	if !proof.Verify() {
+		t.Error("proof should verify against the block's merkle root")
+	}
+}
+
+func TestTamperedTransactionsRejected(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+
+	block := buildBlock(bc, "miner2", nil)
+	block.Transactions = append(block.Transactions, signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0))
+
+	if CalculateBlockHash(block) != block.Hash {
+		t.Fatal("block hash should only cover the header")
+	}
+	if _, err := bc.AddBlock(block); err == nil {
+		t.Error("block whose transactions do not match its merkle root should be rejected")
+	}
+}
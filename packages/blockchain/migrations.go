@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the BoltStorage layout written by this version. Databases
+// without a recorded version are schema 1.
+const SchemaVersion uint64 = 5
+
+// minSchemaVersion is the oldest layout that can be migrated. Earlier
+// pre-release layouts stored blocks in encodings whose hashes and proofs of
+// work do not carry over, so those chains have to be downloaded again.
+const minSchemaVersion uint64 = 5
+
+var (
+	schemaVersionKey = []byte("schemaVersion")
+
+	ErrNewerSchema = errors.New("database was written by a newer version")
+
+	ErrIncompatibleDatabase = errors.New("incompatible pre-release database; move it aside and resync or import an archive")
+)
+
+// migration upgrades a database from version-1 to version inside a single
+// bbolt transaction.
+type migration struct {
+	version     uint64
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations must be listed in version order, one per schema version above
+// minSchemaVersion.
+var migrations = []migration{}
+
+// SchemaVersion returns the schema version recorded in the database.
+func (s *BoltStorage) SchemaVersion() (uint64, error) {
+	var version uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = readSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+func readSchemaVersion(tx *bolt.Tx) (uint64, error) {
+	data := tx.Bucket(metaBucket).Get(schemaVersionKey)
+	if data == nil {
+		if k, _ := tx.Bucket(blocksBucket).Cursor().First(); k == nil {
+			return SchemaVersion, nil // new database
+		}
+		return 1, nil
+	}
+	return decodeUint64(data)
+}
+
+// migrate brings the database up to SchemaVersion, backing it up first.
+func (s *BoltStorage) migrate() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: schema version %d, this node supports up to %d", ErrNewerSchema, version, SchemaVersion)
+	}
+
+	if version < minSchemaVersion {
+		return fmt.Errorf("%w: schema version %d", ErrIncompatibleDatabase, version)
+	}
+
+	if version < SchemaVersion {
+		backup := fmt.Sprintf("%s.v%d.bak", s.path, version)
+		if err := s.db.View(func(tx *bolt.Tx) error { return tx.CopyFile(backup, 0600) }); err != nil {
+			return fmt.Errorf("failed to back up database before migration: %w", err)
+		}
+		log.Printf("Backed up schema version %d database to %s", version, backup)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+			return tx.Bucket(metaBucket).Put(schemaVersionKey, encodeUint64(m.version))
+		})
+		if err != nil {
+			return fmt.Errorf("migration to schema version %d failed: %w", m.version, err)
+		}
+		log.Printf("Migrated database to schema version %d: %s", m.version, m.description)
+		version = m.version
+	}
+
+	// Record the version of new databases
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, encodeUint64(version))
+	})
+}
@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// baselineGenesis is the genesis block as the first release stored it: JSON
+// under a zero-padded decimal key.
+const baselineGenesis = `{"index":0,"timestamp":1700000000,"transactions":[],"prevHash":"0","hash":"26f714c00a8e57a134c962465041d6eee33638b1d9acce885d5c3e9aa3f54fc6","nonce":0,"miner":""}`
+
+// writeSchema1 creates a database in the layout used before schema versions
+// were recorded, with the given genesis block value.
+func writeSchema1(t *testing.T, path string, genesis []byte) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, balancesBucket, noncesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		tx.Bucket(blocksBucket).Put([]byte("0000000000"), genesis)
+		tx.Bucket(balancesBucket).Put([]byte("alice"), []byte("5000000000"))
+		return tx.Bucket(noncesBucket).Put([]byte("alice"), []byte("3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreReleaseDatabaseRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	writeSchema1(t, path, []byte(baselineGenesis))
+
+	if _, err := NewBoltStorage(path); !errors.Is(err, ErrIncompatibleDatabase) {
+		t.Errorf("expected ErrIncompatibleDatabase, got %v", err)
+	}
+	if _, err := os.Stat(path + ".v1.bak"); err == nil {
+		t.Error("a database that cannot be migrated should not be backed up")
+	}
+}
+
+func TestNewDatabaseHasCurrentSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if version, _ := store.SchemaVersion(); version != SchemaVersion {
+		t.Errorf("expected schema version %d, got %d", SchemaVersion, version)
+	}
+	if _, err := os.Stat(path + ".v1.bak"); err == nil {
+		t.Error("a new database should not be backed up")
+	}
+}
+
+func TestNewerSchemaRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	store, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, encodeUint64(SchemaVersion+1))
+	})
+	store.Close()
+
+	if _, err := NewBoltStorage(path); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("expected ErrNewerSchema, got %v", err)
+	}
+}
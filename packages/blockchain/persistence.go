@@ -1,6 +1,8 @@
 package blockchain
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -13,13 +15,21 @@ var (
 	balancesBucket = []byte("balances")
 	noncesBucket   = []byte("nonces")
 	metaBucket     = []byte("meta")
+	undoBucket     = []byte("undo")
+	hashesBucket   = []byte("blockhashes") // block hash to height
+
+	tipKey      = []byte("tip")
+	snapshotKey = []byte("snapshot")
 )
 
 // BoltStorage implements Storage using bbolt (single-file embedded DB).
 type BoltStorage struct {
-	db *bolt.DB
+	db   *bolt.DB
+	path string
 }
 
+// NewBoltStorage opens the database at path, creating it if needed and
+// migrating it to SchemaVersion. A backup is taken before migrating.
 func NewBoltStorage(path string) (*BoltStorage, error) {
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
@@ -27,7 +37,7 @@ func NewBoltStorage(path string) (*BoltStorage, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		for _, bucket := range [][]byte{blocksBucket, balancesBucket, noncesBucket, metaBucket} {
+		for _, bucket := range [][]byte{blocksBucket, balancesBucket, noncesBucket, metaBucket, undoBucket, hashesBucket, txIndexBucket, addrIndexBucket} {
 			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
 				return err
 			}
@@ -39,90 +49,195 @@ func NewBoltStorage(path string) (*BoltStorage, error) {
 		return nil, fmt.Errorf("failed to create buckets: %w", err)
 	}
 
-	return &BoltStorage{db: db}, nil
+	s := &BoltStorage{db: db, path: path}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func blockKey(index uint64) []byte {
+	return []byte(fmt.Sprintf("%010d", index))
 }
 
-func (s *BoltStorage) SaveBlock(block Block) error {
+// Commit writes a chain update in one bbolt transaction.
+func (s *BoltStorage) Commit(batch *ChainBatch) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(blocksBucket)
-		data, err := json.Marshal(block)
-		if err != nil {
-			return err
+		hashes := tx.Bucket(hashesBucket)
+		for i := range batch.Disconnected {
+			if err := unindexBlock(tx, &batch.Disconnected[i]); err != nil {
+				return err
+			}
+			if err := hashes.Delete([]byte(batch.Disconnected[i].Hash)); err != nil {
+				return err
+			}
 		}
-		key := fmt.Sprintf("%010d", block.Index)
-		return b.Put([]byte(key), data)
-	})
-}
 
-func (s *BoltStorage) LoadChain() ([]Block, error) {
-	var chain []Block
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(blocksBucket)
-		return b.ForEach(func(k, v []byte) error {
-			var block Block
-			if err := json.Unmarshal(v, &block); err != nil {
+		blocks := tx.Bucket(blocksBucket)
+		for i := range batch.Blocks {
+			data, err := batch.Blocks[i].MarshalBinary()
+			if err != nil {
 				return err
 			}
-			chain = append(chain, block)
-			return nil
-		})
-	})
-	return chain, err
-}
+			if err := blocks.Put(blockKey(batch.Blocks[i].Index), data); err != nil {
+				return err
+			}
+			if err := indexBlock(tx, &batch.Blocks[i]); err != nil {
+				return err
+			}
+			if err := hashes.Put([]byte(batch.Blocks[i].Hash), encodeUint64(batch.Blocks[i].Index)); err != nil {
+				return err
+			}
+		}
 
-func (s *BoltStorage) SaveBalances(balances map[string]uint64) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(balancesBucket)
-		c := b.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			if err := b.Delete(k); err != nil {
+		undo := tx.Bucket(undoBucket)
+		for i := range batch.Undo {
+			data, err := json.Marshal(batch.Undo[i])
+			if err != nil {
 				return err
 			}
+			if err := undo.Put(blockKey(batch.Blocks[i].Index), data); err != nil {
+				return err
+			}
+		}
+
+		// Drop blocks left above the new tip by a reorganization
+		if err := deleteFrom(blocks, blockKey(batch.Tip.Height+1)); err != nil {
+			return err
+		}
+		if err := deleteFrom(undo, blockKey(batch.Tip.Height+1)); err != nil {
+			return err
+		}
+
+		if err := putAccounts(tx.Bucket(balancesBucket), batch.Balances); err != nil {
+			return err
+		}
+		if err := putAccounts(tx.Bucket(noncesBucket), batch.Nonces); err != nil {
+			return err
 		}
-		for addr, bal := range balances {
-			data, err := json.Marshal(bal)
+
+		if batch.Snapshot != nil {
+			data, err := json.Marshal(batch.Snapshot)
 			if err != nil {
 				return err
 			}
-			if err := b.Put([]byte(addr), data); err != nil {
+			if err := tx.Bucket(metaBucket).Put(snapshotKey, data); err != nil {
 				return err
 			}
 		}
-		return nil
+
+		tip, err := json.Marshal(batch.Tip)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(tipKey, tip)
 	})
 }
 
-func (s *BoltStorage) LoadBalances() (map[string]uint64, error) {
-	balances := make(map[string]uint64)
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(balancesBucket)
-		return b.ForEach(func(k, v []byte) error {
-			var bal uint64
-			if err := json.Unmarshal(v, &bal); err != nil {
+// deleteFrom removes every key at or after start.
+func deleteFrom(b *bolt.Bucket, start []byte) error {
+	var stale [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(start); k != nil; k, _ = c.Next() {
+		stale = append(stale, append([]byte(nil), k...))
+	}
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putAccounts writes per-account values, removing accounts set to zero.
+func putAccounts(b *bolt.Bucket, values map[string]uint64) error {
+	for addr, v := range values {
+		if v == 0 {
+			if err := b.Delete([]byte(addr)); err != nil {
 				return err
 			}
-			balances[string(k)] = bal
+			continue
+		}
+		if err := b.Put([]byte(addr), encodeUint64(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAccounts reads every per-account value of a bucket.
+func (s *BoltStorage) loadAccounts(bucket []byte) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			value, err := decodeUint64(v)
+			if err != nil {
+				return fmt.Errorf("account %s: %w", k, err)
+			}
+			values[string(k)] = value
 			return nil
 		})
 	})
-	return balances, err
+	return values, err
 }
 
-func (s *BoltStorage) SaveNonces(nonces map[string]uint64) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(noncesBucket)
-		c := b.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			if err := b.Delete(k); err != nil {
-				return err
-			}
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func decodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid integer of %d bytes", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (s *BoltStorage) GetBlock(height uint64) (block Block, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(blocksBucket).Get(blockKey(height))
+		if data == nil {
+			return nil
 		}
-		for addr, nonce := range nonces {
-			data, err := json.Marshal(nonce)
-			if err != nil {
-				return err
+		ok = true
+		return block.UnmarshalBinary(data)
+	})
+	return block, ok, err
+}
+
+func (s *BoltStorage) GetBlockByHash(hash string) (Block, bool, error) {
+	var height uint64
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(hashesBucket).Get([]byte(hash))
+		if data == nil {
+			return nil
+		}
+		found = true
+		var err error
+		height, err = decodeUint64(data)
+		return err
+	})
+	if err != nil || !found {
+		return Block{}, false, err
+	}
+	return s.GetBlock(height)
+}
+
+// IterateBlocks calls fn for each stored block from height from to to,
+// inclusive, stopping at the first error.
+func (s *BoltStorage) IterateBlocks(from, to uint64, fn func(*Block) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(blocksBucket).Cursor()
+		end := blockKey(to)
+		for k, v := c.Seek(blockKey(from)); k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			var block Block
+			if err := block.UnmarshalBinary(v); err != nil {
+				return fmt.Errorf("block %s: %w", k, err)
 			}
-			if err := b.Put([]byte(addr), data); err != nil {
+			if err := fn(&block); err != nil {
 				return err
 			}
 		}
@@ -130,20 +245,53 @@ func (s *BoltStorage) SaveNonces(nonces map[string]uint64) error {
 	})
 }
 
+func (s *BoltStorage) LoadBalances() (map[string]uint64, error) {
+	return s.loadAccounts(balancesBucket)
+}
+
 func (s *BoltStorage) LoadNonces() (map[string]uint64, error) {
-	nonces := make(map[string]uint64)
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(noncesBucket)
-		return b.ForEach(func(k, v []byte) error {
-			var nonce uint64
-			if err := json.Unmarshal(v, &nonce); err != nil {
-				return err
-			}
-			nonces[string(k)] = nonce
+	return s.loadAccounts(noncesBucket)
+}
+
+// LoadTip returns the tip pointer written by the last commit. ok is false
+// for databases written before tips were recorded.
+func (s *BoltStorage) LoadTip() (tip ChainTip, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(tipKey)
+		if data == nil {
 			return nil
-		})
+		}
+		ok = true
+		return json.Unmarshal(data, &tip)
+	})
+	return tip, ok, err
+}
+
+// LoadUndo returns the undo record of the main chain block at height.
+func (s *BoltStorage) LoadUndo(height uint64) (undo BlockUndo, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(undoBucket).Get(blockKey(height))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &undo)
 	})
-	return nonces, err
+	return undo, ok, err
+}
+
+// LoadSnapshot returns the state the stored chain was started from, if it
+// was imported from a snapshot.
+func (s *BoltStorage) LoadSnapshot() (snapshot StateSnapshot, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(snapshotKey)
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &snapshot)
+	})
+	return snapshot, ok, err
 }
 
 func (s *BoltStorage) Close() error {
@@ -156,36 +304,101 @@ type MemoryStorage struct {
 	blocks   []Block
 	balances map[string]uint64
 	nonces   map[string]uint64
+	undo     map[uint64]BlockUndo
+	index    *memoryIndex
+	tip      *ChainTip
+	snapshot *StateSnapshot
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
 		balances: make(map[string]uint64),
 		nonces:   make(map[string]uint64),
+		undo:     make(map[uint64]BlockUndo),
+		index:    newMemoryIndex(),
 	}
 }
 
-func (s *MemoryStorage) SaveBlock(block Block) error {
+func (s *MemoryStorage) Commit(batch *ChainBatch) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.blocks = append(s.blocks, block)
+	for i := range batch.Disconnected {
+		s.index.remove(&batch.Disconnected[i])
+	}
+	for _, block := range batch.Blocks {
+		s.index.add(&block)
+		if block.Index < uint64(len(s.blocks)) {
+			s.blocks[block.Index] = block
+		} else {
+			s.blocks = append(s.blocks, block)
+		}
+	}
+	for i, undo := range batch.Undo {
+		s.undo[batch.Blocks[i].Index] = undo
+	}
+	if batch.Tip.Height+1 < uint64(len(s.blocks)) {
+		s.blocks = s.blocks[:batch.Tip.Height+1]
+	}
+	for height := range s.undo {
+		if height > batch.Tip.Height {
+			delete(s.undo, height)
+		}
+	}
+	for addr, v := range batch.Balances {
+		if v == 0 {
+			delete(s.balances, addr)
+		} else {
+			s.balances[addr] = v
+		}
+	}
+	for addr, v := range batch.Nonces {
+		if v == 0 {
+			delete(s.nonces, addr)
+		} else {
+			s.nonces[addr] = v
+		}
+	}
+	if batch.Snapshot != nil {
+		snapshot := *batch.Snapshot
+		s.snapshot = &snapshot
+	}
+	tip := batch.Tip
+	s.tip = &tip
 	return nil
 }
 
-func (s *MemoryStorage) LoadChain() ([]Block, error) {
+func (s *MemoryStorage) GetBlock(height uint64) (Block, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	result := make([]Block, len(s.blocks))
-	copy(result, s.blocks)
-	return result, nil
+	if height >= uint64(len(s.blocks)) {
+		return Block{}, false, nil
+	}
+	return s.blocks[height], true, nil
 }
 
-func (s *MemoryStorage) SaveBalances(balances map[string]uint64) error {
+func (s *MemoryStorage) GetBlockByHash(hash string) (Block, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.balances = make(map[string]uint64)
-	for k, v := range balances {
-		s.balances[k] = v
+	for _, block := range s.blocks {
+		if block.Hash == hash {
+			return block, true, nil
+		}
+	}
+	return Block{}, false, nil
+}
+
+func (s *MemoryStorage) IterateBlocks(from, to uint64, fn func(*Block) error) error {
+	s.mu.Lock()
+	blocks := make([]Block, 0)
+	for i := from; i <= to && i < uint64(len(s.blocks)); i++ {
+		blocks = append(blocks, s.blocks[i])
+	}
+	s.mu.Unlock()
+
+	for i := range blocks {
+		if err := fn(&blocks[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -200,16 +413,6 @@ func (s *MemoryStorage) LoadBalances() (map[string]uint64, error) {
 	return result, nil
 }
 
-func (s *MemoryStorage) SaveNonces(nonces map[string]uint64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.nonces = make(map[string]uint64)
-	for k, v := range nonces {
-		s.nonces[k] = v
-	}
-	return nil
-}
-
 func (s *MemoryStorage) LoadNonces() (map[string]uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -220,6 +423,31 @@ func (s *MemoryStorage) LoadNonces() (map[string]uint64, error) {
 	return result, nil
 }
 
+func (s *MemoryStorage) LoadTip() (ChainTip, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tip == nil {
+		return ChainTip{}, false, nil
+	}
+	return *s.tip, true, nil
+}
+
+func (s *MemoryStorage) LoadUndo(height uint64) (BlockUndo, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	undo, ok := s.undo[height]
+	return undo, ok, nil
+}
+
+func (s *MemoryStorage) LoadSnapshot() (StateSnapshot, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot == nil {
+		return StateSnapshot{}, false, nil
+	}
+	return *s.snapshot, true, nil
+}
+
 func (s *MemoryStorage) Close() error {
 	return nil
 }
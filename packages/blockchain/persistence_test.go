@@ -0,0 +1,274 @@
+package blockchain
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingStorage rejects commits once fail is set.
+type failingStorage struct {
+	*MemoryStorage
+	fail bool
+}
+
+func (s *failingStorage) Commit(batch *ChainBatch) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemoryStorage.Commit(batch)
+}
+
+func TestFailedCommitRollsBack(t *testing.T) {
+	store := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	bc, _ := NewBlockchain(store, nil)
+	bc.MineBlock("miner1", nil)
+
+	store.fail = true
+	if _, err := bc.MineBlock("miner1", nil); err == nil {
+		t.Fatal("mining should fail when storage cannot commit")
+	}
+	if bc.Height() != 2 {
+		t.Errorf("chain should stay at 2 blocks, got %d", bc.Height())
+	}
+	if bc.GetBalance("miner1") != MiningReward {
+		t.Errorf("balance should be rolled back to %d, got %d", MiningReward, bc.GetBalance("miner1"))
+	}
+
+	store.fail = false
+	if _, err := bc.MineBlock("miner1", nil); err != nil {
+		t.Fatalf("mining should succeed once storage recovers: %v", err)
+	}
+	if err := bc.ValidateChain(); err != nil {
+		t.Errorf("chain invalid after recovery: %v", err)
+	}
+}
+
+func TestBoltCommitReorg(t *testing.T) {
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	bc1, _ := NewBlockchain(store, nil)
+	bc1.MineBlock("miner1", nil)
+	bc1.MineBlock("miner1", nil)
+
+	// A longer competing chain paying another miner
+	bc2, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 3; i++ {
+		bc2.MineBlock("miner2", nil)
+	}
+	if _, err := bc1.ReplaceChain(bc2.GetChain()); err != nil {
+		t.Fatalf("ReplaceChain failed: %v", err)
+	}
+
+	tip, ok, _ := store.GetBlock(3)
+	if _, extra, _ := store.GetBlock(4); !ok || extra || tip.Hash != bc2.GetLatestBlock().Hash {
+		t.Fatalf("stored chain does not match the new main chain")
+	}
+	balances, _ := store.LoadBalances()
+	if _, ok := balances["miner1"]; ok {
+		t.Error("disconnected miner should have no stored balance")
+	}
+	if balances["miner2"] != 3*MiningReward {
+		t.Errorf("expected stored balance %d, got %d", 3*MiningReward, balances["miner2"])
+	}
+}
+
+func TestLoadStateFromStorage(t *testing.T) {
+	store := NewMemoryStorage()
+	bc1, _ := NewBlockchain(store, nil)
+	bc1.MineBlock("miner1", nil)
+
+	bc2, _ := NewBlockchain(store, nil)
+	if bc2.GetBalance("miner1") != MiningReward {
+		t.Errorf("expected balance loaded from storage, got %d", bc2.GetBalance("miner1"))
+	}
+
+	// Stored state that does not match the tip's state root is replayed
+	store.balances["miner1"] = 1
+	bc3, _ := NewBlockchain(store, nil)
+	if bc3.GetBalance("miner1") != MiningReward {
+		t.Errorf("corrupted balance should be replayed, got %d", bc3.GetBalance("miner1"))
+	}
+	if balances, _ := store.LoadBalances(); balances["miner1"] != MiningReward {
+		t.Errorf("replayed balance should be written back, got %d", balances["miner1"])
+	}
+}
+
+func TestLoadStateWithoutTipReplays(t *testing.T) {
+	store := NewMemoryStorage()
+	bc1, _ := NewBlockchain(store, nil)
+	bc1.MineBlock("miner1", nil)
+
+	store.tip = nil
+	store.balances = map[string]uint64{"stale": 5}
+	bc2, _ := NewBlockchain(store, nil)
+	if bc2.GetBalance("miner1") != MiningReward || bc2.GetBalance("stale") != 0 {
+		t.Errorf("state should be replayed from the chain")
+	}
+
+	tip, ok, _ := store.LoadTip()
+	if !ok || tip.Hash != bc1.GetLatestBlock().Hash {
+		t.Errorf("replayed state should be saved with the tip")
+	}
+	balances, _ := store.LoadBalances()
+	if len(balances) != 1 || balances["miner1"] != MiningReward {
+		t.Errorf("unexpected stored balances after replay: %v", balances)
+	}
+}
+
+func TestLoadStateRefusesBlockThatDoesNotApply(t *testing.T) {
+	store := NewMemoryStorage()
+	bc1, _ := NewBlockchain(store, nil)
+	bc1.MineBlock("miner1", nil)
+	bc1.MineBlock("miner1", nil)
+
+	// A stored block whose coinbase pays more than its state root allows
+	store.tip = nil
+	store.blocks[2].Transactions[0].Amount++
+	if _, err := NewBlockchain(store, nil); err == nil || !strings.Contains(err.Error(), "fsck -repair") {
+		t.Fatalf("loading should fail and point to fsck -repair, got %v", err)
+	}
+	if store.tip != nil || store.balances["miner1"] != 2*MiningReward {
+		t.Errorf("partially replayed state should not be saved, have tip %v and balances %v", store.tip, store.balances)
+	}
+}
+
+func TestDisconnectTip(t *testing.T) {
+	privKey, pubKey, sender := generateTestWallet()
+	store := NewMemoryStorage()
+	bc, _ := NewBlockchain(store, nil)
+	bc.MineBlock(sender, nil)
+
+	tx := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, 0)
+	block, err := bc.MineBlock("miner1", []Transaction{tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := bc.DisconnectTip()
+	if err != nil {
+		t.Fatalf("DisconnectTip failed: %v", err)
+	}
+	if len(update.Disconnected) != 1 || update.Disconnected[0].Hash != block.Hash {
+		t.Errorf("update should list the disconnected block")
+	}
+	if bc.Height() != 2 {
+		t.Errorf("expected 2 blocks, got %d", bc.Height())
+	}
+	if bc.GetBalance(sender) != MiningReward || bc.GetBalance("receiver") != 0 || bc.GetBalance("miner1") != 0 || bc.GetNonce(sender) != 0 {
+		t.Errorf("state not restored: sender=%d receiver=%d miner1=%d nonce=%d",
+			bc.GetBalance(sender), bc.GetBalance("receiver"), bc.GetBalance("miner1"), bc.GetNonce(sender))
+	}
+
+	// Storage follows, and the next load starts from the restored state
+	bc2, err := NewBlockchain(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc2.Height() != 2 || bc2.GetBalance("receiver") != 0 || bc2.GetBalance(sender) != MiningReward {
+		t.Errorf("stored chain and state should match the disconnected tip")
+	}
+	if _, ok, _ := store.LoadUndo(block.Index); ok {
+		t.Error("undo record of the disconnected block should be removed")
+	}
+
+	// The block can be connected again
+	if _, err := bc.AddBlock(block); err != nil {
+		t.Fatalf("re-adding disconnected block failed: %v", err)
+	}
+	if bc.GetBalance("receiver") != OneFernet {
+		t.Errorf("expected receiver balance %d, got %d", OneFernet, bc.GetBalance("receiver"))
+	}
+}
+
+func TestRewindTo(t *testing.T) {
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	for i := 0; i < 3; i++ {
+		bc.MineBlock("miner1", nil)
+	}
+
+	update, err := bc.RewindTo(1)
+	if err != nil {
+		t.Fatalf("RewindTo failed: %v", err)
+	}
+	if len(update.Disconnected) != 2 || bc.Height() != 2 || bc.GetBalance("miner1") != MiningReward {
+		t.Errorf("unexpected chain after rewind: height=%d balance=%d", bc.Height(), bc.GetBalance("miner1"))
+	}
+
+	if _, err := bc.RewindTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.DisconnectTip(); err == nil {
+		t.Error("disconnecting the genesis block should fail")
+	}
+}
+
+func TestBlocksLoadedFromStorage(t *testing.T) {
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	bc, _ := NewBlockchain(store, nil)
+	for i := 0; i < 4; i++ {
+		bc.MineBlock("miner1", nil)
+	}
+	mined, _ := bc.GetBlock(2)
+
+	// A fresh chain has only headers and an empty cache
+	reloaded, err := NewBlockchain(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.cache = newBlockCache(1)
+	block, err := reloaded.GetBlock(2)
+	if err != nil {
+		t.Fatalf("GetBlock failed: %v", err)
+	}
+	if block.Hash != mined.Hash || len(block.Transactions) != 1 {
+		t.Errorf("block 2 not loaded with its body")
+	}
+	byHash, err := reloaded.GetBlockByHash(mined.Hash)
+	if err != nil || byHash.Index != 2 {
+		t.Errorf("GetBlockByHash should find block 2: %v", err)
+	}
+	if _, err := reloaded.GetBlock(5); err == nil {
+		t.Error("block past the tip should not be found")
+	}
+
+	blocks, err := reloaded.GetBlocks(1, 3)
+	if err != nil || len(blocks) != 3 || blocks[0].Index != 1 || blocks[2].Index != 3 {
+		t.Fatalf("GetBlocks returned %d blocks: %v", len(blocks), err)
+	}
+	if err := reloaded.ValidateChain(); err != nil {
+		t.Errorf("chain invalid when streamed from storage: %v", err)
+	}
+
+	stored, ok, err := store.GetBlockByHash(mined.Hash)
+	if err != nil || !ok || stored.Index != 2 {
+		t.Errorf("storage should find block 2 by hash")
+	}
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newBlockCache(2)
+	c.add(&Block{Hash: "a"})
+	c.add(&Block{Hash: "b"})
+	c.get("a")
+	c.add(&Block{Hash: "c"})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used block should be evicted")
+	}
+	for _, hash := range []string{"a", "c"} {
+		if _, ok := c.get(hash); !ok {
+			t.Errorf("block %s should still be cached", hash)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package blockchain
+
+// subsidy returns the scheduled reward at height before the supply cap is
+// applied: InitialReward, halved every HalvingInterval blocks.
+func (g *Genesis) subsidy(height uint64) uint64 {
+	if height == 0 {
+		return 0
+	}
+	halvings := (height - 1) / g.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return g.InitialReward >> halvings
+}
+
+// SupplyAtHeight returns the genesis allocations plus the total amount issued
+// by the coinbase transactions of all blocks up to and including height. It
+// never exceeds TotalSupply.
+func (g *Genesis) SupplyAtHeight(height uint64) uint64 {
+	issued := g.Premine()
+	for start := uint64(1); start <= height; start += g.HalvingInterval {
+		reward := g.subsidy(start)
+		if reward == 0 {
+			break
+		}
+		end := start + g.HalvingInterval - 1
+		if end > height {
+			end = height
+		}
+		blocks := end - start + 1
+		if reward > (TotalSupply-issued)/blocks {
+			return TotalSupply
+		}
+		issued += reward * blocks
+	}
+	return issued
+}
+
+// BlockReward returns the coinbase reward for a block at height. The final
+// reward is trimmed so that total issuance never exceeds TotalSupply.
+func (g *Genesis) BlockReward(height uint64) uint64 {
+	if height == 0 {
+		return 0
+	}
+	return g.SupplyAtHeight(height) - g.SupplyAtHeight(height-1)
+}
+
+// CirculatingSupply returns the supply issued up to the current tip.
+func (bc *Blockchain) CirculatingSupply() uint64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.genesis.SupplyAtHeight(bc.headers[len(bc.headers)-1].Index)
+}
@@ -0,0 +1,284 @@
+package blockchain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// ExportSnapshot.
+//
+// Layout (integers big-endian, strings as a uint32 length followed by bytes):
+//
+//	snapshot: magic "FRNSNAPS" | version | genesis hash | height u64 | header* | account count u64 | account*
+//	header:   length u32 | block header encoding (see HeaderEncodingVersion)
+//	account:  address | balance u64 | nonce u64
+//
+// It holds the headers of every block from genesis to height, so a new node
+// can check their proof of work, and the full account state after the block
+// at height, ordered by address, which must match that block's state root.
+const SnapshotVersion byte = 1
+
+var snapshotMagic = [8]byte{'F', 'R', 'N', 'S', 'N', 'A', 'P', 'S'}
+
+var ErrNotSnapshot = errors.New("not a state snapshot")
+
+// SnapshotInfo describes the block a snapshot was taken at.
+type SnapshotInfo struct {
+	Height   uint64
+	Hash     string
+	Accounts int
+}
+
+// ExportSnapshot writes the headers up to height and the account state after
+// the block at height to w. State at heights below the tip is found by rolling
+// the current state back with the blocks' undo records.
+func (bc *Blockchain) ExportSnapshot(w io.Writer, height uint64) (*SnapshotInfo, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	tip := uint64(len(bc.headers)) - 1
+	if height == 0 || height > tip {
+		return nil, fmt.Errorf("height must be between 1 and %d", tip)
+	}
+	if height < bc.base {
+		return nil, fmt.Errorf("state before snapshot height %d is not available", bc.base)
+	}
+
+	view := newStateView(bc.Balances, bc.Nonces)
+	for h := tip; h > height; h-- {
+		block, err := bc.blockLocked(h)
+		if err != nil {
+			return nil, err
+		}
+		if err := bc.disconnectBlock(view, block); err != nil {
+			return nil, err
+		}
+	}
+	balances, nonces := view.accounts()
+	if StateRoot(balances, nonces) != bc.headers[height].StateRoot {
+		return nil, fmt.Errorf("state at height %d does not match its state root", height)
+	}
+
+	// Each part is encoded and handed to the buffered writer in turn, so the
+	// snapshot is never held in memory as a whole
+	bw := bufio.NewWriter(w)
+	var e encoder
+	flush := func() error {
+		_, err := bw.Write(e.buf.Bytes())
+		e.buf.Reset()
+		return err
+	}
+
+	e.buf.Write(snapshotMagic[:])
+	e.byte(SnapshotVersion)
+	e.string(bc.headers[0].Hash)
+	e.uint64(height)
+	for i := uint64(0); i <= height; i++ {
+		e.bytes(bc.headers[i].HeaderBytes())
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	addrs := make([]string, 0, len(balances))
+	for addr := range balances {
+		addrs = append(addrs, addr)
+	}
+	for addr := range nonces {
+		if _, ok := balances[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	e.uint64(uint64(len(addrs)))
+	for _, addr := range addrs {
+		e.string(addr)
+		e.uint64(balances[addr])
+		e.uint64(nonces[addr])
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return &SnapshotInfo{Height: height, Hash: bc.headers[height].Hash, Accounts: len(addrs)}, nil
+}
+
+// ImportSnapshot starts a new chain from a snapshot read from r. Every header
+// is checked as for a block received from a peer, except for its
+// transactions, and the account state must match the state root of the last
+// one. Blocks up to the snapshot are stored without transactions; the chain
+// then syncs forward from the snapshot as usual.
+func (bc *Blockchain) ImportSnapshot(r io.Reader) (*SnapshotInfo, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if len(bc.headers) != 1 {
+		return nil, errors.New("snapshots can only be imported into a new chain")
+	}
+
+	s := &streamReader{r: bufio.NewReader(r)}
+	var magic [8]byte
+	s.read(magic[:])
+	if s.err != nil || magic != snapshotMagic {
+		return nil, ErrNotSnapshot
+	}
+	if version := s.byte(); s.err == nil && version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: snapshot version %d", ErrUnknownEncodingVersion, version)
+	}
+	genesisHash := s.string()
+	height := s.uint64()
+	if s.err != nil {
+		return nil, fmt.Errorf("truncated snapshot header: %w", s.err)
+	}
+	if genesisHash != bc.headers[0].Hash {
+		return nil, fmt.Errorf("snapshot belongs to genesis %s, expected %s", genesisHash, bc.headers[0].Hash)
+	}
+	if height == 0 {
+		return nil, errors.New("snapshot must be above genesis")
+	}
+
+	now := bc.now().Unix()
+	headers := []Block{bc.headers[0]}
+	for i := uint64(0); i <= height; i++ {
+		data := s.bytes(maxEncodedString)
+		if s.err != nil {
+			return nil, fmt.Errorf("header %d: %w", i, s.err)
+		}
+		var header Block
+		if err := header.UnmarshalHeader(data); err != nil {
+			return nil, fmt.Errorf("header %d: %w", i, err)
+		}
+		if i == 0 {
+			if header.Hash != headers[0].Hash {
+				return nil, fmt.Errorf("header 0 is not the genesis block")
+			}
+			continue
+		}
+		if err := bc.validateHeader(headers, &header, now); err != nil {
+			return nil, fmt.Errorf("header %d: %w", i, err)
+		}
+		headers = append(headers, header)
+	}
+
+	balances := make(map[string]uint64)
+	nonces := make(map[string]uint64)
+	count := s.uint64()
+	prev := ""
+	for i := uint64(0); s.err == nil && i < count; i++ {
+		addr := s.string()
+		balance := s.uint64()
+		nonce := s.uint64()
+		if s.err != nil {
+			break
+		}
+		if i > 0 && addr <= prev {
+			return nil, fmt.Errorf("account %s is out of order", addr)
+		}
+		if balance == 0 && nonce == 0 {
+			return nil, fmt.Errorf("account %s is empty", addr)
+		}
+		prev = addr
+		if balance != 0 {
+			balances[addr] = balance
+		}
+		if nonce != 0 {
+			nonces[addr] = nonce
+		}
+	}
+	if s.err != nil {
+		return nil, fmt.Errorf("truncated snapshot accounts: %w", s.err)
+	}
+
+	last := headers[height]
+	if root := StateRoot(balances, nonces); root != last.StateRoot {
+		return nil, fmt.Errorf("state root mismatch: block %d commits to %s, snapshot has %s", height, last.StateRoot, root)
+	}
+
+	batch := &ChainBatch{
+		Blocks:   headers[1:],
+		Balances: stateDiff(bc.Balances, balances),
+		Nonces:   stateDiff(bc.Nonces, nonces),
+		Tip:      ChainTip{Height: height, Hash: last.Hash},
+		Snapshot: &StateSnapshot{Height: height, Hash: last.Hash, Balances: balances, Nonces: nonces},
+	}
+	if err := bc.store.Commit(batch); err != nil {
+		return nil, fmt.Errorf("failed to persist snapshot: %w", err)
+	}
+
+	// MemoryStorage keeps the snapshot maps, so the live state gets copies
+	liveBalances := make(map[string]uint64, len(balances))
+	for addr, v := range balances {
+		liveBalances[addr] = v
+	}
+	liveNonces := make(map[string]uint64, len(nonces))
+	for addr, v := range nonces {
+		liveNonces[addr] = v
+	}
+	bc.setState(liveBalances, liveNonces)
+	bc.headers = headers
+	bc.base = height
+	bc.buildIndex()
+
+	return &SnapshotInfo{Height: height, Hash: last.Hash, Accounts: int(count)}, nil
+}
+
+// streamReader reads the canonical encoding from a stream, remembering the
+// first error like decoder.
+type streamReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (s *streamReader) read(b []byte) {
+	if s.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+	}
+}
+
+func (s *streamReader) byte() byte {
+	var b [1]byte
+	s.read(b[:])
+	return b[0]
+}
+
+func (s *streamReader) uint64() uint64 {
+	var b [8]byte
+	s.read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// bytes reads a uint32 length followed by that many bytes, up to limit.
+func (s *streamReader) bytes(limit uint32) []byte {
+	var length [4]byte
+	s.read(length[:])
+	n := binary.BigEndian.Uint32(length[:])
+	if s.err == nil && n > limit {
+		s.err = fmt.Errorf("field of %d bytes exceeds limit", n)
+	}
+	if s.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	s.read(b)
+	return b
+}
+
+func (s *streamReader) string() string {
+	return string(s.bytes(maxEncodedString))
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// snapshotSource returns a chain with transfers, so the snapshot state has
+// nonces as well as balances.
+func snapshotSource(t *testing.T) *Blockchain {
+	t.Helper()
+	privKey, pubKey, sender := generateTestWallet()
+	bc, _ := NewBlockchain(NewMemoryStorage(), nil)
+	bc.MineBlock(sender, nil)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		tx := signedTx(bc, privKey, pubKey, sender, "receiver", OneFernet, nonce)
+		if _, err := bc.MineBlock("miner1", []Transaction{tx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bc
+}
+
+func TestSnapshotImport(t *testing.T) {
+	src := snapshotSource(t)
+	var buf bytes.Buffer
+	info, err := src.ExportSnapshot(&buf, 4)
+	if err != nil {
+		t.Fatalf("ExportSnapshot failed: %v", err)
+	}
+
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	dst, _ := NewBlockchain(store, nil)
+	imported, err := dst.ImportSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("ImportSnapshot failed: %v", err)
+	}
+	if *imported != *info {
+		t.Errorf("imported %+v, exported %+v", imported, info)
+	}
+	if dst.GetLatestBlock().Hash != src.GetLatestBlock().Hash {
+		t.Error("snapshot chain should have the source tip")
+	}
+	for addr, balance := range src.Balances {
+		if dst.GetBalance(addr) != balance || dst.GetNonce(addr) != src.GetNonce(addr) {
+			t.Errorf("account %s differs after import", addr)
+		}
+	}
+
+	// The chain syncs forward from the snapshot
+	src.MineBlock("miner2", nil)
+	next, _ := src.GetBlock(5)
+	if _, err := dst.AddBlock(next); err != nil {
+		t.Fatalf("AddBlock after snapshot failed: %v", err)
+	}
+	if err := dst.ValidateChain(); err != nil {
+		t.Errorf("chain started from a snapshot should validate: %v", err)
+	}
+
+	// The snapshot base survives a restart and still bounds rollbacks
+	reloaded, err := NewBlockchain(store, nil)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if reloaded.GetBalance("miner2") != src.GetBalance("miner2") {
+		t.Error("state should be loaded after restart")
+	}
+	if _, err := reloaded.RewindTo(2); err == nil {
+		t.Error("rewinding below the snapshot should fail")
+	}
+	if reloaded.Height() != 5 {
+		t.Errorf("rewind should stop at the snapshot, height is %d", reloaded.Height())
+	}
+	if err := reloaded.rebuildState(nil); err != nil || StateRoot(reloaded.Balances, reloaded.Nonces) != reloaded.GetLatestBlock().StateRoot {
+		t.Errorf("replay should start from the snapshot state: %v", err)
+	}
+}
+
+func TestSnapshotAtEarlierHeight(t *testing.T) {
+	src := snapshotSource(t)
+	var buf bytes.Buffer
+	if _, err := src.ExportSnapshot(&buf, 2); err != nil {
+		t.Fatalf("ExportSnapshot failed: %v", err)
+	}
+
+	dst, _ := NewBlockchain(NewMemoryStorage(), nil)
+	if _, err := dst.ImportSnapshot(&buf); err != nil {
+		t.Fatalf("ImportSnapshot failed: %v", err)
+	}
+	for height := uint64(3); height < src.Height(); height++ {
+		block, _ := src.GetBlock(height)
+		if _, err := dst.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock %d failed: %v", height, err)
+		}
+	}
+	if StateRoot(dst.Balances, dst.Nonces) != StateRoot(src.Balances, src.Nonces) {
+		t.Error("syncing forward from an earlier snapshot should reach the same state")
+	}
+}
+
+func TestSnapshotRejectsTampering(t *testing.T) {
+	src := snapshotSource(t)
+	var buf bytes.Buffer
+	src.ExportSnapshot(&buf, 4)
+	snapshot := buf.Bytes()
+
+	dst, _ := NewBlockchain(NewMemoryStorage(), nil)
+	if _, err := dst.ImportSnapshot(bytes.NewReader([]byte("not a snapshot"))); !errors.Is(err, ErrNotSnapshot) {
+		t.Errorf("expected ErrNotSnapshot, got %v", err)
+	}
+	if _, err := dst.ImportSnapshot(bytes.NewReader(snapshot[:len(snapshot)-4])); err == nil {
+		t.Error("truncated snapshot should be rejected")
+	}
+
+	// Raise the last account's nonce, which the state root covers
+	tampered := append([]byte(nil), snapshot...)
+	tampered[len(tampered)-1]++
+	if _, err := dst.ImportSnapshot(bytes.NewReader(tampered)); err == nil {
+		t.Error("snapshot with altered state should be rejected")
+	}
+	if dst.Height() != 1 || dst.GetBalance("miner1") != 0 {
+		t.Error("rejected snapshot should leave the chain untouched")
+	}
+
+	dst.MineBlock("miner3", nil)
+	if _, err := dst.ImportSnapshot(bytes.NewReader(snapshot)); err == nil {
+		t.Error("snapshot should only be imported into a new chain")
+	}
+}
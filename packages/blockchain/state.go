@@ -0,0 +1,381 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// stateView stages balance and nonce changes on top of committed state, so a
+// block can be checked transaction by transaction and then either committed
+// or discarded as a whole.
+type stateView struct {
+	baseBalances map[string]uint64
+	baseNonces   map[string]uint64
+	balances     map[string]uint64
+	nonces       map[string]uint64
+	tree         *stateTree // tree over the base state, nil to hash it in full
+}
+
+func newStateView(balances, nonces map[string]uint64) *stateView {
+	return &stateView{
+		baseBalances: balances,
+		baseNonces:   nonces,
+		balances:     make(map[string]uint64),
+		nonces:       make(map[string]uint64),
+	}
+}
+
+func (s *stateView) balance(addr string) uint64 {
+	if v, ok := s.balances[addr]; ok {
+		return v
+	}
+	return s.baseBalances[addr]
+}
+
+func (s *stateView) nonce(addr string) uint64 {
+	if v, ok := s.nonces[addr]; ok {
+		return v
+	}
+	return s.baseNonces[addr]
+}
+
+// credit adds amount to an account, refusing to wrap around.
+func (s *stateView) credit(addr string, amount uint64) error {
+	balance := s.balance(addr)
+	if balance > math.MaxUint64-amount {
+		return fmt.Errorf("balance overflow for %s", addr)
+	}
+	s.balances[addr] = balance + amount
+	return nil
+}
+
+// checkTx verifies a non-coinbase transaction can be applied to the view.
+func (s *stateView) checkTx(tx *Transaction) error {
+	if tx.Amount > math.MaxUint64-tx.Fee {
+		return errors.New("amount plus fee overflows")
+	}
+
+	// Check balance
+	balance := s.balance(tx.Sender)
+	if balance < tx.Amount+tx.Fee {
+		return fmt.Errorf("insufficient balance: has %d, needs %d", balance, tx.Amount+tx.Fee)
+	}
+
+	// Check nonce
+	expectedNonce := s.nonce(tx.Sender)
+	if tx.Nonce != expectedNonce {
+		return fmt.Errorf("invalid nonce: expected %d, got %d", expectedNonce, tx.Nonce)
+	}
+
+	return nil
+}
+
+// applyTx checks a transaction and applies it. The view is left untouched
+// if the transaction is rejected. Fees leave the sender here and are paid out
+// through the coinbase transaction.
+func (s *stateView) applyTx(tx *Transaction) error {
+	if tx.Sender == CoinbaseSender {
+		return s.credit(tx.Receiver, tx.Amount)
+	}
+
+	if err := s.checkTx(tx); err != nil {
+		return err
+	}
+	if s.balance(tx.Receiver) > math.MaxUint64-tx.Amount {
+		return fmt.Errorf("balance overflow for %s", tx.Receiver)
+	}
+
+	s.balances[tx.Sender] = s.balance(tx.Sender) - (tx.Amount + tx.Fee)
+	s.balances[tx.Receiver] = s.balance(tx.Receiver) + tx.Amount
+	s.nonces[tx.Sender] = tx.Nonce + 1
+	return nil
+}
+
+// applyBlock checks every transaction of a block against the view and applies
+// them in order. The genesis block holds only allocations, which are applied
+// like coinbase transactions and are not subject to the block size limit.
+func (s *stateView) applyBlock(block *Block) error {
+	if block.Index == 0 {
+		return s.applyGenesis(block)
+	}
+	if len(block.Transactions)-1 > MaxTxPerBlock {
+		return fmt.Errorf("too many transactions: %d exceeds limit of %d", len(block.Transactions)-1, MaxTxPerBlock)
+	}
+
+	seen := make(map[string]bool, len(block.Transactions))
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if seen[tx.ID] {
+			return fmt.Errorf("tx %d: duplicate transaction %s", i, tx.ID)
+		}
+		seen[tx.ID] = true
+
+		if i > 0 && tx.Sender == CoinbaseSender {
+			return fmt.Errorf("tx %d: unexpected coinbase transaction", i)
+		}
+		if err := s.applyTx(tx); err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+	}
+	return s.checkStateRoot(block)
+}
+
+func (s *stateView) applyGenesis(block *Block) error {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if tx.Sender != CoinbaseSender {
+			return fmt.Errorf("tx %d: genesis transactions must be allocations", i)
+		}
+		if err := s.applyTx(tx); err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+	}
+	return s.checkStateRoot(block)
+}
+
+// checkStateRoot verifies the block commits to the state of the view.
+func (s *stateView) checkStateRoot(block *Block) error {
+	if root := s.stateRoot(); root != block.StateRoot {
+		return fmt.Errorf("state root mismatch: expected %s, got %s", root, block.StateRoot)
+	}
+	return nil
+}
+
+// accounts returns the full state of the view, without zero entries.
+func (s *stateView) accounts() (balances, nonces map[string]uint64) {
+	merge := func(base, staged map[string]uint64) map[string]uint64 {
+		result := make(map[string]uint64, len(base))
+		for addr, v := range base {
+			if _, ok := staged[addr]; !ok {
+				result[addr] = v
+			}
+		}
+		for addr, v := range staged {
+			if v != 0 {
+				result[addr] = v
+			}
+		}
+		return result
+	}
+	return merge(s.baseBalances, s.balances), merge(s.baseNonces, s.nonces)
+}
+
+func (s *stateView) stateRoot() string {
+	if s.tree == nil {
+		return StateRoot(s.accounts())
+	}
+	return s.tree.update(s.touched(), s).root()
+}
+
+// touched returns the accounts with staged changes, sorted by address.
+func (s *stateView) touched() []string {
+	addrs := make([]string, 0, len(s.balances)+len(s.nonces))
+	for addr := range s.balances {
+		addrs = append(addrs, addr)
+	}
+	for addr := range s.nonces {
+		if _, ok := s.balances[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// StateRoot commits to every account's balance and nonce. It is the Merkle
+// root over one leaf per account, ordered by address, where a leaf is the
+// hash of the address, balance and nonce. Accounts whose balance and nonce
+// are both zero are left out, so the root does not depend on how state was
+// reached.
+func StateRoot(balances, nonces map[string]uint64) string {
+	return newStateTree(balances, nonces).root()
+}
+
+// stateTree is the Merkle tree behind the state root, kept for the committed
+// state so a view rehashes only the accounts it touched and the nodes above
+// them. Adding or removing an account shifts the leaves after it, whose
+// parents are rehashed as well.
+type stateTree struct {
+	addrs  []string   // account of each leaf, sorted
+	levels [][][]byte // leaves first, as built by merkleTree
+}
+
+func newStateTree(balances, nonces map[string]uint64) *stateTree {
+	present := make(map[string]bool, len(balances))
+	for _, values := range []map[string]uint64{balances, nonces} {
+		for addr, v := range values {
+			if v != 0 {
+				present[addr] = true
+			}
+		}
+	}
+	addrs := make([]string, 0, len(present))
+	for addr := range present {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	leaves := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		leaves[i] = merkleLeaf(accountHash(addr, balances[addr], nonces[addr]))
+	}
+	return &stateTree{addrs: addrs, levels: merkleTree(leaves)}
+}
+
+func (t *stateTree) root() string {
+	if len(t.addrs) == 0 {
+		return EmptyMerkleRoot
+	}
+	return hex.EncodeToString(t.levels[len(t.levels)-1][0])
+}
+
+// update returns the tree once the accounts in touched, sorted by address,
+// take their state in s. Accounts left with a zero balance and nonce are
+// removed. Nodes that did not change are shared with t, which is not
+// modified.
+func (t *stateTree) update(touched []string, s *stateView) *stateTree {
+	old := t.levels[0]
+	next := &stateTree{addrs: make([]string, 0, len(t.addrs)+len(touched))}
+	leaves := make([][]byte, 0, len(old)+len(touched))
+
+	// Leaves before shift are at the same position as in t; of those, only
+	// the ones in dirty changed
+	shift := -1
+	var dirty []int
+	i := 0
+	for _, addr := range touched {
+		j := i + sort.SearchStrings(t.addrs[i:], addr)
+		next.addrs = append(next.addrs, t.addrs[i:j]...)
+		leaves = append(leaves, old[i:j]...)
+		i = j
+
+		found := i < len(t.addrs) && t.addrs[i] == addr
+		if found {
+			i++
+		}
+		balance, nonce := s.balance(addr), s.nonce(addr)
+		present := balance != 0 || nonce != 0
+		if found != present && shift < 0 {
+			shift = len(leaves)
+		}
+		if present {
+			if found {
+				dirty = append(dirty, len(leaves))
+			}
+			next.addrs = append(next.addrs, addr)
+			leaves = append(leaves, merkleLeaf(accountHash(addr, balance, nonce)))
+		}
+	}
+	next.addrs = append(next.addrs, t.addrs[i:]...)
+	leaves = append(leaves, old[i:]...)
+	if shift < 0 {
+		shift = len(leaves)
+	}
+
+	next.levels = [][][]byte{leaves}
+	for level, l := leaves, 1; len(level) > 1; l++ {
+		var prev [][]byte
+		if l < len(t.levels) {
+			prev = t.levels[l]
+		}
+		shift = min(shift/2, len(prev))
+
+		parents := make([][]byte, (len(level)+1)/2)
+		copy(parents, prev[:shift])
+		var up []int
+		for _, d := range dirty {
+			if k := d / 2; k < shift && (len(up) == 0 || up[len(up)-1] != k) {
+				parents[k] = merkleParent(level, k)
+				up = append(up, k)
+			}
+		}
+		for k := shift; k < len(parents); k++ {
+			parents[k] = merkleParent(level, k)
+		}
+
+		next.levels = append(next.levels, parents)
+		level, dirty = parents, up
+	}
+	return next
+}
+
+func accountHash(addr string, balance, nonce uint64) string {
+	var e encoder
+	e.string(addr)
+	e.uint64(balance)
+	e.uint64(nonce)
+	hash := sha256.Sum256(e.buf.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// undoRecord captures the current balance and nonce of every account block
+// touches, to be saved before the block is applied.
+func (s *stateView) undoRecord(block *Block) BlockUndo {
+	undo := BlockUndo{
+		Balances: make(map[string]uint64),
+		Nonces:   make(map[string]uint64),
+	}
+	for _, tx := range block.Transactions {
+		for _, addr := range []string{tx.Sender, tx.Receiver} {
+			if addr == CoinbaseSender {
+				continue
+			}
+			undo.Balances[addr] = s.balance(addr)
+			undo.Nonces[addr] = s.nonce(addr)
+		}
+	}
+	return undo
+}
+
+// revert restores the accounts saved in an undo record.
+func (s *stateView) revert(undo *BlockUndo) {
+	for addr, v := range undo.Balances {
+		s.balances[addr] = v
+	}
+	for addr, v := range undo.Nonces {
+		s.nonces[addr] = v
+	}
+}
+
+// undoBlock reverses the effects of an applied block by replaying its
+// transactions backwards. It is used for blocks stored without an undo record.
+func (s *stateView) undoBlock(block *Block) {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if tx.Sender == CoinbaseSender {
+			s.balances[tx.Receiver] = s.balance(tx.Receiver) - tx.Amount
+			continue
+		}
+		s.balances[tx.Receiver] = s.balance(tx.Receiver) - tx.Amount
+		s.balances[tx.Sender] = s.balance(tx.Sender) + tx.Amount + tx.Fee
+		s.nonces[tx.Sender] = tx.Nonce
+	}
+}
+
+// commit writes the staged changes into the underlying state and its tree.
+// Zero entries are dropped so the result matches state replayed from genesis.
+func (s *stateView) commit() {
+	if s.tree != nil {
+		*s.tree = *s.tree.update(s.touched(), s)
+	}
+	for addr, v := range s.balances {
+		if v == 0 {
+			delete(s.baseBalances, addr)
+		} else {
+			s.baseBalances[addr] = v
+		}
+	}
+	for addr, v := range s.nonces {
+		if v == 0 {
+			delete(s.baseNonces, addr)
+		} else {
+			s.baseNonces[addr] = v
+		}
+	}
+	s.balances = make(map[string]uint64)
+	s.nonces = make(map[string]uint64)
+}
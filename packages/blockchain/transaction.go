@@ -11,9 +11,10 @@ import (
 	"time"
 )
 
-// NewTransaction creates a new unsigned transaction.
-func NewTransaction(sender, receiver string, amount, fee, nonce uint64, pubKey string) *Transaction {
+// NewTransaction creates a new unsigned transaction for the given chain.
+func NewTransaction(chainID, sender, receiver string, amount, fee, nonce uint64, pubKey string) *Transaction {
 	tx := &Transaction{
+		ChainID:   chainID,
 		Sender:    sender,
 		Receiver:  receiver,
 		Amount:    amount,
@@ -42,26 +43,31 @@ func NewCoinbaseTx(receiver string, reward uint64) *Transaction {
 	return tx
 }
 
-// CalculateHash computes the SHA-256 hash of the transaction's core data.
+// CalculateHash computes the SHA-256 hash of the transaction's signable
+// encoding. The chain ID is part of it so a signature is only valid on one
+// network.
 func (t *Transaction) CalculateHash() string {
-	data := fmt.Sprintf("%s:%s:%d:%d:%d:%d", t.Sender, t.Receiver, t.Amount, t.Fee, t.Nonce, t.Timestamp)
-	hash := sha256.Sum256([]byte(data))
+	hash := sha256.Sum256(t.SignableBytes())
 	return hex.EncodeToString(hash[:])
 }
 
 // SignableData returns the SHA-256 hash bytes used for signing.
 func (t *Transaction) SignableData() []byte {
-	data := fmt.Sprintf("%s:%s:%d:%d:%d:%d", t.Sender, t.Receiver, t.Amount, t.Fee, t.Nonce, t.Timestamp)
-	hash := sha256.Sum256([]byte(data))
+	hash := sha256.Sum256(t.SignableBytes())
 	return hash[:]
 }
 
-// VerifySignature verifies the transaction's ECDSA signature.
-func (t *Transaction) VerifySignature() error {
+// VerifySignature verifies the transaction's ECDSA signature and that it was
+// signed for chainID.
+func (t *Transaction) VerifySignature(chainID string) error {
 	if t.Sender == CoinbaseSender {
 		return nil
 	}
 
+	if t.ChainID != chainID {
+		return fmt.Errorf("transaction is for chain %q, expected %q", t.ChainID, chainID)
+	}
+
 	if t.PubKey == "" || t.Signature == "" {
 		return errors.New("missing public key or signature")
 	}
@@ -99,8 +105,8 @@ func (t *Transaction) VerifySignature() error {
 	return nil
 }
 
-// IsValid checks all transaction validity rules.
-func (t *Transaction) IsValid() error {
+// IsValid checks all transaction validity rules for the given chain.
+func (t *Transaction) IsValid(chainID string) error {
 	if t.Sender == "" {
 		return errors.New("sender is empty")
 	}
@@ -110,7 +116,7 @@ func (t *Transaction) IsValid() error {
 	if t.Sender == t.Receiver && t.Sender != CoinbaseSender {
 		return errors.New("sender and receiver are the same")
 	}
-	if t.Amount == 0 {
+	if t.Amount == 0 && t.Sender != CoinbaseSender {
 		return errors.New("amount is zero")
 	}
 
@@ -119,7 +125,7 @@ func (t *Transaction) IsValid() error {
 		return errors.New("transaction hash mismatch")
 	}
 
-	if err := t.VerifySignature(); err != nil {
+	if err := t.VerifySignature(chainID); err != nil {
 		return fmt.Errorf("signature error: %w", err)
 	}
 
@@ -42,20 +42,22 @@ func signTx(privKey *ecdsa.PrivateKey, tx *Transaction) {
 	tx.Signature = hex.EncodeToString(sig)
 }
 
+const testChainID = "fernet-test"
+
 func TestSignAndVerifyTransaction(t *testing.T) {
 	privKey, pubKeyHex, senderAddr := generateTestWallet()
 	_, _, receiverAddr := generateTestWallet()
 
-	tx := NewTransaction(senderAddr, receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
+	tx := NewTransaction(testChainID, senderAddr, receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
 	signTx(privKey, tx)
 	// Recalculate ID after all fields are set
 	tx.ID = tx.CalculateHash()
 
-	if err := tx.VerifySignature(); err != nil {
+	if err := tx.VerifySignature(testChainID); err != nil {
 		t.Fatalf("signature verification failed: %v", err)
 	}
 
-	if err := tx.IsValid(); err != nil {
+	if err := tx.IsValid(testChainID); err != nil {
 		t.Fatalf("transaction should be valid: %v", err)
 	}
 }
@@ -67,7 +69,7 @@ func TestCoinbaseTransaction(t *testing.T) {
 		t.Errorf("coinbase sender should be %s, got %s", CoinbaseSender, tx.Sender)
 	}
 
-	if err := tx.VerifySignature(); err != nil {
+	if err := tx.VerifySignature(testChainID); err != nil {
 		t.Errorf("coinbase should pass signature check: %v", err)
 	}
 }
@@ -76,12 +78,12 @@ func TestInvalidSignature(t *testing.T) {
 	_, pubKeyHex, senderAddr := generateTestWallet()
 	_, _, receiverAddr := generateTestWallet()
 
-	tx := NewTransaction(senderAddr, receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
+	tx := NewTransaction(testChainID, senderAddr, receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
 	tx.Signature = "0000000000000000000000000000000000000000000000000000000000000000" +
 		"0000000000000000000000000000000000000000000000000000000000000000"
 	tx.ID = tx.CalculateHash()
 
-	if err := tx.VerifySignature(); err == nil {
+	if err := tx.VerifySignature(testChainID); err == nil {
 		t.Error("invalid signature should fail verification")
 	}
 }
@@ -91,17 +93,36 @@ func TestWrongSenderAddress(t *testing.T) {
 	_, _, receiverAddr := generateTestWallet()
 
 	// Use wrong sender address
-	tx := NewTransaction("wrongaddress1234567890", receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
+	tx := NewTransaction(testChainID, "wrongaddress1234567890", receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
 	signTx(privKey, tx)
 	tx.ID = tx.CalculateHash()
 
-	if err := tx.VerifySignature(); err == nil {
+	if err := tx.VerifySignature(testChainID); err == nil {
 		t.Error("wrong sender should fail verification")
 	}
 }
 
+func TestWrongChainID(t *testing.T) {
+	privKey, pubKeyHex, senderAddr := generateTestWallet()
+	_, _, receiverAddr := generateTestWallet()
+
+	tx := NewTransaction(testChainID, senderAddr, receiverAddr, 100*OneFernet, OneFernet, 0, pubKeyHex)
+	signTx(privKey, tx)
+
+	if err := tx.VerifySignature("fernet-other"); err == nil {
+		t.Error("transaction signed for another chain should fail verification")
+	}
+
+	// Rewriting the chain ID invalidates the signature.
+	tx.ChainID = "fernet-other"
+	tx.ID = tx.CalculateHash()
+	if err := tx.VerifySignature("fernet-other"); err == nil {
+		t.Error("signature should cover the chain ID")
+	}
+}
+
 func TestTransactionHash(t *testing.T) {
-	tx := NewTransaction("sender", "receiver", 100, 1, 0, "pubkey")
+	tx := NewTransaction(testChainID, "sender", "receiver", 100, 1, 0, "pubkey")
 	hash := tx.CalculateHash()
 
 	if hash != tx.ID {
@@ -110,6 +131,7 @@ func TestTransactionHash(t *testing.T) {
 
 	// Same params should produce same hash
 	tx2 := &Transaction{
+		ChainID:   tx.ChainID,
 		Sender:    tx.Sender,
 		Receiver:  tx.Receiver,
 		Amount:    tx.Amount,
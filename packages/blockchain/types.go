@@ -5,11 +5,25 @@ const (
 	Fernetoshi     uint64 = 1
 	OneFernet      uint64 = 100_000_000
 	TotalSupply    uint64 = 21_000_000 * OneFernet
-	MiningReward   uint64 = 50 * OneFernet
+	MiningReward   uint64 = 50 * OneFernet // initial block reward
 	MaxTxPerBlock  int    = 100
-	TargetPrefix          = "0000"
 	CoinbaseSender        = "0000000000000000000000000000000000000000"
 
+	// Difficulty retargeting: every RetargetInterval blocks the target is
+	// adjusted so blocks arrive roughly every TargetBlockTime seconds.
+	RetargetInterval  uint64 = 10
+	TargetBlockTime   int64  = 30
+	MaxRetargetFactor int64  = 4
+
+	// A block's timestamp must be later than the median of the previous
+	// MedianTimeSpan blocks and at most MaxFutureDrift seconds ahead of the
+	// validating node's clock.
+	MedianTimeSpan       = 11
+	MaxFutureDrift int64 = 10 * 60
+
+	// The block reward halves every HalvingInterval blocks.
+	HalvingInterval uint64 = 210_000
+
 	// Fixed genesis timestamp for deterministic genesis block
 	GenesisTimestamp int64 = 1700000000
 )
@@ -20,18 +34,10 @@ type Block struct {
 	Timestamp    int64         `json:"timestamp"`
 	Transactions []Transaction `json:"transactions"`
 	PrevHash     string        `json:"prevHash"`
+	MerkleRoot   string        `json:"merkleRoot"`
+	StateRoot    string        `json:"stateRoot"` // commitment to every account after the block
 	Hash         string        `json:"hash"`
-	Nonce        uint64        `json:"nonce"`
-	Miner        string        `json:"miner"`
-}
-
-// BlockHashData is the same as Block but without the Hash field,
-// used to avoid circular hash calculation.
-type BlockHashData struct {
-	Index        uint64        `json:"index"`
-	Timestamp    int64         `json:"timestamp"`
-	Transactions []Transaction `json:"transactions"`
-	PrevHash     string        `json:"prevHash"`
+	Target       string        `json:"target"`
 	Nonce        uint64        `json:"nonce"`
 	Miner        string        `json:"miner"`
 }
@@ -39,6 +45,7 @@ type BlockHashData struct {
 // Transaction represents a transfer of fernetoshi between addresses.
 type Transaction struct {
 	ID        string `json:"id"`
+	ChainID   string `json:"chainId"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Amount    uint64 `json:"amount"`
@@ -49,13 +56,58 @@ type Transaction struct {
 	Signature string `json:"signature"`
 }
 
+// ChainBatch holds every change of one main chain update. Storage writes it
+// in a single transaction so blocks, state and tip never disagree on disk.
+type ChainBatch struct {
+	Blocks       []Block           // blocks that joined the main chain
+	Disconnected []Block           // blocks that left the main chain
+	Undo         []BlockUndo       // undo records of Blocks, in the same order
+	Balances     map[string]uint64 // new balances of touched accounts, zero removes
+	Nonces       map[string]uint64 // new nonces of touched accounts, zero removes
+	Tip          ChainTip          // stored blocks above Tip.Height are removed
+	Snapshot     *StateSnapshot    // set when the chain is started from a snapshot
+}
+
+// StateSnapshot is the full account state at a main chain block. A chain
+// started from a snapshot stores only headers up to that block.
+type StateSnapshot struct {
+	Height   uint64            `json:"height"`
+	Hash     string            `json:"hash"`
+	Balances map[string]uint64 `json:"balances"`
+	Nonces   map[string]uint64 `json:"nonces"`
+}
+
+// TxLocation is the position of a transaction on the main chain.
+type TxLocation struct {
+	Height   uint64
+	Position uint32
+}
+
+// BlockUndo holds the balance and nonce of every account a block touched, as
+// they were before the block was applied. Zero means the account had no entry.
+type BlockUndo struct {
+	Balances map[string]uint64 `json:"balances"`
+	Nonces   map[string]uint64 `json:"nonces"`
+}
+
+// ChainTip identifies the last block of the main chain.
+type ChainTip struct {
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+}
+
 // Storage is the persistence interface for the blockchain.
 type Storage interface {
-	SaveBlock(block Block) error
-	LoadChain() ([]Block, error)
-	SaveBalances(balances map[string]uint64) error
+	Commit(batch *ChainBatch) error
+	GetBlock(height uint64) (block Block, ok bool, err error)
+	GetBlockByHash(hash string) (block Block, ok bool, err error)
+	IterateBlocks(from, to uint64, fn func(*Block) error) error
 	LoadBalances() (map[string]uint64, error)
-	SaveNonces(nonces map[string]uint64) error
 	LoadNonces() (map[string]uint64, error)
+	LoadTip() (tip ChainTip, ok bool, err error)
+	LoadUndo(height uint64) (undo BlockUndo, ok bool, err error)
+	LoadSnapshot() (snapshot StateSnapshot, ok bool, err error)
+	FindTransaction(txID string) (loc TxLocation, ok bool, err error)
+	AddressTransactions(address string) ([]TxLocation, error)
 	Close() error
 }
@@ -0,0 +1,157 @@
+package faucet
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/node"
+	"github.com/nawesan12/fernet-token/packages/wallet"
+)
+
+type Config struct {
+	Amount          uint64
+	Fee             uint64
+	AddressCooldown time.Duration
+	IPCooldown      time.Duration
+}
+
+// DefaultConfig hands out 100 FERNET per address a day and lets each IP ask
+// once an hour.
+func DefaultConfig() Config {
+	return Config{
+		Amount:          100 * blockchain.OneFernet,
+		AddressCooldown: 24 * time.Hour,
+		IPCooldown:      time.Hour,
+	}
+}
+
+// CooldownError is returned when an address or IP asks again too soon.
+type CooldownError struct {
+	Subject   string
+	Remaining time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("%s must wait %s before requesting again", e.Subject, e.Remaining.Round(time.Second))
+}
+
+// Faucet pays out test funds as ordinary signed transfers from a funded
+// account, typically one allocated in the genesis file.
+type Faucet struct {
+	node       *node.Node
+	wallet     *wallet.Wallet
+	config     Config
+	lastByAddr map[string]time.Time
+	lastByIP   map[string]time.Time
+	now        func() time.Time
+	mu         sync.Mutex
+}
+
+func New(n *node.Node, w *wallet.Wallet, cfg Config) *Faucet {
+	return &Faucet{
+		node:       n,
+		wallet:     w,
+		config:     cfg,
+		lastByAddr: make(map[string]time.Time),
+		lastByIP:   make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Request sends the faucet amount to address and returns the submitted
+// transaction. The transfer is pending until it is mined.
+func (f *Faucet) Request(address, ip string) (*blockchain.Transaction, error) {
+	if address == "" {
+		return nil, errors.New("address required")
+	}
+	if address == f.wallet.Address {
+		return nil, errors.New("cannot send to the faucet address")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.prune(now)
+	if last, ok := f.lastByAddr[address]; ok {
+		return nil, &CooldownError{Subject: "address", Remaining: last.Add(f.config.AddressCooldown).Sub(now)}
+	}
+	if last, ok := f.lastByIP[ip]; ok && ip != "" {
+		return nil, &CooldownError{Subject: "IP", Remaining: last.Add(f.config.IPCooldown).Sub(now)}
+	}
+
+	bc := f.node.Blockchain
+	tx := blockchain.NewTransaction(bc.ChainID(), f.wallet.Address, address, f.config.Amount, f.config.Fee, f.nextNonce(), f.wallet.PublicKey)
+	sig, err := f.wallet.Sign(tx.SignableData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign faucet transaction: %w", err)
+	}
+	tx.Signature = sig
+
+	if err := f.node.SubmitTransaction(tx); err != nil {
+		return nil, err
+	}
+
+	f.lastByAddr[address] = now
+	if ip != "" {
+		f.lastByIP[ip] = now
+	}
+	log.Printf("Faucet sent %d to %s in tx %s", f.config.Amount, address, tx.ID)
+	return tx, nil
+}
+
+// nextNonce returns the nonce after the faucet's pending transactions that
+// follow on from its confirmed nonce. Pending transactions already confirmed
+// or behind a gap are skipped, so a stale one cannot hold up later payouts.
+func (f *Faucet) nextNonce() uint64 {
+	pending := make(map[uint64]bool)
+	for _, tx := range f.node.Mempool.FromSender(f.wallet.Address) {
+		pending[tx.Nonce] = true
+	}
+	nonce := f.node.Blockchain.GetNonce(f.wallet.Address)
+	for pending[nonce] {
+		nonce++
+	}
+	return nonce
+}
+
+// prune forgets requests whose cooldown has passed.
+func (f *Faucet) prune(now time.Time) {
+	for addr, last := range f.lastByAddr {
+		if now.Sub(last) >= f.config.AddressCooldown {
+			delete(f.lastByAddr, addr)
+		}
+	}
+	for ip, last := range f.lastByIP {
+		if now.Sub(last) >= f.config.IPCooldown {
+			delete(f.lastByIP, ip)
+		}
+	}
+}
+
+// Status describes the faucet account and its limits.
+type Status struct {
+	Address         string `json:"address"`
+	Balance         uint64 `json:"balance"`
+	Amount          uint64 `json:"amount"`
+	Fee             uint64 `json:"fee"`
+	Pending         int    `json:"pending"`
+	AddressCooldown int64  `json:"addressCooldown"` // seconds
+	IPCooldown      int64  `json:"ipCooldown"`      // seconds
+}
+
+func (f *Faucet) Status() Status {
+	return Status{
+		Address:         f.wallet.Address,
+		Balance:         f.node.Blockchain.GetBalance(f.wallet.Address),
+		Amount:          f.config.Amount,
+		Fee:             f.config.Fee,
+		Pending:         len(f.node.Mempool.FromSender(f.wallet.Address)),
+		AddressCooldown: int64(f.config.AddressCooldown / time.Second),
+		IPCooldown:      int64(f.config.IPCooldown / time.Second),
+	}
+}
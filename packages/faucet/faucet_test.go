@@ -0,0 +1,106 @@
+package faucet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/node"
+	"github.com/nawesan12/fernet-token/packages/wallet"
+)
+
+func newTestFaucet(t *testing.T) (*Faucet, *node.Node) {
+	t.Helper()
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := blockchain.DefaultGenesis()
+	genesis.Alloc = map[string]uint64{w.Address: 1000 * blockchain.OneFernet}
+
+	n, err := node.NewNodeWithStorage(blockchain.NewMemoryStorage(), "0", genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(n, w, DefaultConfig()), n
+}
+
+func TestFaucetPaysOnChain(t *testing.T) {
+	f, n := newTestFaucet(t)
+
+	if _, err := f.Request("alice", "10.0.0.1"); err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+	if _, err := f.Request("bob", "10.0.0.2"); err != nil {
+		t.Fatalf("second request before mining failed: %v", err)
+	}
+	if n.Mempool.Count() != 2 {
+		t.Fatalf("expected 2 pending transactions, got %d", n.Mempool.Count())
+	}
+
+	if _, err := n.Mine("miner1"); err != nil {
+		t.Fatal(err)
+	}
+	amount := DefaultConfig().Amount
+	if n.Blockchain.GetBalance("alice") != amount || n.Blockchain.GetBalance("bob") != amount {
+		t.Errorf("faucet transfers should be mined: alice=%d bob=%d",
+			n.Blockchain.GetBalance("alice"), n.Blockchain.GetBalance("bob"))
+	}
+	if status := f.Status(); status.Balance != 1000*blockchain.OneFernet-2*amount || status.Pending != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestFaucetSkipsStalePending(t *testing.T) {
+	f, n := newTestFaucet(t)
+
+	// A pending transaction that leaves a nonce gap and can never be mined
+	n.Mempool.Add(&blockchain.Transaction{ID: "stale", Sender: f.wallet.Address, Receiver: "carol", Nonce: 5})
+
+	tx, err := f.Request("alice", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Nonce != 0 {
+		t.Errorf("expected nonce 0, got %d", tx.Nonce)
+	}
+	if tx, err = f.Request("bob", "10.0.0.2"); err != nil || tx.Nonce != 1 {
+		t.Fatalf("expected nonce 1, got %+v, %v", tx, err)
+	}
+
+	if _, err := n.Mine("miner1"); err != nil {
+		t.Fatal(err)
+	}
+	if n.Blockchain.GetBalance("alice") == 0 || n.Blockchain.GetBalance("bob") == 0 {
+		t.Error("payouts should be mined despite the stale transaction")
+	}
+}
+
+func TestFaucetCooldowns(t *testing.T) {
+	f, _ := newTestFaucet(t)
+	now := time.Unix(1_700_000_000, 0)
+	f.now = func() time.Time { return now }
+
+	if _, err := f.Request("alice", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var cooldown *CooldownError
+	if _, err := f.Request("alice", "10.0.0.2"); !errors.As(err, &cooldown) || cooldown.Subject != "address" {
+		t.Errorf("expected address cooldown, got %v", err)
+	}
+	if _, err := f.Request("bob", "10.0.0.1"); !errors.As(err, &cooldown) || cooldown.Subject != "IP" {
+		t.Errorf("expected IP cooldown, got %v", err)
+	}
+
+	now = now.Add(DefaultConfig().IPCooldown)
+	if _, err := f.Request("bob", "10.0.0.1"); err != nil {
+		t.Errorf("IP cooldown should have expired: %v", err)
+	}
+
+	now = now.Add(DefaultConfig().AddressCooldown)
+	if _, err := f.Request("alice", "10.0.0.3"); err != nil {
+		t.Errorf("address cooldown should have expired: %v", err)
+	}
+}
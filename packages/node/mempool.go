@@ -25,6 +25,14 @@ func (m *Mempool) Add(tx *blockchain.Transaction) {
 	m.txns[tx.ID] = tx
 }
 
+// Get returns the pending transaction with the given ID.
+func (m *Mempool) Get(id string) (*blockchain.Transaction, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tx, ok := m.txns[id]
+	return tx, ok
+}
+
 // GetPending returns up to limit pending transactions.
 func (m *Mempool) GetPending(limit int) []blockchain.Transaction {
 	m.mu.RLock()
@@ -49,6 +57,20 @@ func (m *Mempool) RemoveConfirmed(txns []blockchain.Transaction) {
 	}
 }
 
+// FromSender returns the pending transactions sent by address.
+func (m *Mempool) FromSender(address string) []blockchain.Transaction {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []blockchain.Transaction
+	for _, tx := range m.txns {
+		if tx.Sender == address {
+			result = append(result, *tx)
+		}
+	}
+	return result
+}
+
 // Count returns the number of pending transactions.
 func (m *Mempool) Count() int {
 	m.mu.RLock()
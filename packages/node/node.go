@@ -1,6 +1,7 @@
 package node
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
@@ -11,12 +12,19 @@ import (
 type Config struct {
 	DataDir string
 	P2PPort string
+	Genesis *blockchain.Genesis // nil selects the default genesis
+
+	// MaxInbound and MaxOutbound limit P2P connections; zero selects the
+	// p2p defaults.
+	MaxInbound  int
+	MaxOutbound int
 }
 
 type Node struct {
 	Blockchain *blockchain.Blockchain
 	Mempool    *Mempool
 	P2P        *p2p.P2PServer
+	sync       *syncManager
 	store      blockchain.Storage
 	config     Config
 }
@@ -27,7 +35,7 @@ func NewNode(cfg Config) (*Node, error) {
 		return nil, fmt.Errorf("failed to create storage: %w", err)
 	}
 
-	bc, err := blockchain.NewBlockchain(store)
+	bc, err := blockchain.NewBlockchain(store, cfg.Genesis)
 	if err != nil {
 		store.Close()
 		return nil, fmt.Errorf("failed to create blockchain: %w", err)
@@ -40,14 +48,30 @@ func NewNode(cfg Config) (*Node, error) {
 		config:     cfg,
 	}
 
-	n.P2P = p2p.NewP2PServer(cfg.P2PPort, n.handleP2PMessage)
+	book, err := p2p.LoadPeerBook(cfg.DataDir + "/peers.json")
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load peer book: %w", err)
+	}
+
+	n.P2P = p2p.NewP2PServer(cfg.P2PPort, bc, n.handleP2PMessage)
+	n.P2P.SetPeerBook(book)
+	limits := p2p.DefaultLimits()
+	if cfg.MaxInbound > 0 {
+		limits.MaxInbound = cfg.MaxInbound
+	}
+	if cfg.MaxOutbound > 0 {
+		limits.MaxOutbound = cfg.MaxOutbound
+	}
+	n.P2P.SetLimits(limits)
+	n.sync = newSyncManager(n)
 
 	return n, nil
 }
 
 // NewNodeWithStorage creates a node with a custom storage (for testing).
-func NewNodeWithStorage(store blockchain.Storage, p2pPort string) (*Node, error) {
-	bc, err := blockchain.NewBlockchain(store)
+func NewNodeWithStorage(store blockchain.Storage, p2pPort string, genesis *blockchain.Genesis) (*Node, error) {
+	bc, err := blockchain.NewBlockchain(store, genesis)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create blockchain: %w", err)
 	}
@@ -58,19 +82,23 @@ func NewNodeWithStorage(store blockchain.Storage, p2pPort string) (*Node, error)
 		store:      store,
 	}
 
-	n.P2P = p2p.NewP2PServer(p2pPort, n.handleP2PMessage)
+	n.P2P = p2p.NewP2PServer(p2pPort, bc, n.handleP2PMessage)
+	n.sync = newSyncManager(n)
 
 	return n, nil
 }
 
-// StartP2P starts the P2P server.
+// StartP2P starts the P2P server and block synchronization.
 func (n *Node) StartP2P() {
 	go n.P2P.Start()
+	n.sync.start()
 }
 
 // SubmitTransaction validates a transaction, adds it to the mempool, and broadcasts it.
+// The sender's transactions already in the mempool are taken into account, so
+// several can be submitted before the next block.
 func (n *Node) SubmitTransaction(tx *blockchain.Transaction) error {
-	if err := n.Blockchain.ValidateTransaction(tx); err != nil {
+	if err := n.validatePending(tx); err != nil {
 		return fmt.Errorf("transaction validation failed: %w", err)
 	}
 
@@ -80,6 +108,10 @@ func (n *Node) SubmitTransaction(tx *blockchain.Transaction) error {
 	return nil
 }
 
+func (n *Node) validatePending(tx *blockchain.Transaction) error {
+	return n.Blockchain.ValidatePendingTransaction(tx, n.Mempool.FromSender(tx.Sender))
+}
+
 // Mine pulls transactions from the mempool, mines a block, and broadcasts it.
 func (n *Node) Mine(miner string) (*blockchain.Block, error) {
 	pending := n.Mempool.GetPending(blockchain.MaxTxPerBlock)
@@ -102,39 +134,63 @@ func (n *Node) handleP2PMessage(msg p2p.Message) {
 	switch msg.Type {
 	case p2p.MsgTransaction:
 		if msg.Transaction != nil {
-			if err := n.Blockchain.ValidateTransaction(msg.Transaction); err != nil {
+			if err := n.validatePending(msg.Transaction); err != nil {
 				log.Printf("Received invalid transaction: %v", err)
 				return
 			}
 			n.Mempool.Add(msg.Transaction)
+			n.P2P.BroadcastTransaction(msg.Transaction)
 			log.Printf("Received transaction %s from peer", msg.Transaction.ID)
 		}
 
 	case p2p.MsgBlock:
 		if msg.Block != nil {
-			if err := n.Blockchain.AddBlock(msg.Block); err != nil {
+			update, err := n.Blockchain.AddBlock(msg.Block)
+			if errors.Is(err, blockchain.ErrKnownBlock) {
+				return
+			}
+			if errors.Is(err, blockchain.ErrOrphanBlock) {
+				// We are missing blocks before it; fetch them headers first
+				n.sync.requestHeaders(msg.SenderAddr)
+				return
+			}
+			if err != nil {
 				log.Printf("Received invalid block: %v", err)
 				return
 			}
-			// Remove confirmed transactions from mempool
-			n.Mempool.RemoveConfirmed(msg.Block.Transactions)
+			n.applyChainUpdate(update)
+			if len(update.Connected) > 0 {
+				n.P2P.BroadcastBlock(msg.Block)
+			}
 			log.Printf("Received and added block %d from peer", msg.Block.Index)
 		}
 
+	case p2p.MsgGetData:
+		n.sendInventory(msg.SenderAddr, msg.Inventory)
+
+	case p2p.MsgVersion:
+		if msg.Version != nil {
+			n.sync.peerConnected(msg.SenderAddr, msg.Version)
+		}
+
+	case p2p.MsgGetHeaders:
+		headers := n.Blockchain.HeadersAfter(msg.Locator, p2p.MaxHeadersPerMessage)
+		if err := n.P2P.Send(msg.SenderAddr, p2p.Message{Type: p2p.MsgHeaders, Headers: headers}); err != nil {
+			log.Printf("Failed to send headers: %v", err)
+		}
+
+	case p2p.MsgHeaders:
+		n.sync.onHeaders(msg.SenderAddr, msg.Headers)
+
 	case p2p.MsgGetBlocks:
-		chain := n.Blockchain.GetChain()
-		n.P2P.SendChain(msg.SenderAddr, chain)
-		log.Printf("Sent chain (%d blocks) to peer %s", len(chain), msg.SenderAddr)
-
-	case p2p.MsgChain:
-		if msg.Chain != nil && n.Blockchain.ShouldReplaceChain(msg.Chain) {
-			if err := n.Blockchain.ReplaceChain(msg.Chain); err != nil {
-				log.Printf("Failed to replace chain: %v", err)
-				return
-			}
-			log.Printf("Replaced chain with longer chain (%d blocks)", len(msg.Chain))
+		blocks := n.blocksForPeer(msg.From, msg.Count)
+		if err := n.P2P.Send(msg.SenderAddr, p2p.Message{Type: p2p.MsgBlocks, Blocks: blocks}); err != nil {
+			log.Printf("Failed to send blocks: %v", err)
 		}
 
+	case p2p.MsgBlocks:
+		n.sync.onBlocks(msg.SenderAddr, msg.Blocks)
+
 	case p2p.MsgPing:
 		// Respond with pong - handled at P2P layer
 
@@ -143,8 +199,103 @@ func (n *Node) handleP2PMessage(msg p2p.Message) {
 	}
 }
 
-// Close shuts down the node.
+// sendInventory answers GETDATA with the requested transactions still in the
+// mempool and blocks in the block tree. Unknown items are skipped.
+func (n *Node) sendInventory(addr string, items []p2p.InvItem) {
+	for _, item := range items {
+		var msg p2p.Message
+		switch item.Type {
+		case p2p.InvTransaction:
+			tx, ok := n.Mempool.Get(item.Hash)
+			if !ok {
+				continue
+			}
+			msg = p2p.Message{Type: p2p.MsgTransaction, Transaction: tx}
+		case p2p.InvBlock:
+			block, err := n.Blockchain.GetBlockByHash(item.Hash)
+			if err != nil || block.Index <= n.Blockchain.SnapshotHeight() {
+				continue
+			}
+			msg = p2p.Message{Type: p2p.MsgBlock, Block: block}
+		default:
+			continue
+		}
+		if err := n.P2P.Send(addr, msg); err != nil {
+			log.Printf("Failed to send %s %s: %v", item.Type, item.Hash, err)
+			return
+		}
+	}
+}
+
+// blocksForPeer loads up to count main chain blocks from height from, as many
+// as fit in half a message. Blocks imported from a snapshot have no
+// transactions and are not served.
+func (n *Node) blocksForPeer(from, count uint64) []blockchain.Block {
+	if count > p2p.MaxBlocksPerMessage {
+		count = p2p.MaxBlocksPerMessage
+	}
+	if count == 0 || from <= n.Blockchain.SnapshotHeight() {
+		return nil
+	}
+	blocks, err := n.Blockchain.GetBlocks(from, from+count-1)
+	if err != nil {
+		log.Printf("Failed to load blocks for peer: %v", err)
+		return nil
+	}
+
+	// Binary blocks grow by a third as base64 in the JSON envelope
+	size := 0
+	for i := range blocks {
+		data, err := blocks[i].MarshalBinary()
+		if err != nil {
+			return blocks[:i]
+		}
+		size += len(data) * 4 / 3
+		if i > 0 && size > p2p.MaxMessageSize/2 {
+			return blocks[:i]
+		}
+	}
+	return blocks
+}
+
+// applyChainUpdate keeps the mempool in line with the main chain: confirmed
+// transactions are dropped and those from disconnected blocks are returned.
+func (n *Node) applyChainUpdate(update *blockchain.ChainUpdate) {
+	for _, block := range update.Connected {
+		n.Mempool.RemoveConfirmed(block.Transactions)
+	}
+
+	confirmed := make(map[string]bool)
+	for _, block := range update.Connected {
+		for _, tx := range block.Transactions {
+			confirmed[tx.ID] = true
+		}
+	}
+
+	readded := 0
+	for _, block := range update.Disconnected {
+		for _, tx := range block.Transactions {
+			if tx.Sender == blockchain.CoinbaseSender || confirmed[tx.ID] {
+				continue
+			}
+			if err := tx.IsValid(n.Blockchain.ChainID()); err != nil {
+				continue
+			}
+			if tx.Nonce < n.Blockchain.GetNonce(tx.Sender) {
+				continue
+			}
+			n.Mempool.Add(&tx)
+			readded++
+		}
+	}
+	if readded > 0 {
+		log.Printf("Returned %d transactions from disconnected blocks to the mempool", readded)
+	}
+}
+
+// Close shuts down the node. It may be called more than once.
 func (n *Node) Close() error {
+	n.sync.stop()
 	n.P2P.Stop()
 	return n.store.Close()
 }
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+)
+
+// testGenesis returns a genesis whose blocks are mined almost instantly.
+func testGenesis() *blockchain.Genesis {
+	genesis := blockchain.DefaultGenesis()
+	genesis.InitialTarget = blockchain.TargetToHex(blockchain.PowLimit)
+	return genesis
+}
+
+// freePort returns a loopback port that was free when it was checked.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// testNode returns a node with in-memory storage that has not been started,
+// and the loopback address it will listen on.
+func testNode(t *testing.T) (*Node, string) {
+	t.Helper()
+	port := freePort(t)
+	n, err := NewNodeWithStorage(blockchain.NewMemoryStorage(), port, testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, "127.0.0.1:" + port
+}
+
+func TestCloseTwice(t *testing.T) {
+	n, _ := testNode(t)
+	n.StartP2P()
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/p2p"
+)
+
+const (
+	// syncWindow bounds how far past the next block to connect blocks are
+	// requested, and so how many downloaded blocks can wait for their parent.
+	syncWindow = 1024
+	// syncTimeout is how long a peer has to answer GET_HEADERS or GET_BLOCKS
+	// before the request is given to another peer.
+	syncTimeout = 30 * time.Second
+	syncTick    = 2 * time.Second
+	// maxBodyFailures is the number of peers whose body of a block may be
+	// rejected before the header itself is blamed on the sync peer.
+	maxBodyFailures = 3
+)
+
+// syncPeers is the part of the P2P server the sync manager uses. Send and
+// DisconnectPeer only queue a message or close a connection, so they may be
+// called with the sync manager's lock held.
+type syncPeers interface {
+	Send(addr string, msg p2p.Message) error
+	DisconnectPeer(addr string)
+	PeerAddresses() []string
+	PeerVersion(addr string) (p2p.Version, bool)
+}
+
+type blockRequest struct {
+	from  uint64
+	count uint64
+	sent  time.Time
+}
+
+// downloadedBlock is a block body and the peer that delivered it.
+type downloadedBlock struct {
+	block *blockchain.Block
+	from  string
+}
+
+// syncManager downloads blocks headers first. Headers are fetched from one
+// peer and validated as a HeaderChain; once they form a branch with more
+// work than the main chain, the missing blocks are requested in batches from
+// every peer that announced enough height and connected in order as they
+// arrive. Only one sync runs at a time; it starts over from the best peer if
+// the sync peer leaves or no peer can be given the missing blocks.
+type syncManager struct {
+	node  *Node
+	peers syncPeers
+	now   func() time.Time
+	batch uint64 // blocks asked for per GET_BLOCKS
+
+	mu          sync.Mutex
+	peer        string // peer headers are downloaded from, or "" when idle
+	headers     *blockchain.HeaderChain
+	headersSent time.Time // when the pending GET_HEADERS was sent, or zero
+	headersDone bool      // the peer has sent all its headers
+	fetching    bool      // the headers have more work, so blocks are wanted
+
+	queue    []blockchain.Block          // validated headers of blocks to connect, in height order
+	blocks   map[string]*downloadedBlock // downloaded blocks waiting for their parent
+	inflight map[string]*blockRequest    // pending GET_BLOCKS by peer
+	failures map[string]int              // rejected bodies by block hash
+	progress time.Time                   // when fetch last requested a batch or had none left
+
+	// connecting is set while a block is being added to the chain with mu
+	// released; gen changes on every reset so the result of a block from an
+	// abandoned sync is ignored.
+	connecting bool
+	gen        uint64
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newSyncManager(n *Node) *syncManager {
+	s := &syncManager{
+		node:  n,
+		peers: n.P2P,
+		now:   time.Now,
+		batch: p2p.MaxBlocksPerMessage,
+		quit:  make(chan struct{}),
+	}
+	s.reset()
+	return s
+}
+
+// start runs the sync manager in the background until stop is called.
+func (s *syncManager) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run()
+	}()
+}
+
+// run retries requests that timed out until stop is called.
+func (s *syncManager) run() {
+	ticker := time.NewTicker(syncTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// stop ends run and waits for it to return. It may be called more than once.
+func (s *syncManager) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+	s.wg.Wait()
+}
+
+func (s *syncManager) reset() {
+	s.gen++
+	s.peer = ""
+	s.headers = nil
+	s.headersSent = time.Time{}
+	s.headersDone = false
+	s.fetching = false
+	s.queue = nil
+	s.blocks = make(map[string]*downloadedBlock)
+	s.inflight = make(map[string]*blockRequest)
+	s.failures = make(map[string]int)
+	s.progress = time.Time{}
+}
+
+// restart abandons the sync and starts over from the best peer other than
+// skip, if any.
+func (s *syncManager) restart(skip string) {
+	s.reset()
+	if addr := s.bestPeer(skip); addr != "" {
+		s.startHeaders(addr)
+	}
+}
+
+// peerConnected starts a sync from a new peer that announced a longer chain.
+func (s *syncManager) peerConnected(addr string, version *p2p.Version) {
+	if version.BestHeight >= s.node.Blockchain.Height() {
+		s.requestHeaders(addr)
+	}
+}
+
+// requestHeaders starts a sync from addr unless one is already running, for
+// instance after it sent a block whose parent is unknown.
+func (s *syncManager) requestHeaders(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer == "" {
+		s.startHeaders(addr)
+	}
+}
+
+func (s *syncManager) startHeaders(addr string) {
+	s.reset()
+	s.peer = addr
+	s.headers = s.node.Blockchain.NewHeaderChain()
+	s.sendHeadersRequest(s.node.Blockchain.Locator())
+}
+
+func (s *syncManager) sendHeadersRequest(locator []string) {
+	if err := s.peers.Send(s.peer, p2p.Message{Type: p2p.MsgGetHeaders, Locator: locator}); err != nil {
+		log.Printf("Sync: %v", err)
+		s.reset()
+		return
+	}
+	s.headersSent = s.now()
+}
+
+// onHeaders validates headers from the sync peer, queues the blocks missing
+// from the block tree and requests the next headers or the blocks.
+func (s *syncManager) onHeaders(addr string, headers []blockchain.Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if addr != s.peer || s.headersSent.IsZero() {
+		return
+	}
+	s.headersSent = time.Time{}
+	if len(headers) > p2p.MaxHeadersPerMessage {
+		s.misbehaving("sent %d headers", len(headers))
+		return
+	}
+	if err := s.headers.Add(headers); err != nil {
+		s.misbehaving("sent invalid headers: %v", err)
+		return
+	}
+	for _, header := range headers {
+		if !s.node.Blockchain.HasBlock(header.Hash) {
+			s.queue = append(s.queue, header)
+		}
+	}
+
+	if len(headers) == p2p.MaxHeadersPerMessage {
+		s.sendHeadersRequest([]string{headers[len(headers)-1].Hash})
+	} else {
+		s.headersDone = true
+	}
+
+	if !s.fetching && s.headers.MoreWork() {
+		s.fetching = true
+		s.progress = s.now()
+		log.Printf("Sync: downloading blocks up to %d from %s", s.headers.Tip().Index, s.peer)
+	}
+	if !s.fetching {
+		if s.headersDone {
+			s.reset()
+		}
+		return
+	}
+	s.connect()
+	s.fetch()
+}
+
+// onBlocks stores downloaded blocks that match queued headers and connects
+// those whose parent is in place.
+func (s *syncManager) onBlocks(addr string, blocks []blockchain.Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return
+	}
+	first := s.queue[0].Index
+	useful := 0
+	for i := range blocks {
+		block := blocks[i]
+		pos := block.Index - first
+		if block.Index < first || pos >= uint64(len(s.queue)) || s.queue[pos].Hash != block.Hash {
+			continue
+		}
+		s.blocks[block.Hash] = &downloadedBlock{block: &block, from: addr}
+		useful++
+	}
+	// A peer that could not serve any of the blocks keeps its request until
+	// it times out, so it is not asked again straight away
+	if useful > 0 {
+		delete(s.inflight, addr)
+	}
+
+	s.connect()
+	s.fetch()
+}
+
+// connect adds downloaded blocks to the chain in height order. A block that
+// is rejected is dropped and its peer disconnected, so the block is requested
+// again from another peer. mu is released while a block is added, so other
+// peers' messages are handled meanwhile; only one caller connects at a time.
+func (s *syncManager) connect() {
+	if s.connecting {
+		return
+	}
+	s.connecting = true
+	defer func() { s.connecting = false }()
+
+	for len(s.queue) > 0 {
+		downloaded, ok := s.blocks[s.queue[0].Hash]
+		if !ok {
+			return
+		}
+		block := downloaded.block
+		gen := s.gen
+
+		s.mu.Unlock()
+		update, err := s.node.Blockchain.AddBlock(block)
+		if err == nil {
+			s.node.applyChainUpdate(update)
+		}
+		s.mu.Lock()
+
+		if s.gen != gen {
+			continue // the sync was reset meanwhile
+		}
+		delete(s.blocks, block.Hash)
+		if err != nil && !errors.Is(err, blockchain.ErrKnownBlock) {
+			log.Printf("Sync: peer %s sent invalid block %d: %v", downloaded.from, block.Index, err)
+			s.peers.DisconnectPeer(downloaded.from)
+			delete(s.inflight, downloaded.from)
+			s.failures[block.Hash]++
+			if s.failures[block.Hash] >= maxBodyFailures {
+				s.misbehaving("sent headers of invalid block %d", block.Index)
+			}
+			return
+		}
+		s.queue = s.queue[1:]
+	}
+
+	if s.headersDone {
+		log.Printf("Sync: synchronized with %s at block %d", s.peer, s.node.Blockchain.Height()-1)
+		s.reset()
+	}
+}
+
+// fetch sends GET_BLOCKS for the next unrequested batches to idle peers. The
+// sync peer is always asked; others only if they announced the height.
+func (s *syncManager) fetch() {
+	if !s.fetching {
+		return
+	}
+	peers := s.peers.PeerAddresses()
+	sort.Strings(peers)
+	for _, addr := range peers {
+		if s.inflight[addr] != nil {
+			continue
+		}
+		from, count := s.nextBatch()
+		if count == 0 {
+			break
+		}
+		if addr != s.peer {
+			version, ok := s.peers.PeerVersion(addr)
+			if !ok || version.BestHeight < from+count-1 {
+				continue
+			}
+		}
+		if err := s.peers.Send(addr, p2p.Message{Type: p2p.MsgGetBlocks, From: from, Count: count}); err != nil {
+			log.Printf("Sync: %v", err)
+			continue
+		}
+		s.inflight[addr] = &blockRequest{from: from, count: count, sent: s.now()}
+		s.progress = s.now()
+	}
+	if _, count := s.nextBatch(); count == 0 {
+		s.progress = s.now()
+	}
+}
+
+// nextBatch returns the first run of queued blocks within the window that
+// are neither downloaded nor requested.
+func (s *syncManager) nextBatch() (from, count uint64) {
+	window := s.queue
+	if len(window) > syncWindow {
+		window = window[:syncWindow]
+	}
+	for _, header := range window {
+		wanted := s.blocks[header.Hash] == nil && !s.requested(header.Index)
+		if count > 0 && (!wanted || count == s.batch) {
+			break
+		}
+		if wanted {
+			if count == 0 {
+				from = header.Index
+			}
+			count++
+		}
+	}
+	return from, count
+}
+
+func (s *syncManager) requested(height uint64) bool {
+	for _, req := range s.inflight {
+		if height >= req.from && height < req.from+req.count {
+			return true
+		}
+	}
+	return false
+}
+
+// tick drops requests peers did not answer in time and hands their work to
+// other peers. It starts the sync over if the sync peer is gone, did not
+// answer for headers, or if the missing blocks could not be requested from
+// any peer for syncTimeout.
+func (s *syncManager) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peer == "" {
+		return
+	}
+	now := s.now()
+	if _, ok := s.peers.PeerVersion(s.peer); !ok {
+		log.Printf("Sync: lost sync peer %s", s.peer)
+		s.restart(s.peer)
+		return
+	}
+	if !s.headersSent.IsZero() && now.Sub(s.headersSent) > syncTimeout {
+		log.Printf("Sync: %s did not answer the header request", s.peer)
+		s.peers.DisconnectPeer(s.peer)
+		s.restart(s.peer)
+		return
+	}
+	for addr, req := range s.inflight {
+		if now.Sub(req.sent) > syncTimeout {
+			delete(s.inflight, addr)
+		}
+	}
+	s.fetch()
+	if s.fetching && now.Sub(s.progress) > syncTimeout {
+		log.Printf("Sync: no peer could be asked for the blocks after %d", s.node.Blockchain.Height()-1)
+		s.restart("")
+	}
+}
+
+// bestPeer returns the connected peer other than skip that announced the
+// highest chain above ours, or "".
+func (s *syncManager) bestPeer(skip string) string {
+	best, height := "", s.node.Blockchain.Height()-1
+	for _, addr := range s.peers.PeerAddresses() {
+		if addr == skip {
+			continue
+		}
+		if version, ok := s.peers.PeerVersion(addr); ok && version.BestHeight > height {
+			best, height = addr, version.BestHeight
+		}
+	}
+	return best
+}
+
+// misbehaving disconnects the sync peer and starts the sync over from
+// another one.
+func (s *syncManager) misbehaving(format string, args ...interface{}) {
+	peer := s.peer
+	log.Printf("Sync: peer %s "+format, append([]interface{}{peer}, args...)...)
+	s.peers.DisconnectPeer(peer)
+	s.restart(peer)
+}
@@ -0,0 +1,349 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+	"github.com/nawesan12/fernet-token/packages/p2p"
+)
+
+// fakePeers records what the sync manager sends instead of using the network.
+type fakePeers struct {
+	mu       sync.Mutex
+	versions map[string]p2p.Version
+	sent     map[string][]p2p.Message
+	dropped  []string
+}
+
+func (f *fakePeers) connect(addr string, height uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions[addr] = p2p.Version{BestHeight: height}
+}
+
+func (f *fakePeers) Send(addr string, msg p2p.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.versions[addr]; !ok {
+		return fmt.Errorf("peer %s not found", addr)
+	}
+	f.sent[addr] = append(f.sent[addr], msg)
+	return nil
+}
+
+func (f *fakePeers) DisconnectPeer(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.versions, addr)
+	f.dropped = append(f.dropped, addr)
+}
+
+func (f *fakePeers) PeerAddresses() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addrs := make([]string, 0, len(f.versions))
+	for addr := range f.versions {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (f *fakePeers) PeerVersion(addr string) (p2p.Version, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	version, ok := f.versions[addr]
+	return version, ok
+}
+
+// last returns the last message sent to addr.
+func (f *fakePeers) last(t *testing.T, addr string) p2p.Message {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs := f.sent[addr]
+	if len(msgs) == 0 {
+		t.Fatalf("nothing was sent to %s", addr)
+	}
+	return msgs[len(msgs)-1]
+}
+
+// syncTest is a node whose sync manager talks to fakePeers and reads a clock
+// the test advances.
+type syncTest struct {
+	node  *Node
+	sync  *syncManager
+	peers *fakePeers
+	now   time.Time
+}
+
+func newSyncTest(t *testing.T) *syncTest {
+	t.Helper()
+	n, _ := testNode(t)
+	st := &syncTest{
+		node: n,
+		peers: &fakePeers{
+			versions: make(map[string]p2p.Version),
+			sent:     make(map[string][]p2p.Message),
+		},
+		now: time.Unix(blockchain.GenesisTimestamp, 0),
+	}
+	st.sync = newSyncManager(st.node)
+	st.sync.peers = st.peers
+	st.sync.now = func() time.Time { return st.now }
+	st.node.sync = st.sync
+	return st
+}
+
+// sourceChain returns a chain of count blocks after the test genesis.
+func sourceChain(t *testing.T, count int) *blockchain.Blockchain {
+	t.Helper()
+	bc, err := blockchain.NewBlockchain(blockchain.NewMemoryStorage(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(blockchain.GenesisTimestamp, 0)
+	bc.SetClock(func() time.Time {
+		now = now.Add(time.Duration(blockchain.TargetBlockTime) * time.Second)
+		return now
+	})
+	for i := 0; i < count; i++ {
+		if _, err := bc.MineBlock("miner1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bc
+}
+
+// answerHeaders replies to the GET_HEADERS last sent to addr from src.
+func (st *syncTest) answerHeaders(t *testing.T, src *blockchain.Blockchain, addr string) {
+	t.Helper()
+	req := st.peers.last(t, addr)
+	if req.Type != p2p.MsgGetHeaders {
+		t.Fatalf("expected GET_HEADERS to %s, got %s", addr, req.Type)
+	}
+	st.sync.onHeaders(addr, src.HeadersAfter(req.Locator, p2p.MaxHeadersPerMessage))
+}
+
+// blocksRequest returns the GET_BLOCKS last sent to addr.
+func (st *syncTest) blocksRequest(t *testing.T, addr string) (from, count uint64) {
+	t.Helper()
+	req := st.peers.last(t, addr)
+	if req.Type != p2p.MsgGetBlocks {
+		t.Fatalf("expected GET_BLOCKS to %s, got %s", addr, req.Type)
+	}
+	return req.From, req.Count
+}
+
+func blocks(t *testing.T, src *blockchain.Blockchain, from, count uint64) []blockchain.Block {
+	t.Helper()
+	blocks, err := src.GetBlocks(from, from+count-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+// tamper changes a block's body so it no longer matches its header.
+func tamper(blocks []blockchain.Block, i int) []blockchain.Block {
+	blocks[i].Transactions = append([]blockchain.Transaction(nil), blocks[i].Transactions...)
+	blocks[i].Transactions[0].Amount++
+	return blocks
+}
+
+func TestSyncHeadersFirst(t *testing.T) {
+	st := newSyncTest(t)
+	src := sourceChain(t, 5)
+	st.peers.connect("a", 5)
+
+	st.sync.peerConnected("a", &p2p.Version{BestHeight: 5})
+	st.answerHeaders(t, src, "a")
+	if from, count := st.blocksRequest(t, "a"); from != 1 || count != 5 {
+		t.Fatalf("expected blocks 1-5 to be requested, got %d from %d", count, from)
+	}
+	st.sync.onBlocks("a", blocks(t, src, 1, 5))
+
+	if st.node.Blockchain.Height() != 6 {
+		t.Errorf("expected height 6, got %d", st.node.Blockchain.Height())
+	}
+	if st.sync.peer != "" {
+		t.Errorf("the sync should be over, still syncing from %q", st.sync.peer)
+	}
+}
+
+func TestSyncFetchesBatchesFromSeveralPeers(t *testing.T) {
+	st := newSyncTest(t)
+	st.sync.batch = 2
+	src := sourceChain(t, 6)
+	for _, addr := range []string{"a", "b", "c"} {
+		st.peers.connect(addr, 6)
+	}
+
+	st.sync.requestHeaders("a")
+	st.answerHeaders(t, src, "a")
+	for addr, want := range map[string]uint64{"a": 1, "b": 3, "c": 5} {
+		if from, count := st.blocksRequest(t, addr); from != want || count != 2 {
+			t.Errorf("%s: expected blocks %d-%d, got %d from %d", addr, want, want+1, count, from)
+		}
+	}
+
+	// Blocks are connected in order whatever order they arrive in
+	st.sync.onBlocks("c", blocks(t, src, 5, 2))
+	if st.node.Blockchain.Height() != 1 {
+		t.Fatalf("blocks 5-6 should wait for their parents, height %d", st.node.Blockchain.Height())
+	}
+	st.sync.onBlocks("a", blocks(t, src, 1, 2))
+	st.sync.onBlocks("b", blocks(t, src, 3, 2))
+	if st.node.Blockchain.Height() != 7 {
+		t.Errorf("expected height 7, got %d", st.node.Blockchain.Height())
+	}
+}
+
+func TestSyncAsksAnotherPeerForRejectedBody(t *testing.T) {
+	st := newSyncTest(t)
+	src := sourceChain(t, 3)
+	st.peers.connect("a", 3)
+	st.peers.connect("b", 3)
+
+	st.sync.requestHeaders("a")
+	st.answerHeaders(t, src, "a")
+	st.sync.onBlocks("a", tamper(blocks(t, src, 1, 3), 1))
+
+	if len(st.peers.dropped) != 1 || st.peers.dropped[0] != "a" {
+		t.Fatalf("the peer that sent the bad body should be dropped, dropped %v", st.peers.dropped)
+	}
+	if from, count := st.blocksRequest(t, "b"); from != 2 || count != 1 {
+		t.Fatalf("expected block 2 to be requested from b, got %d from %d", count, from)
+	}
+	st.sync.onBlocks("b", blocks(t, src, 2, 1))
+	if st.node.Blockchain.Height() != 4 {
+		t.Errorf("expected height 4, got %d", st.node.Blockchain.Height())
+	}
+}
+
+func TestSyncBlamesHeadersAfterMaxBodyFailures(t *testing.T) {
+	st := newSyncTest(t)
+	src := sourceChain(t, 2)
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		st.peers.connect(addr, 2)
+	}
+
+	st.sync.requestHeaders("a")
+	st.answerHeaders(t, src, "a")
+	for _, addr := range []string{"a", "b", "c"}[:maxBodyFailures] {
+		if from, _ := st.blocksRequest(t, addr); from != 1 {
+			t.Fatalf("expected block 1 to be requested from %s, got %d", addr, from)
+		}
+		st.sync.onBlocks(addr, tamper(blocks(t, src, 1, 1), 0))
+	}
+
+	// Every body was rejected, so the sync peer's headers are blamed and the
+	// sync starts over from the remaining peer
+	if got := st.peers.dropped; len(got) != maxBodyFailures+1 || got[maxBodyFailures] != "a" {
+		t.Errorf("expected the sync peer to be dropped last, dropped %v", got)
+	}
+	if st.sync.peer != "d" {
+		t.Errorf("expected the sync to restart from d, syncing from %q", st.sync.peer)
+	}
+	if msg := st.peers.last(t, "d"); msg.Type != p2p.MsgGetHeaders {
+		t.Errorf("expected GET_HEADERS to d, got %s", msg.Type)
+	}
+}
+
+func TestSyncRestartsWhenSyncPeerLeaves(t *testing.T) {
+	st := newSyncTest(t)
+	st.peers.connect("a", 3)
+	st.peers.connect("b", 3)
+
+	st.sync.requestHeaders("a")
+	st.peers.DisconnectPeer("a")
+	st.now = st.now.Add(syncTick)
+	st.sync.tick()
+
+	if st.sync.peer != "b" {
+		t.Fatalf("expected the sync to restart from b, syncing from %q", st.sync.peer)
+	}
+	if msg := st.peers.last(t, "b"); msg.Type != p2p.MsgGetHeaders {
+		t.Errorf("expected GET_HEADERS to b, got %s", msg.Type)
+	}
+}
+
+func TestSyncRestartsWhenHeadersTimeOut(t *testing.T) {
+	st := newSyncTest(t)
+	st.peers.connect("a", 3)
+	st.peers.connect("b", 3)
+
+	st.sync.requestHeaders("a")
+	st.now = st.now.Add(syncTimeout / 2)
+	st.sync.tick()
+	if st.sync.peer != "a" {
+		t.Fatalf("the sync peer should have until syncTimeout, syncing from %q", st.sync.peer)
+	}
+
+	st.now = st.now.Add(syncTimeout)
+	st.sync.tick()
+	if len(st.peers.dropped) != 1 || st.peers.dropped[0] != "a" {
+		t.Errorf("expected the silent sync peer to be dropped, dropped %v", st.peers.dropped)
+	}
+	if st.sync.peer != "b" {
+		t.Errorf("expected the sync to restart from b, syncing from %q", st.sync.peer)
+	}
+}
+
+func TestSyncReassignsTimedOutBlocks(t *testing.T) {
+	st := newSyncTest(t)
+	st.sync.batch = 2
+	src := sourceChain(t, 4)
+	st.peers.connect("a", 4)
+	st.peers.connect("b", 4)
+
+	st.sync.requestHeaders("a")
+	st.answerHeaders(t, src, "a")
+	st.sync.onBlocks("a", blocks(t, src, 1, 2))
+
+	// b never answers for blocks 3-4; once its request expires, a is asked
+	st.now = st.now.Add(syncTimeout + time.Second)
+	st.sync.tick()
+	if from, count := st.blocksRequest(t, "a"); from != 3 || count != 2 {
+		t.Fatalf("expected blocks 3-4 to be requested from a, got %d from %d", count, from)
+	}
+	st.sync.onBlocks("a", blocks(t, src, 3, 2))
+	if st.node.Blockchain.Height() != 5 {
+		t.Errorf("expected height 5, got %d", st.node.Blockchain.Height())
+	}
+}
+
+func TestNodesSyncOverNetwork(t *testing.T) {
+	a, addr := testNode(t)
+	for i := 0; i < 3; i++ {
+		if _, err := a.Mine("miner1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := testNode(t)
+	a.StartP2P()
+	b.StartP2P()
+	defer a.Close()
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.P2P.ConnectToPeer(addr) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("could not connect to the first node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for b.Blockchain.Height() != a.Blockchain.Height() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected height %d, got %d", a.Blockchain.Height(), b.Blockchain.Height())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Blockchain.GetLatestBlock().Hash != a.Blockchain.GetLatestBlock().Hash {
+		t.Error("the nodes have different tips")
+	}
+}
@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Inventory types announced in INV and requested in GETDATA messages.
+const (
+	InvTransaction = "tx"
+	InvBlock       = "block"
+)
+
+const (
+	// knownInventorySize bounds the inventory remembered per peer and
+	// seenInventorySize the inventory the server remembers having received.
+	knownInventorySize = 10000
+	seenInventorySize  = 50000
+
+	// getDataTimeout is how long an item requested from one peer is not
+	// requested from others.
+	getDataTimeout = 30 * time.Second
+)
+
+// InvItem identifies a transaction by its ID or a block by its hash.
+type InvItem struct {
+	Type string `json:"type"`
+	Hash string `json:"hash"`
+}
+
+// inventorySet is a set of inventory items that forgets the oldest ones once
+// it holds max items. It is safe for concurrent use.
+type inventorySet struct {
+	mu    sync.Mutex
+	items map[InvItem]bool
+	order []InvItem // ring buffer of the items in insertion order
+	next  int
+	max   int
+}
+
+func newInventorySet(max int) *inventorySet {
+	return &inventorySet{items: make(map[InvItem]bool), max: max}
+}
+
+// Add adds item and reports whether it was not in the set already.
+func (s *inventorySet) Add(item InvItem) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.items[item] {
+		return false
+	}
+	if len(s.order) < s.max {
+		s.order = append(s.order, item)
+	} else {
+		delete(s.items, s.order[s.next])
+		s.order[s.next] = item
+		s.next = (s.next + 1) % s.max
+	}
+	s.items[item] = true
+	return true
+}
+
+// Has reports whether item is in the set.
+func (s *inventorySet) Has(item InvItem) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[item]
+}
+
+// inventoryOf returns the item carried by a TRANSACTION or BLOCK message.
+func inventoryOf(msg *Message) (InvItem, bool) {
+	switch {
+	case msg.Type == MsgTransaction && msg.Transaction != nil:
+		return InvItem{Type: InvTransaction, Hash: msg.Transaction.ID}, true
+	case msg.Type == MsgBlock && msg.Block != nil:
+		return InvItem{Type: InvBlock, Hash: msg.Block.Hash}, true
+	}
+	return InvItem{}, false
+}
+
+// wanted returns the items of an INV that the server has neither seen nor
+// requested from another peer in the last getDataTimeout, and records them
+// as requested.
+func (s *P2PServer) wanted(inv []InvItem) []InvItem {
+	s.invMu.Lock()
+	defer s.invMu.Unlock()
+
+	now := time.Now()
+	for item, at := range s.requested {
+		if now.Sub(at) > getDataTimeout {
+			delete(s.requested, item)
+		}
+	}
+
+	var want []InvItem
+	for _, item := range inv {
+		if item.Type != InvTransaction && item.Type != InvBlock {
+			continue
+		}
+		if s.seen.Has(item) || (item.Type == InvBlock && s.chain.HasBlock(item.Hash)) {
+			continue
+		}
+		if _, ok := s.requested[item]; ok {
+			continue
+		}
+		s.requested[item] = now
+		want = append(want, item)
+	}
+	return want
+}
+
+// received records that the item of a TRANSACTION or BLOCK message arrived
+// from a peer, so it is not announced back to it. The item is only seen once
+// the handler accepts and announces it; until then its pending request keeps
+// other peers from being asked for it, and once the request expires an item
+// the handler rejected can be fetched from another peer.
+func (s *P2PServer) received(p *peer, msg *Message) {
+	if item, ok := inventoryOf(msg); ok {
+		p.known.Add(item)
+	}
+}
+
+// announce marks item as seen and sends it to every peer not known to have
+// it: as an INV to peers speaking InvProtocolVersion, and as the full message
+// to older ones.
+func (s *P2PServer) announce(item InvItem, full Message) {
+	s.seen.Add(item)
+	s.invMu.Lock()
+	delete(s.requested, item)
+	s.invMu.Unlock()
+
+	s.mu.RLock()
+	peers := make([]*peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.RUnlock()
+
+	inv := Message{Type: MsgInv, Inventory: []InvItem{item}}
+	for _, p := range peers {
+		if !p.known.Add(item) {
+			continue
+		}
+		msg := inv
+		if p.version.ProtocolVersion < InvProtocolVersion {
+			msg = full
+		}
+		if err := p.send(msg); err != nil {
+			log.Printf("P2P: failed to send to %s: %v", p.addr, err)
+		}
+	}
+}
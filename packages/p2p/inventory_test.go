@@ -0,0 +1,36 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+)
+
+func TestRejectedInventoryIsRequestedAgain(t *testing.T) {
+	s := NewP2PServer("0", testChain(t, nil), func(Message) {})
+	tx := &blockchain.Transaction{ID: "aa"}
+	item := InvItem{Type: InvTransaction, Hash: tx.ID}
+	msg := Message{Type: MsgTransaction, Transaction: tx}
+
+	if want := s.wanted([]InvItem{item}); len(want) != 1 {
+		t.Fatalf("a new item should be requested, got %v", want)
+	}
+	s.received(newPeer("10.0.0.1:6000", nil, Version{}), &msg)
+	if want := s.wanted([]InvItem{item}); len(want) != 0 {
+		t.Errorf("an item requested from another peer should not be requested again, got %v", want)
+	}
+
+	// The handler did not accept it; once the request expires another peer
+	// can be asked
+	s.requested[item] = time.Now().Add(-getDataTimeout - time.Second)
+	if want := s.wanted([]InvItem{item}); len(want) != 1 {
+		t.Errorf("a rejected item should be requested again, got %v", want)
+	}
+
+	s.BroadcastTransaction(tx)
+	s.requested = make(map[InvItem]time.Time)
+	if want := s.wanted([]InvItem{item}); len(want) != 0 {
+		t.Errorf("an accepted item should not be requested again, got %v", want)
+	}
+}
@@ -0,0 +1,292 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxPeerBookSize bounds the number of addresses a peer book keeps. Once
+	// it is full, a new address replaces the unverified one learned longest
+	// ago; addresses we completed a handshake with are kept.
+	MaxPeerBookSize = 1000
+
+	// maxPeerFailures is the number of failed dials in a row after which an
+	// address is forgotten.
+	maxPeerFailures = 10
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// KnownPeer is a peer book entry. Times are Unix seconds, zero if never.
+type KnownPeer struct {
+	Address     string `json:"address"`
+	Added       int64  `json:"added,omitempty"`       // when the address was learned
+	LastSeen    int64  `json:"lastSeen,omitempty"`    // last completed handshake
+	LastAttempt int64  `json:"lastAttempt,omitempty"` // last dial
+	Failures    int    `json:"failures,omitempty"`    // failed dials since the last success
+}
+
+// retryAt returns when the address may be dialed again: straight away if it
+// never failed, then after a delay doubling with every failure.
+func (p *KnownPeer) retryAt() time.Time {
+	if p.Failures == 0 {
+		return time.Unix(p.LastAttempt, 0)
+	}
+	delay := retryBaseDelay
+	for i := 1; i < p.Failures && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Unix(p.LastAttempt, 0).Add(delay)
+}
+
+// PeerBook remembers the addresses of peers learned from the network or
+// connected to, so the node can find peers again after a restart. It is
+// kept in a JSON file; an empty path keeps it in memory only.
+type PeerBook struct {
+	path  string
+	peers map[string]*KnownPeer
+	self  map[string]bool // our own addresses, never added again
+	dirty bool
+	mu    sync.Mutex
+	now   func() time.Time
+}
+
+// NewPeerBook returns an empty peer book kept in memory.
+func NewPeerBook() *PeerBook {
+	return &PeerBook{peers: make(map[string]*KnownPeer), self: make(map[string]bool), now: time.Now}
+}
+
+// LoadPeerBook reads the peer book at path. A missing file yields an empty
+// book that is created on the first Save.
+func LoadPeerBook(path string) (*PeerBook, error) {
+	b := NewPeerBook()
+	b.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []KnownPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("invalid peer book %s: %w", path, err)
+	}
+	for i := range peers {
+		if validPeerAddress(peers[i].Address) && len(b.peers) < MaxPeerBookSize {
+			p := peers[i]
+			b.peers[p.Address] = &p
+		}
+	}
+	return b, nil
+}
+
+// Save writes the peer book to its file if it changed since the last save.
+func (b *PeerBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.path == "" || !b.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replace the file in one step so a crash cannot leave half a book
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// Add records addresses learned from peers. Invalid addresses are ignored.
+func (b *PeerBook) Add(addrs ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, addr := range addrs {
+		if _, ok := b.peers[addr]; ok || b.self[addr] || !validPeerAddress(addr) || !b.makeRoom() {
+			continue
+		}
+		b.peers[addr] = &KnownPeer{Address: addr, Added: b.now().Unix()}
+		b.dirty = true
+	}
+}
+
+// makeRoom reports whether an address can be added, evicting the unverified
+// address learned longest ago if the book is full.
+func (b *PeerBook) makeRoom() bool {
+	if len(b.peers) < MaxPeerBookSize {
+		return true
+	}
+	var oldest *KnownPeer
+	for _, p := range b.peers {
+		if p.LastSeen != 0 {
+			continue
+		}
+		if oldest == nil || p.Added < oldest.Added || (p.Added == oldest.Added && p.Address < oldest.Address) {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(b.peers, oldest.Address)
+	return true
+}
+
+// MarkSelf forgets an address found to lead back to this node and ignores it
+// when peers share it again.
+func (b *PeerBook) MarkSelf(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.self[addr] = true
+	if _, ok := b.peers[addr]; ok {
+		delete(b.peers, addr)
+		b.dirty = true
+	}
+}
+
+// Attempt records that addr is being dialed.
+func (b *PeerBook) Attempt(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, ok := b.peers[addr]; ok {
+		p.LastAttempt = b.now().Unix()
+		b.dirty = true
+	}
+}
+
+// Good records a completed handshake with the peer at addr, adding it to the
+// book if needed.
+func (b *PeerBook) Good(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !validPeerAddress(addr) {
+		return
+	}
+	p, ok := b.peers[addr]
+	if !ok {
+		if !b.makeRoom() {
+			return
+		}
+		p = &KnownPeer{Address: addr, Added: b.now().Unix()}
+		b.peers[addr] = p
+	}
+	p.LastSeen = b.now().Unix()
+	p.Failures = 0
+	b.dirty = true
+}
+
+// Failed records a failed dial of addr. Addresses failing too often are
+// forgotten.
+func (b *PeerBook) Failed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.peers[addr]
+	if !ok {
+		return
+	}
+	p.Failures++
+	if p.Failures >= maxPeerFailures {
+		delete(b.peers, addr)
+	}
+	b.dirty = true
+}
+
+// Candidates returns up to max addresses that are due to be dialed and not
+// in exclude, those seen most recently first.
+func (b *PeerBook) Candidates(max int, exclude map[string]bool) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	var addrs []string
+	for _, p := range b.sorted() {
+		if len(addrs) == max {
+			break
+		}
+		if !exclude[p.Address] && !p.retryAt().After(now) {
+			addrs = append(addrs, p.Address)
+		}
+	}
+	return addrs
+}
+
+// Addresses returns up to max addresses worth sharing with peers: those we
+// completed a handshake with and have not failed to dial since, most
+// recently seen first.
+func (b *PeerBook) Addresses(max int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []string
+	for _, p := range b.sorted() {
+		if len(addrs) == max {
+			break
+		}
+		if p.LastSeen != 0 && p.Failures == 0 {
+			addrs = append(addrs, p.Address)
+		}
+	}
+	return addrs
+}
+
+// Peers returns a copy of every entry, most recently seen first.
+func (b *PeerBook) Peers() []KnownPeer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sorted()
+}
+
+// Len returns the number of addresses in the book.
+func (b *PeerBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.peers)
+}
+
+func (b *PeerBook) sorted() []KnownPeer {
+	peers := make([]KnownPeer, 0, len(b.peers))
+	for _, p := range b.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].LastSeen != peers[j].LastSeen {
+			return peers[i].LastSeen > peers[j].LastSeen
+		}
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+// validPeerAddress reports whether addr is a host:port a peer could be
+// dialed at.
+func validPeerAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != "" && port != "0"
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerBookPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	book, err := LoadPeerBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Add("10.0.0.1:6000", "10.0.0.2:6000", "not an address", "10.0.0.3:0")
+	book.Good("10.0.0.2:6000")
+	book.Failed("10.0.0.1:6000")
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPeerBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := loaded.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %+v", peers)
+	}
+	if peers[0].Address != "10.0.0.2:6000" || peers[0].LastSeen == 0 {
+		t.Errorf("the peer seen should come first, got %+v", peers[0])
+	}
+	if peers[1].Address != "10.0.0.1:6000" || peers[1].Failures != 1 {
+		t.Errorf("the failure should be kept, got %+v", peers[1])
+	}
+	if addrs := loaded.Addresses(10); len(addrs) != 1 || addrs[0] != "10.0.0.2:6000" {
+		t.Errorf("only the peer seen should be shared, got %v", addrs)
+	}
+}
+
+func TestPeerBookBackoff(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	book := NewPeerBook()
+	book.now = func() time.Time { return now }
+	book.Add("10.0.0.1:6000", "10.0.0.2:6000")
+
+	exclude := map[string]bool{"10.0.0.2:6000": true}
+	if addrs := book.Candidates(10, exclude); len(addrs) != 1 || addrs[0] != "10.0.0.1:6000" {
+		t.Fatalf("expected the address not excluded, got %v", addrs)
+	}
+
+	// Each failure doubles the wait before the next dial
+	for failures, wait := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute} {
+		book.Attempt("10.0.0.1:6000")
+		book.Failed("10.0.0.1:6000")
+		now = now.Add(wait - time.Second)
+		if addrs := book.Candidates(10, exclude); len(addrs) != 0 {
+			t.Errorf("after %d failures: dialed again too soon", failures+1)
+		}
+		now = now.Add(time.Second)
+		if addrs := book.Candidates(10, exclude); len(addrs) != 1 {
+			t.Errorf("after %d failures: should be dialed again after %v", failures+1, wait)
+		}
+	}
+
+	for i := 0; i < maxPeerFailures; i++ {
+		book.Failed("10.0.0.1:6000")
+	}
+	if book.Len() != 1 {
+		t.Errorf("an address failing too often should be forgotten, have %+v", book.Peers())
+	}
+
+	book.MarkSelf("10.0.0.2:6000")
+	book.Add("10.0.0.2:6000")
+	if book.Len() != 0 {
+		t.Errorf("our own address should not be added again, have %+v", book.Peers())
+	}
+}
+
+func TestPeerBookEvictsOldestUnverified(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	book := NewPeerBook()
+	book.now = func() time.Time { return now }
+	for i := 0; i < MaxPeerBookSize; i++ {
+		book.Add(fmt.Sprintf("10.0.%d.%d:6000", i/256, i%256))
+		now = now.Add(time.Second)
+	}
+	book.Good("10.0.0.0:6000")
+
+	// The first address was verified, so the second one makes room
+	book.Add("10.1.0.0:6000")
+	if book.Len() != MaxPeerBookSize {
+		t.Fatalf("expected a full book, have %d addresses", book.Len())
+	}
+	have := make(map[string]bool)
+	for _, p := range book.Peers() {
+		have[p.Address] = true
+	}
+	if !have["10.1.0.0:6000"] || !have["10.0.0.0:6000"] || have["10.0.0.1:6000"] {
+		t.Errorf("expected the oldest unverified address to be replaced")
+	}
+}
@@ -13,21 +13,169 @@ import (
 const (
 	MsgTransaction = "TRANSACTION"
 	MsgBlock       = "BLOCK"
+	MsgGetHeaders  = "GET_HEADERS"
+	MsgHeaders     = "HEADERS"
 	MsgGetBlocks   = "GET_BLOCKS"
-	MsgChain       = "CHAIN"
+	MsgBlocks      = "BLOCKS"
 	MsgPing        = "PING"
 	MsgPong        = "PONG"
+	MsgVersion     = "VERSION"
+	MsgVerack      = "VERACK"
+	MsgGetAddr     = "GETADDR"
+	MsgAddr        = "ADDR"
+	MsgInv         = "INV"
+	MsgGetData     = "GETDATA"
 
 	MaxMessageSize = 10 * 1024 * 1024 // 10MB
+
+	// MaxHeadersPerMessage and MaxBlocksPerMessage bound the answers to
+	// GET_HEADERS and GET_BLOCKS. A shorter HEADERS answer means the peer has
+	// no more headers to send.
+	MaxHeadersPerMessage = 2000
+	MaxBlocksPerMessage  = 64
+
+	// MaxAddrPerMessage bounds the addresses in an ADDR message. Larger ones
+	// are ignored.
+	MaxAddrPerMessage = 1000
+
+	// MaxInvPerMessage bounds the items in INV and GETDATA messages. Larger
+	// ones are ignored.
+	MaxInvPerMessage = 1000
+)
+
+// ProtocolVersion is the version of the message protocol spoken by this
+// build. Peers announcing an older version than MinProtocolVersion are
+// disconnected during the handshake.
+const (
+	ProtocolVersion    uint32 = 4
+	MinProtocolVersion uint32 = 2
+
+	// AddrProtocolVersion is the first version answering GETADDR.
+	AddrProtocolVersion uint32 = 3
+	// InvProtocolVersion is the first version announcing transactions and
+	// blocks with INV. Older peers are sent them in full.
+	InvProtocolVersion uint32 = 4
 )
 
+// Version is exchanged by both sides when a connection is opened, before any
+// other message.
+type Version struct {
+	ProtocolVersion uint32 `json:"protocolVersion"`
+	GenesisHash     string `json:"genesisHash"`
+	ChainID         string `json:"chainId"`
+	BestHeight      uint64 `json:"bestHeight"`
+	NodeID          string `json:"nodeId"`
+	ListenPort      string `json:"listenPort"`
+}
+
 // Message is the wire format for P2P communication.
+//
+// Blocks are synchronized headers first: GET_HEADERS carries a block locator
+// (see blockchain.Locator) and is answered by HEADERS with the main chain
+// headers following the latest block in common. GET_BLOCKS asks for Count
+// main chain blocks starting at height From and is answered by BLOCKS.
+//
+// GETADDR asks a peer for the addresses it knows and is answered by ADDR
+// with up to MaxAddrPerMessage host:port pairs in Addrs.
+//
+// New transactions and blocks are announced by ID or hash in an INV. A peer
+// that has not seen them asks for them with GETDATA and is sent a
+// TRANSACTION or BLOCK message for each item it asked for.
 type Message struct {
-	Type        string                    `json:"type"`
-	Transaction *blockchain.Transaction   `json:"transaction,omitempty"`
-	Block       *blockchain.Block         `json:"block,omitempty"`
-	Chain       []blockchain.Block        `json:"chain,omitempty"`
-	SenderAddr  string                    `json:"senderAddr,omitempty"`
+	Type        string                  `json:"type"`
+	Transaction *blockchain.Transaction `json:"transaction,omitempty"`
+	Block       *blockchain.Block       `json:"block,omitempty"`
+	Headers     []blockchain.Block      `json:"headers,omitempty"`
+	Blocks      []blockchain.Block      `json:"blocks,omitempty"`
+	Locator     []string                `json:"locator,omitempty"`
+	From        uint64                  `json:"from,omitempty"`
+	Count       uint64                  `json:"count,omitempty"`
+	Addrs       []string                `json:"addrs,omitempty"`
+	Inventory   []InvItem               `json:"inventory,omitempty"`
+	Version     *Version                `json:"version,omitempty"`
+	SenderAddr  string                  `json:"senderAddr,omitempty"`
+}
+
+// wireMessage overrides the block and transaction fields of Message so they
+// travel in their canonical binary encoding inside the JSON envelope. Headers
+// use the header encoding, without transactions.
+type wireMessage struct {
+	messageFields
+	Transaction []byte   `json:"transaction,omitempty"`
+	Block       []byte   `json:"block,omitempty"`
+	Headers     [][]byte `json:"headers,omitempty"`
+	Blocks      [][]byte `json:"blocks,omitempty"`
+}
+
+// messageFields has the fields of Message without its methods, so embedding
+// it in wireMessage does not recurse into MarshalJSON.
+type messageFields Message
+
+// MarshalJSON encodes the message envelope for the wire.
+func (m Message) MarshalJSON() ([]byte, error) {
+	w := wireMessage{messageFields: messageFields(m)}
+	var err error
+	if m.Transaction != nil {
+		if w.Transaction, err = m.Transaction.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	if m.Block != nil {
+		if w.Block, err = m.Block.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range m.Headers {
+		w.Headers = append(w.Headers, m.Headers[i].HeaderBytes())
+	}
+	for i := range m.Blocks {
+		data, err := m.Blocks[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		w.Blocks = append(w.Blocks, data)
+	}
+	return json.Marshal(w)
+}
+
+// UnmarshalJSON decodes a message envelope read from the wire.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var w wireMessage
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*m = Message(w.messageFields)
+	m.Transaction, m.Block, m.Headers, m.Blocks = nil, nil, nil, nil
+
+	if w.Transaction != nil {
+		m.Transaction = &blockchain.Transaction{}
+		if err := m.Transaction.UnmarshalBinary(w.Transaction); err != nil {
+			return err
+		}
+	}
+	if w.Block != nil {
+		m.Block = &blockchain.Block{}
+		if err := m.Block.UnmarshalBinary(w.Block); err != nil {
+			return err
+		}
+	}
+	if w.Headers != nil {
+		m.Headers = make([]blockchain.Block, len(w.Headers))
+		for i := range w.Headers {
+			if err := m.Headers[i].UnmarshalHeader(w.Headers[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if w.Blocks != nil {
+		m.Blocks = make([]blockchain.Block, len(w.Blocks))
+		for i := range w.Blocks {
+			if err := m.Blocks[i].UnmarshalBinary(w.Blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // WriteMessage writes a length-prefixed JSON message to a connection.
@@ -15,12 +15,13 @@ func TestMessageFraming(t *testing.T) {
 
 	// Test transaction message
 	tx := &blockchain.Transaction{
-		ID:       "test-tx-id",
 		Sender:   "sender-addr",
 		Receiver: "receiver-addr",
 		Amount:   100,
 		Fee:      1,
 	}
+	// IDs are derived from the encoded fields rather than sent on the wire
+	tx.ID = tx.CalculateHash()
 
 	sent := Message{
 		Type:        MsgTransaction,
@@ -61,10 +62,10 @@ func TestBlockMessage(t *testing.T) {
 
 	block := &blockchain.Block{
 		Index:    5,
-		Hash:     "0000abc123",
 		PrevHash: "0000def456",
 		Miner:    "miner1",
 	}
+	block.Hash = blockchain.CalculateBlockHash(block)
 
 	sent := Message{
 		Type:  MsgBlock,
@@ -86,8 +87,8 @@ func TestBlockMessage(t *testing.T) {
 	if received.Block.Index != 5 {
 		t.Errorf("expected block index 5, got %d", received.Block.Index)
 	}
-	if received.Block.Hash != "0000abc123" {
-		t.Errorf("expected hash '0000abc123', got '%s'", received.Block.Hash)
+	if received.Block.Hash != block.Hash {
+		t.Errorf("expected hash '%s', got '%s'", block.Hash, received.Block.Hash)
 	}
 }
 
@@ -109,3 +110,44 @@ func TestPingPong(t *testing.T) {
 		t.Errorf("expected PING, got %s", received.Type)
 	}
 }
+
+func TestBlocksMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	blocks := []blockchain.Block{
+		{Index: 0, PrevHash: "0", Transactions: []blockchain.Transaction{}},
+		{Index: 1, Miner: "miner1", Transactions: []blockchain.Transaction{*blockchain.NewCoinbaseTx("miner1", 5)}},
+	}
+	for i := range blocks {
+		blocks[i].Hash = blockchain.CalculateBlockHash(&blocks[i])
+	}
+
+	go func() {
+		WriteMessage(client, Message{Type: MsgBlocks, Blocks: blocks, Headers: blocks})
+	}()
+
+	received, err := ReadMessage(server)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	if len(received.Blocks) != len(blocks) || len(received.Headers) != len(blocks) {
+		t.Fatalf("expected %d blocks and headers, got %d and %d", len(blocks), len(received.Blocks), len(received.Headers))
+	}
+	for i := range blocks {
+		if received.Blocks[i].Hash != blocks[i].Hash {
+			t.Errorf("block %d: expected hash %s, got %s", i, blocks[i].Hash, received.Blocks[i].Hash)
+		}
+		if received.Headers[i].Hash != blocks[i].Hash {
+			t.Errorf("header %d: expected hash %s, got %s", i, blocks[i].Hash, received.Headers[i].Hash)
+		}
+	}
+	if received.Blocks[1].Transactions[0].ID != blocks[1].Transactions[0].ID {
+		t.Error("transactions should survive the round trip")
+	}
+	if received.Headers[1].Transactions != nil {
+		t.Error("headers should travel without transactions")
+	}
+}
@@ -1,178 +1,653 @@
 package p2p
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/nawesan12/fernet-token/packages/blockchain"
 )
 
+// HandshakeTimeout bounds the VERSION/VERACK exchange on a new connection.
+const HandshakeTimeout = 10 * time.Second
+
+const (
+	// DefaultMaxInbound and DefaultMaxOutbound are the connection limits of a
+	// new server.
+	DefaultMaxInbound  = 32
+	DefaultMaxOutbound = 8
+
+	dialInterval = 5 * time.Second
+
+	// A persistent peer that cannot be reached is dialed again after
+	// redialBaseDelay, doubling after every failure up to redialMaxDelay.
+	// A connection dropped before minPeerUptime counts as a failure.
+	redialBaseDelay = time.Second
+	redialMaxDelay  = 5 * time.Minute
+	minPeerUptime   = time.Minute
+
+	// Messages to a peer wait in a queue of sendQueueSize for its writer
+	// goroutine. A peer that lets the queue fill up, or does not accept a
+	// message within writeTimeout, is disconnected.
+	sendQueueSize = 256
+	writeTimeout  = 30 * time.Second
+
+	// maxAddrsPerPeer bounds the addresses a connection may add to the peer
+	// book, so a single peer cannot replace most of it.
+	maxAddrsPerPeer = 250
+)
+
+var (
+	// ErrServerStopped is returned when connecting through a stopped server.
+	ErrServerStopped = errors.New("p2p server stopped")
+
+	errConnectedToSelf = errors.New("connected to self")
+	errSendQueueFull   = errors.New("send queue full")
+	errPeerGone        = errors.New("peer disconnected")
+)
+
+// Limits bounds the connections of a server. Outbound slots are filled by
+// dialing addresses from the peer book; persistent peers are dialed even
+// when they are full.
+type Limits struct {
+	MaxInbound  int
+	MaxOutbound int
+}
+
+// DefaultLimits returns the limits of a new server.
+func DefaultLimits() Limits {
+	return Limits{MaxInbound: DefaultMaxInbound, MaxOutbound: DefaultMaxOutbound}
+}
+
 // MessageHandler is called when a message is received from a peer.
 type MessageHandler func(Message)
 
 type peer struct {
-	addr string
-	conn net.Conn
+	addr       string
+	listenAddr string // address the peer accepts connections on, if known
+	outbound   bool
+	conn       net.Conn
+	version    Version
+	queue      chan Message  // messages waiting for writeLoop
+	done       chan struct{} // closed once the peer is disconnected
+	known      *inventorySet // inventory the peer sent us or was sent
+	addrs      int           // addresses taken from its ADDR messages, used by readLoop only
+}
+
+func newPeer(addr string, conn net.Conn, version Version) *peer {
+	return &peer{
+		addr:    addr,
+		conn:    conn,
+		version: version,
+		queue:   make(chan Message, sendQueueSize),
+		done:    make(chan struct{}),
+		known:   newInventorySet(knownInventorySize),
+	}
+}
+
+// send queues a message for the peer without blocking. A peer whose queue
+// is full is too slow to keep up and is disconnected.
+func (p *peer) send(msg Message) error {
+	select {
+	case <-p.done:
+		return errPeerGone
+	default:
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		p.conn.Close()
+		return errSendQueueFull
+	}
+}
+
+// writeLoop writes queued messages to the connection until the peer is
+// disconnected, closing the connection if a write fails or times out.
+func (p *peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.queue:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := WriteMessage(p.conn, msg); err != nil {
+				log.Printf("P2P: failed to send %s to %s: %v", msg.Type, p.addr, err)
+				p.conn.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
 }
 
 type P2PServer struct {
-	port     string
-	handler  MessageHandler
-	peers    map[string]*peer
-	mu       sync.RWMutex
-	listener net.Listener
-	quit     chan struct{}
+	port        string
+	nodeID      string
+	chain       *blockchain.Blockchain
+	genesisHash string
+	handler     MessageHandler
+	peers       map[string]*peer
+	mu          sync.RWMutex
+	listener    net.Listener
+
+	// Stop cancels ctx, closes every connection in conns, including those
+	// still in the handshake, and waits for the goroutines in wg.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+	stopped bool
+
+	// seen holds the inventory the handler accepted and announced to peers;
+	// requested holds items asked for with GETDATA and when.
+	seen      *inventorySet
+	invMu     sync.Mutex
+	requested map[InvItem]time.Time
+
+	book         *PeerBook
+	limits       Limits
+	persistent   map[string]bool
+	dialInterval time.Duration
 }
 
-func NewP2PServer(port string, handler MessageHandler) *P2PServer {
+// NewP2PServer creates a server for chain. The genesis hash, chain ID and
+// height of chain are announced to peers in the handshake.
+func NewP2PServer(port string, chain *blockchain.Blockchain, handler MessageHandler) *P2PServer {
+	var id [8]byte
+	rand.Read(id[:])
+
+	genesisHash := ""
+	if genesis, err := chain.GetBlock(0); err == nil {
+		genesisHash = genesis.Hash
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &P2PServer{
-		port:    port,
-		handler: handler,
-		peers:   make(map[string]*peer),
-		quit:    make(chan struct{}),
+		port:        port,
+		nodeID:      hex.EncodeToString(id[:]),
+		chain:       chain,
+		genesisHash: genesisHash,
+		handler:     handler,
+		peers:       make(map[string]*peer),
+
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]bool),
+
+		seen:      newInventorySet(seenInventorySize),
+		requested: make(map[InvItem]time.Time),
+
+		book:         NewPeerBook(),
+		limits:       DefaultLimits(),
+		persistent:   make(map[string]bool),
+		dialInterval: dialInterval,
 	}
 }
 
-// Start listens for incoming TCP connections.
+// SetLimits replaces the connection limits. Peers already connected beyond
+// the new limits stay connected.
+func (s *P2PServer) SetLimits(limits Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+}
+
+// SetPeerBook replaces the in-memory peer book the server starts with, for
+// instance with one loaded from the data directory. It must be called before
+// Start.
+func (s *P2PServer) SetPeerBook(book *PeerBook) {
+	s.book = book
+}
+
+// PeerBook returns the addresses the server knows about.
+func (s *P2PServer) PeerBook() *PeerBook {
+	return s.book
+}
+
+// NodeID returns the random identifier this server announces to peers. It
+// changes every time the node starts.
+func (s *P2PServer) NodeID() string {
+	return s.nodeID
+}
+
+// Start listens for incoming TCP connections and fills the outbound slots by
+// dialing peers from the peer book. It returns once the server is stopped.
 func (s *P2PServer) Start() {
 	ln, err := net.Listen("tcp", ":"+s.port)
 	if err != nil {
 		log.Printf("P2P: failed to listen on port %s: %v", s.port, err)
 		return
 	}
-	s.listener = ln
 	log.Printf("P2P: listening on port %s", s.port)
 
+	s.spawn(s.dialLoop)
+	s.serve(ln)
+}
+
+// serve accepts connections on ln until the server stops.
+func (s *P2PServer) serve(ln net.Listener) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		ln.Close()
+		return
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			select {
-			case <-s.quit:
+			if s.ctx.Err() != nil {
 				return
-			default:
-				log.Printf("P2P: accept error: %v", err)
-				continue
 			}
+			log.Printf("P2P: accept error: %v", err)
+			continue
+		}
+		if !s.spawn(func() { s.handleConn(conn) }) {
+			conn.Close()
 		}
-		go s.handleConn(conn)
 	}
 }
 
-func (s *P2PServer) handleConn(conn net.Conn) {
-	addr := conn.RemoteAddr().String()
+// spawn runs f in a goroutine Stop waits for. It returns false without
+// running f once the server is stopped.
+func (s *P2PServer) spawn(f func()) bool {
 	s.mu.Lock()
-	s.peers[addr] = &peer{addr: addr, conn: conn}
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// trackConn registers an open connection for Stop to close. It returns false
+// once the server is stopped.
+func (s *P2PServer) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
 
-	log.Printf("P2P: peer connected: %s", addr)
+// closeConn closes a connection and forgets it.
+func (s *P2PServer) closeConn(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
 
-	defer func() {
+func (s *P2PServer) handleConn(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	if !s.trackConn(conn) {
 		conn.Close()
-		s.mu.Lock()
-		delete(s.peers, addr)
-		s.mu.Unlock()
-		log.Printf("P2P: peer disconnected: %s", addr)
-	}()
+		return
+	}
+	if s.inboundFull() {
+		log.Printf("P2P: rejecting %s: too many inbound peers", addr)
+		s.closeConn(conn)
+		return
+	}
 
-	for {
-		msg, err := ReadMessage(conn)
-		if err != nil {
-			return
-		}
+	version, err := s.handshake(conn)
+	if err != nil {
+		log.Printf("P2P: handshake with %s failed: %v", addr, err)
+		s.closeConn(conn)
+		return
+	}
 
-		if msg.Type == MsgPing {
-			WriteMessage(conn, Message{Type: MsgPong})
-			continue
-		}
+	// Remember where the peer says it listens so it can be dialed. The
+	// address is only vouched for, and shared, once a dial to it succeeds.
+	listenAddr := ""
+	if host, _, err := net.SplitHostPort(addr); err == nil && version.ListenPort != "" {
+		listenAddr = net.JoinHostPort(host, version.ListenPort)
+		s.book.Add(listenAddr)
+	}
 
-		msg.SenderAddr = addr
-		s.handler(msg)
+	p := newPeer(addr, conn, version)
+	p.listenAddr = listenAddr
+	if err := s.addPeer(p); err != nil {
+		log.Printf("P2P: rejecting %s: %v", addr, err)
+		s.closeConn(conn)
+		return
 	}
+	log.Printf("P2P: peer connected: %s (node %s, height %d)", addr, version.NodeID, version.BestHeight)
+	s.readLoop(p)
+	log.Printf("P2P: peer disconnected: %s", addr)
 }
 
-// ConnectToPeer establishes a persistent outbound connection to a peer.
+// ConnectToPeer opens an outbound connection to a peer. It fails if the peer
+// does not complete the handshake or is on another chain. The outcome is
+// recorded in the peer book. The connection is not restored if it drops; see
+// AddPersistentPeer.
 func (s *P2PServer) ConnectToPeer(address string) error {
-	conn, err := net.Dial("tcp", address)
+	s.book.Attempt(address)
+	dialer := net.Dialer{Timeout: HandshakeTimeout}
+	conn, err := dialer.DialContext(s.ctx, "tcp", address)
 	if err != nil {
+		if s.ctx.Err() != nil {
+			return ErrServerStopped
+		}
+		s.book.Failed(address)
 		return err
 	}
+	if !s.trackConn(conn) {
+		conn.Close()
+		return ErrServerStopped
+	}
 
+	version, err := s.handshake(conn)
+	if err != nil {
+		s.closeConn(conn)
+		if errors.Is(err, errConnectedToSelf) {
+			s.book.MarkSelf(address)
+		} else {
+			s.book.Failed(address)
+		}
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	s.book.Good(address)
+
+	p := newPeer(address, conn, version)
+	p.listenAddr = address
+	p.outbound = true
+	if err := s.addPeer(p); err != nil {
+		s.closeConn(conn)
+		return err
+	}
+	log.Printf("P2P: connected to peer: %s (node %s, height %d)", address, version.NodeID, version.BestHeight)
+
+	// Learn more addresses from the peer
+	if version.ProtocolVersion >= AddrProtocolVersion {
+		s.Send(address, Message{Type: MsgGetAddr})
+	}
+
+	// Start listening for messages from this peer. If the server stopped in
+	// the meantime the connection is already closed and readLoop returns
+	// straight away.
+	readLoop := func() {
+		s.readLoop(p)
+		log.Printf("P2P: outbound peer disconnected: %s", address)
+	}
+	if !s.spawn(readLoop) {
+		readLoop()
+	}
+
+	return nil
+}
+
+// AddPersistentPeer keeps the server connected to address until it stops.
+// The peer is dialed straight away and again whenever the connection drops;
+// failed dials are retried with exponential backoff.
+func (s *P2PServer) AddPersistentPeer(address string) {
 	s.mu.Lock()
-	s.peers[address] = &peer{addr: address, conn: conn}
+	known := s.persistent[address]
+	s.persistent[address] = true
 	s.mu.Unlock()
 
-	log.Printf("P2P: connected to peer: %s", address)
+	if !known {
+		s.spawn(func() { s.keepConnected(address) })
+	}
+}
 
-	// Start listening for messages from this peer
-	go func() {
-		defer func() {
-			conn.Close()
-			s.mu.Lock()
-			delete(s.peers, address)
-			s.mu.Unlock()
-			log.Printf("P2P: outbound peer disconnected: %s", address)
-		}()
-
-		for {
-			msg, err := ReadMessage(conn)
+func (s *P2PServer) keepConnected(address string) {
+	delay := redialBaseDelay
+	for {
+		done := s.peerDone(address)
+		if done == nil {
+			err := s.ConnectToPeer(address)
+			if errors.Is(err, ErrServerStopped) {
+				return
+			}
 			if err != nil {
+				log.Printf("P2P: failed to connect to persistent peer %s, retrying in %v: %v", address, delay, err)
+			}
+			done = s.peerDone(address)
+		}
+		if done != nil {
+			// Connected, maybe by the peer; wait for the connection to drop.
+			// Only a connection that stayed up resets the backoff, so a peer
+			// that drops us straight away is not redialed in a tight loop.
+			connected := time.Now()
+			select {
+			case <-done:
+			case <-s.ctx.Done():
 				return
 			}
-
-			if msg.Type == MsgPing {
-				WriteMessage(conn, Message{Type: MsgPong})
-				continue
+			if time.Since(connected) >= minPeerUptime {
+				delay = redialBaseDelay
 			}
+		}
 
-			msg.SenderAddr = address
-			s.handler(msg)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return
 		}
-	}()
+		delay = min(delay*2, redialMaxDelay)
+	}
+}
 
-	// Request blocks from the peer
-	WriteMessage(conn, Message{Type: MsgGetBlocks})
+// peerDone returns the done channel of the peer connected at or listening
+// on address, or nil if there is none.
+func (s *P2PServer) peerDone(address string) chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.peers {
+		if p.addr == address || p.listenAddr == address {
+			return p.done
+		}
+	}
+	return nil
+}
+
+// localVersion describes this node for the handshake.
+func (s *P2PServer) localVersion() *Version {
+	return &Version{
+		ProtocolVersion: ProtocolVersion,
+		GenesisHash:     s.genesisHash,
+		ChainID:         s.chain.ChainID(),
+		BestHeight:      s.chain.Height() - 1,
+		NodeID:          s.nodeID,
+		ListenPort:      s.port,
+	}
+}
+
+// handshake exchanges VERSION and VERACK messages on a new connection. Both
+// sides send VERSION first, check the one they receive and acknowledge it;
+// the connection is usable once each side has seen the other's VERACK.
+func (s *P2PServer) handshake(conn net.Conn) (Version, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
 
+	if err := WriteMessage(conn, Message{Type: MsgVersion, Version: s.localVersion()}); err != nil {
+		return Version{}, err
+	}
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return Version{}, err
+	}
+	if msg.Type != MsgVersion || msg.Version == nil {
+		return Version{}, fmt.Errorf("expected %s, got %s", MsgVersion, msg.Type)
+	}
+	version := *msg.Version
+	if err := s.checkVersion(&version); err != nil {
+		return Version{}, err
+	}
+
+	if err := WriteMessage(conn, Message{Type: MsgVerack}); err != nil {
+		return Version{}, err
+	}
+	msg, err = ReadMessage(conn)
+	if err != nil {
+		return Version{}, err
+	}
+	if msg.Type != MsgVerack {
+		return Version{}, fmt.Errorf("expected %s, got %s", MsgVerack, msg.Type)
+	}
+	return version, nil
+}
+
+// checkVersion decides whether a peer may stay connected.
+func (s *P2PServer) checkVersion(v *Version) error {
+	if v.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", v.ProtocolVersion)
+	}
+	if v.GenesisHash != s.genesisHash {
+		return fmt.Errorf("peer is on genesis %s, expected %s", v.GenesisHash, s.genesisHash)
+	}
+	if v.ChainID != s.chain.ChainID() {
+		return fmt.Errorf("peer is on chain %s, expected %s", v.ChainID, s.chain.ChainID())
+	}
+	if v.NodeID == s.nodeID {
+		return errConnectedToSelf
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.peers {
+		if p.version.NodeID == v.NodeID {
+			return fmt.Errorf("already connected to node %s", v.NodeID)
+		}
+	}
 	return nil
 }
 
-// BroadcastTransaction sends a transaction to all connected peers.
+// addPeer registers a peer that completed the handshake, starts its writer
+// and passes its VERSION message to the handler, so the node can start
+// syncing from it. It fails if the inbound slots filled up during the
+// handshake.
+func (s *P2PServer) addPeer(p *peer) error {
+	s.mu.Lock()
+	if !p.outbound && s.inboundFullLocked() {
+		s.mu.Unlock()
+		return errors.New("too many inbound peers")
+	}
+	s.peers[p.addr] = p
+	s.mu.Unlock()
+	s.spawn(p.writeLoop)
+
+	version := p.version
+	s.handler(Message{Type: MsgVersion, Version: &version, SenderAddr: p.addr})
+	return nil
+}
+
+// readLoop passes messages from a connected peer to the handler until the
+// connection fails, then removes the peer.
+func (s *P2PServer) readLoop(p *peer) {
+	addr := p.addr
+	defer func() {
+		s.closeConn(p.conn)
+		s.mu.Lock()
+		delete(s.peers, addr)
+		s.mu.Unlock()
+		close(p.done)
+	}()
+
+	for {
+		msg, err := ReadMessage(p.conn)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case MsgPing:
+			s.Send(addr, Message{Type: MsgPong})
+			continue
+		case MsgVersion, MsgVerack:
+			// The handshake is over; repeats are ignored
+			continue
+		case MsgGetAddr:
+			s.Send(addr, Message{Type: MsgAddr, Addrs: s.book.Addresses(MaxAddrPerMessage)})
+			continue
+		case MsgAddr:
+			if len(msg.Addrs) <= MaxAddrPerMessage {
+				addrs := msg.Addrs[:min(len(msg.Addrs), maxAddrsPerPeer-p.addrs)]
+				p.addrs += len(addrs)
+				s.book.Add(addrs...)
+			}
+			continue
+		case MsgInv:
+			if len(msg.Inventory) > MaxInvPerMessage {
+				continue
+			}
+			for _, item := range msg.Inventory {
+				p.known.Add(item)
+			}
+			if want := s.wanted(msg.Inventory); len(want) > 0 {
+				s.Send(addr, Message{Type: MsgGetData, Inventory: want})
+			}
+			continue
+		case MsgGetData:
+			if len(msg.Inventory) > MaxInvPerMessage {
+				continue
+			}
+		}
+
+		s.received(p, &msg)
+		msg.SenderAddr = addr
+		s.handler(msg)
+	}
+}
+
+// BroadcastTransaction announces a transaction to the connected peers that
+// have not sent or been sent it. Relaying a transaction received from a peer
+// does not announce it back to that peer.
 func (s *P2PServer) BroadcastTransaction(tx *blockchain.Transaction) {
-	msg := Message{Type: MsgTransaction, Transaction: tx}
-	s.broadcast(msg)
+	item := InvItem{Type: InvTransaction, Hash: tx.ID}
+	s.announce(item, Message{Type: MsgTransaction, Transaction: tx})
 }
 
-// BroadcastBlock sends a block to all connected peers.
+// BroadcastBlock announces a block like BroadcastTransaction.
 func (s *P2PServer) BroadcastBlock(block *blockchain.Block) {
-	msg := Message{Type: MsgBlock, Block: block}
-	s.broadcast(msg)
+	item := InvItem{Type: InvBlock, Hash: block.Hash}
+	s.announce(item, Message{Type: MsgBlock, Block: block})
 }
 
-// SendChain sends the full chain to a specific peer.
-func (s *P2PServer) SendChain(addr string, chain []blockchain.Block) {
+// Send queues a message for a specific peer. It does not wait for the
+// message to be written.
+func (s *P2PServer) Send(addr string, msg Message) error {
 	s.mu.RLock()
 	p, ok := s.peers[addr]
 	s.mu.RUnlock()
 
 	if !ok {
-		log.Printf("P2P: peer %s not found for SendChain", addr)
-		return
+		return fmt.Errorf("peer %s not found", addr)
 	}
-
-	msg := Message{Type: MsgChain, Chain: chain}
-	if err := WriteMessage(p.conn, msg); err != nil {
-		log.Printf("P2P: failed to send chain to %s: %v", addr, err)
+	if item, ok := inventoryOf(&msg); ok {
+		p.known.Add(item)
+	}
+	if err := p.send(msg); err != nil {
+		return fmt.Errorf("failed to send %s to %s: %w", msg.Type, addr, err)
 	}
+	return nil
 }
 
-func (s *P2PServer) broadcast(msg Message) {
+// DisconnectPeer closes the connection to a peer, for instance after it sent
+// invalid data.
+func (s *P2PServer) DisconnectPeer(addr string) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	p, ok := s.peers[addr]
+	s.mu.RUnlock()
 
-	for addr, p := range s.peers {
-		if err := WriteMessage(p.conn, msg); err != nil {
-			log.Printf("P2P: failed to send to %s: %v", addr, err)
-		}
+	if ok {
+		p.conn.Close()
 	}
 }
 
@@ -183,6 +658,23 @@ func (s *P2PServer) PeerCount() int {
 	return len(s.peers)
 }
 
+// inboundFull reports whether the inbound slots are all taken.
+func (s *P2PServer) inboundFull() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inboundFullLocked()
+}
+
+func (s *P2PServer) inboundFullLocked() bool {
+	inbound := 0
+	for _, p := range s.peers {
+		if !p.outbound {
+			inbound++
+		}
+	}
+	return inbound >= s.limits.MaxInbound
+}
+
 // PeerAddresses returns the addresses of all connected peers.
 func (s *P2PServer) PeerAddresses() []string {
 	s.mu.RLock()
@@ -195,17 +687,96 @@ func (s *P2PServer) PeerAddresses() []string {
 	return addrs
 }
 
-// Stop shuts down the P2P server.
+// PeerVersion returns the VERSION message a connected peer sent in its
+// handshake.
+func (s *P2PServer) PeerVersion(addr string) (Version, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.peers[addr]
+	if !ok {
+		return Version{}, false
+	}
+	return p.version, true
+}
+
+// dialLoop tops up outbound connections from the peer book and saves the
+// book until the server stops.
+func (s *P2PServer) dialLoop() {
+	ticker := time.NewTicker(s.dialInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.dialPeers()
+			if err := s.book.Save(); err != nil {
+				log.Printf("P2P: failed to save peer book: %v", err)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// dialPeers dials as many addresses from the peer book as there are free
+// outbound slots, skipping peers already connected and persistent peers,
+// which are dialed on their own.
+func (s *P2PServer) dialPeers() {
+	exclude := make(map[string]bool)
+	outbound := 0
+	s.mu.RLock()
+	for addr, p := range s.peers {
+		exclude[addr] = true
+		if p.listenAddr != "" {
+			exclude[p.listenAddr] = true
+		}
+		if p.outbound {
+			outbound++
+		}
+	}
+	for addr := range s.persistent {
+		exclude[addr] = true
+	}
+	free := s.limits.MaxOutbound - outbound
+	s.mu.RUnlock()
+
+	if free <= 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, addr := range s.book.Candidates(free, exclude) {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := s.ConnectToPeer(addr); err != nil {
+				log.Printf("P2P: failed to connect to %s: %v", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// Stop shuts down the P2P server: it stops listening and dialing, closes
+// every connection and waits for the goroutines serving them to return
+// before saving the peer book. Calling it again has no effect.
 func (s *P2PServer) Stop() {
-	close(s.quit)
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	s.cancel()
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for _, p := range s.peers {
-		p.conn.Close()
+	s.wg.Wait()
+	if err := s.book.Save(); err != nil {
+		log.Printf("P2P: failed to save peer book: %v", err)
 	}
-	s.peers = make(map[string]*peer)
 }
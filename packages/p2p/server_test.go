@@ -0,0 +1,377 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nawesan12/fernet-token/packages/blockchain"
+)
+
+func testChain(t *testing.T, genesis *blockchain.Genesis) *blockchain.Blockchain {
+	t.Helper()
+	bc, err := blockchain.NewBlockchain(blockchain.NewMemoryStorage(), genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+// testServer returns a server accepting connections on a loopback port, and
+// a channel receiving the messages passed to its handler.
+func testServer(t *testing.T, bc *blockchain.Blockchain) (*P2PServer, string, chan Message) {
+	t.Helper()
+	received := make(chan Message, 16)
+	s, addr := newTestServer(t, bc, func(msg Message) { received <- msg })
+	return s, addr, received
+}
+
+// newTestServer returns a server with handler accepting connections on a
+// loopback port.
+func newTestServer(t *testing.T, bc *blockchain.Blockchain, handler MessageHandler) (*P2PServer, string) {
+	t.Helper()
+	s := NewP2PServer("0", bc, handler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s.port, _ = net.SplitHostPort(ln.Addr().String())
+	go s.serve(ln)
+	t.Cleanup(s.Stop)
+	return s, ln.Addr().String()
+}
+
+func waitForPeers(t *testing.T, s *P2PServer, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.PeerCount() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d peers, have %d", want, s.PeerCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	bc := testChain(t, nil)
+	bc.MineBlock("miner1", nil)
+	a, addr, received := testServer(t, bc)
+	b, _, _ := testServer(t, testChain(t, nil))
+
+	if err := b.ConnectToPeer(addr); err != nil {
+		t.Fatalf("ConnectToPeer failed: %v", err)
+	}
+	waitForPeers(t, a, 1)
+
+	version, ok := b.PeerVersion(addr)
+	if !ok || version.NodeID != a.NodeID() || version.BestHeight != 1 || version.ProtocolVersion != ProtocolVersion {
+		t.Errorf("unexpected peer version: %+v", version)
+	}
+
+	// Once the handshake completes the peer's VERSION reaches the handler
+	select {
+	case msg := <-received:
+		if msg.Type != MsgVersion || msg.Version.NodeID != b.NodeID() {
+			t.Errorf("expected %s from %s, got %+v", MsgVersion, b.NodeID(), msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received after handshake")
+	}
+}
+
+func TestHandshakeRejectsOtherGenesis(t *testing.T) {
+	a, addr, received := testServer(t, testChain(t, nil))
+	other := blockchain.DefaultGenesis()
+	other.ChainID = "fernet-other"
+	b, _, _ := testServer(t, testChain(t, other))
+
+	if err := b.ConnectToPeer(addr); err == nil {
+		t.Fatal("peer on another chain should be rejected")
+	}
+	if b.PeerCount() != 0 || a.PeerCount() != 0 {
+		t.Errorf("no peers should remain, have %d and %d", b.PeerCount(), a.PeerCount())
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("handler should not be called, got %s", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandshakeRejectsSelf(t *testing.T) {
+	a, addr, _ := testServer(t, testChain(t, nil))
+	if err := a.ConnectToPeer(addr); err == nil {
+		t.Fatal("connecting to self should fail")
+	}
+}
+
+func TestHandshakeRequiresVersionFirst(t *testing.T) {
+	a, addr, received := testServer(t, testChain(t, nil))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteMessage(conn, Message{Type: MsgGetBlocks}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's VERSION arrives, then the connection is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if msg, err := ReadMessage(conn); err != nil || msg.Type != MsgVersion {
+		t.Fatalf("expected %s, got %+v, %v", MsgVersion, msg, err)
+	}
+	if _, err := ReadMessage(conn); err == nil {
+		t.Error("connection should be closed")
+	}
+	if a.PeerCount() != 0 || len(received) != 0 {
+		t.Errorf("peer should not be accepted, have %d peers and %d messages", a.PeerCount(), len(received))
+	}
+}
+
+func TestAddressExchange(t *testing.T) {
+	a, _, _ := testServer(t, testChain(t, nil))
+	b, addrB, _ := testServer(t, testChain(t, nil))
+	c, addrC, _ := testServer(t, testChain(t, nil))
+
+	// b dials c, so it can vouch for c's address
+	if err := b.ConnectToPeer(addrC); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, c, 1)
+
+	// a asks b for addresses after connecting and dials c on its own
+	a.dialInterval = 20 * time.Millisecond
+	a.spawn(a.dialLoop)
+	if err := a.ConnectToPeer(addrB); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, c, 2)
+	waitForPeers(t, a, 2)
+
+	if _, ok := a.PeerVersion(addrC); !ok {
+		t.Errorf("a should be connected to c, has %v", a.PeerAddresses())
+	}
+	for _, p := range a.PeerBook().Peers() {
+		if p.LastSeen == 0 || p.Failures != 0 {
+			t.Errorf("unexpected peer book entry %+v", p)
+		}
+	}
+	if a.PeerBook().Len() != 2 {
+		t.Errorf("expected b and c in the peer book, have %+v", a.PeerBook().Peers())
+	}
+
+	// c only heard from its inbound peers where they listen
+	if c.PeerBook().Len() != 2 {
+		t.Errorf("expected a and b in c's peer book, have %+v", c.PeerBook().Peers())
+	}
+	if addrs := c.PeerBook().Addresses(MaxAddrPerMessage); len(addrs) != 0 {
+		t.Errorf("addresses of inbound peers should not be shared before they are dialed, got %v", addrs)
+	}
+}
+
+func TestAddressesAcceptedPerPeerAreCapped(t *testing.T) {
+	a, addrA, _ := testServer(t, testChain(t, nil))
+	b, _, _ := testServer(t, testChain(t, nil))
+	if err := b.ConnectToPeer(addrA); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	for n := 0; n < 2; n++ {
+		addrs := make([]string, 200)
+		for i := range addrs {
+			addrs[i] = fmt.Sprintf("10.%d.0.%d:6000", n, i)
+		}
+		if err := b.Send(addrA, Message{Type: MsgAddr, Addrs: addrs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b's listen address is in the book too
+	deadline := time.Now().Add(2 * time.Second)
+	for a.PeerBook().Len() < maxAddrsPerPeer+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d addresses, have %d", maxAddrsPerPeer+1, a.PeerBook().Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, p := range a.PeerBook().Peers() {
+		if p.Address == "10.1.0.199:6000" {
+			t.Errorf("addresses past the per-peer cap should be ignored")
+		}
+	}
+}
+
+func TestPersistentPeerReconnects(t *testing.T) {
+	a, _, _ := testServer(t, testChain(t, nil))
+	b, addrB, _ := testServer(t, testChain(t, nil))
+
+	a.AddPersistentPeer(addrB)
+	waitForPeers(t, b, 1)
+
+	// b drops the connection and a dials it again
+	b.DisconnectPeer(b.PeerAddresses()[0])
+	waitForPeers(t, a, 0)
+	waitForPeers(t, b, 1)
+	if _, ok := a.PeerVersion(addrB); !ok {
+		t.Errorf("a should be connected to b again, has %v", a.PeerAddresses())
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	a, addrA, _ := testServer(t, testChain(t, nil))
+	a.SetLimits(Limits{MaxInbound: 1, MaxOutbound: DefaultMaxOutbound})
+	b, _, _ := testServer(t, testChain(t, nil))
+	c, _, _ := testServer(t, testChain(t, nil))
+
+	if err := b.ConnectToPeer(addrA); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+	if err := c.ConnectToPeer(addrA); err == nil {
+		t.Error("connection beyond the inbound limit should be refused")
+	}
+	if a.PeerCount() != 1 || c.PeerCount() != 0 {
+		t.Errorf("expected 1 and 0 peers, have %d and %d", a.PeerCount(), c.PeerCount())
+	}
+}
+
+func TestStopWaitsForPeers(t *testing.T) {
+	a, addrA, _ := testServer(t, testChain(t, nil))
+	b, _, _ := testServer(t, testChain(t, nil))
+
+	b.AddPersistentPeer(addrA)
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	// Stop returns once the read loop removed the peer
+	b.Stop()
+	if b.PeerCount() != 0 {
+		t.Errorf("expected no peers after Stop, have %d", b.PeerCount())
+	}
+	if err := b.ConnectToPeer(addrA); !errors.Is(err, ErrServerStopped) {
+		t.Errorf("expected %v, got %v", ErrServerStopped, err)
+	}
+	waitForPeers(t, a, 0)
+}
+
+func TestSlowPeerIsDisconnected(t *testing.T) {
+	a, addr, _ := testServer(t, testChain(t, nil))
+
+	// A peer that completes the handshake and then stops reading
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	other := NewP2PServer("0", testChain(t, nil), func(Message) {})
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	WriteMessage(conn, Message{Type: MsgVersion, Version: other.localVersion()})
+	ReadMessage(conn)
+	WriteMessage(conn, Message{Type: MsgVerack})
+	if msg, err := ReadMessage(conn); err != nil || msg.Type != MsgVerack {
+		t.Fatalf("expected %s, got %+v, %v", MsgVerack, msg, err)
+	}
+	waitForPeers(t, a, 1)
+
+	// Sending never blocks; once the queue is full the peer is dropped
+	addrs := make([]string, MaxAddrPerMessage)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d:6000", i/256, i%256)
+	}
+	peer := a.PeerAddresses()[0]
+	for i := 0; a.Send(peer, Message{Type: MsgAddr, Addrs: addrs}) == nil; i++ {
+		if i == 100000 {
+			t.Fatal("the send queue never filled up")
+		}
+	}
+	waitForPeers(t, a, 0)
+}
+
+// gossipNode relays transactions like a node: it keeps those it receives,
+// announces them on and answers GETDATA for them.
+type gossipNode struct {
+	server   *P2PServer
+	addr     string
+	mu       sync.Mutex
+	txns     map[string]*blockchain.Transaction
+	received int // TRANSACTION messages received
+}
+
+func newGossipNode(t *testing.T) *gossipNode {
+	n := &gossipNode{txns: make(map[string]*blockchain.Transaction)}
+	n.server, n.addr = newTestServer(t, testChain(t, nil), n.handle)
+	return n
+}
+
+func (n *gossipNode) handle(msg Message) {
+	switch msg.Type {
+	case MsgTransaction:
+		n.mu.Lock()
+		n.received++
+		_, known := n.txns[msg.Transaction.ID]
+		n.txns[msg.Transaction.ID] = msg.Transaction
+		n.mu.Unlock()
+		if !known {
+			n.server.BroadcastTransaction(msg.Transaction)
+		}
+	case MsgGetData:
+		for _, item := range msg.Inventory {
+			n.mu.Lock()
+			tx := n.txns[item.Hash]
+			n.mu.Unlock()
+			if tx != nil {
+				n.server.Send(msg.SenderAddr, Message{Type: MsgTransaction, Transaction: tx})
+			}
+		}
+	}
+}
+
+func (n *gossipNode) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.received
+}
+
+func TestGossipReachesEveryPeerOnce(t *testing.T) {
+	// a - b - c - d - a
+	nodes := []*gossipNode{newGossipNode(t), newGossipNode(t), newGossipNode(t), newGossipNode(t)}
+	for i, n := range nodes {
+		next := nodes[(i+1)%len(nodes)]
+		if err := n.server.ConnectToPeer(next.addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range nodes {
+		waitForPeers(t, n.server, 2)
+	}
+
+	tx := blockchain.NewCoinbaseTx("miner1", 5)
+	a := nodes[0]
+	a.txns[tx.ID] = tx
+	a.server.BroadcastTransaction(tx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, n := range nodes[1:] {
+		for n.count() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Give duplicates time to arrive
+	time.Sleep(200 * time.Millisecond)
+
+	if a.count() != 0 {
+		t.Errorf("the transaction should not be sent back to its origin, got it %d times", a.count())
+	}
+	for i, n := range nodes[1:] {
+		if n.count() != 1 {
+			t.Errorf("node %d: expected the transaction once, got it %d times", i+1, n.count())
+		}
+	}
+}
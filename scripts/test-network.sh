@@ -7,12 +7,20 @@ echo "Starting two nodes and verifying sync..."
 TMPDIR=$(mktemp -d)
 trap "kill 0; rm -rf $TMPDIR" EXIT
 
+# Fund a faucet account in a genesis shared by both nodes. Its address is the
+# first 20 bytes of the SHA-256 of the public key's X||Y.
+openssl ecparam -name prime256v1 -genkey -noout -out "$TMPDIR/faucet.pem"
+FAUCET_ADDRESS=$(openssl ec -in "$TMPDIR/faucet.pem" -pubout -outform DER 2>/dev/null | tail -c 64 | sha256sum | cut -c1-40)
+echo "{\"alloc\": {\"$FAUCET_ADDRESS\": 100000000000000}}" > "$TMPDIR/genesis.json"
+
 # Start Node A
-echo "Starting Node A (HTTP:8080, P2P:6000)..."
+echo "Starting Node A (HTTP:8080, P2P:6000, faucet:$FAUCET_ADDRESS)..."
 go run ./apps/api \
     --http-port 8080 \
     --p2p-port 6000 \
-    --data-dir "$TMPDIR/nodeA" &
+    --data-dir "$TMPDIR/nodeA" \
+    --genesis "$TMPDIR/genesis.json" \
+    --faucet-key "$TMPDIR/faucet.pem" &
 NODE_A_PID=$!
 
 sleep 2
@@ -23,6 +31,7 @@ go run ./apps/api \
     --http-port 8081 \
     --p2p-port 6001 \
     --data-dir "$TMPDIR/nodeB" \
+    --genesis "$TMPDIR/genesis.json" \
     --peers "localhost:6000" &
 NODE_B_PID=$!
 